@@ -0,0 +1,14 @@
+# A GCP service account assumes an AWS IAM role, configured with the provider on AWS
+resource "mdxc_application_identity" "aws" {
+  name     = "reporting"
+  workload = "lambda"
+}
+
+resource "mdxc_identity_federation" "gcp" {
+  target_identity = mdxc_application_identity.aws.principal
+
+  source = {
+    cloud                         = "gcp"
+    gcp_service_account_unique_id = "123456789012345678901"
+  }
+}
@@ -3,19 +3,68 @@ package aws
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"terraform-provider-mdxc/internal/verify"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/aws-sdk-go-v2/service/iam/types"
 	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/structure"
 )
 
 type ApplicationIdentityConfig struct {
-	Name             string
-	IAMRoleARN       string
-	AssumeRolePolicy string
+	Name                string
+	IAMRoleARN          string
+	AssumeRolePolicy    string
+	Path                string
+	Description         string
+	MaxSessionDuration  int32
+	PermissionsBoundary string
+	Tags                map[string]string
+	KubernetesSubjects  []KubernetesSubject
+	OIDCFederation      *OIDCFederation
+	// cloud-agnostic workload preset, e.g. lambda or ec2
+	Workload                      string
+	CreateInstanceProfile         bool
+	InstanceProfileARN            string
+	PodIdentityClusterName        string
+	PodIdentityNamespace          string
+	PodIdentityServiceAccountName string
+	PodIdentityAssociationARN     string
+	ForceDetachOnDestroy          bool
+	DetachedDependencies          []string
+	// statements of identity federations found in the remote trust policy, kept on updates
+	identityFederationStatements []json.RawMessage
 }
 
-func CreateApplicationIdentity(ctx context.Context, config *ApplicationIdentityConfig, client IAMClient) error {
+// OIDCFederation trusts the tokens of an external OIDC issuer, e.g. GitHub Actions. The issuer's IAM OIDC provider
+// must already exist in the account.
+type OIDCFederation struct {
+	Issuer string
+	// defaults to sts.amazonaws.com when empty
+	Audience string
+	// the exact sub claim, or a pattern where * matches any characters
+	Subject string
+}
+
+type KubernetesSubject struct {
+	OIDCProviderARN    string
+	Namespace          string
+	ServiceAccountName string
+}
+
+func CreateApplicationIdentity(ctx context.Context, config *ApplicationIdentityConfig, client IAMClient, eksClient EKSClient) error {
+	if buildErr := buildAssumeRolePolicy(ctx, config, client); buildErr != nil {
+		return buildErr
+	}
+	if config.AssumeRolePolicy == "" {
+		return fmt.Errorf("role %s trusts nobody: set a workload, oidc_federation or aws_configuration", config.Name)
+	}
+
 	assumeRolePolicy, assumeErr := structure.NormalizeJsonString(config.AssumeRolePolicy)
 	if assumeErr != nil {
 		return assumeErr
@@ -24,6 +73,19 @@ func CreateApplicationIdentity(ctx context.Context, config *ApplicationIdentityC
 	roleInput := iam.CreateRoleInput{
 		AssumeRolePolicyDocument: &assumeRolePolicy,
 		RoleName:                 &config.Name,
+		Tags:                     tagsFromMap(config.Tags),
+	}
+	if config.Path != "" {
+		roleInput.Path = aws.String(config.Path)
+	}
+	if config.Description != "" {
+		roleInput.Description = aws.String(config.Description)
+	}
+	if config.MaxSessionDuration != 0 {
+		roleInput.MaxSessionDuration = aws.Int32(config.MaxSessionDuration)
+	}
+	if config.PermissionsBoundary != "" {
+		roleInput.PermissionsBoundary = aws.String(config.PermissionsBoundary)
 	}
 
 	output, roleErr := client.CreateRole(ctx, &roleInput)
@@ -33,19 +95,204 @@ func CreateApplicationIdentity(ctx context.Context, config *ApplicationIdentityC
 
 	config.Name = *output.Role.RoleName
 	config.IAMRoleARN = *output.Role.Arn
+	config.Path = aws.ToString(output.Role.Path)
+	config.MaxSessionDuration = aws.ToInt32(output.Role.MaxSessionDuration)
+
+	if config.PodIdentityClusterName != "" {
+		if errAssociate := createPodIdentityAssociation(ctx, config, eksClient); errAssociate != nil {
+			return rollbackApplicationIdentity(ctx, config, client, eksClient, errAssociate)
+		}
+	}
+
+	if config.CreateInstanceProfile {
+		if errProfile := createInstanceProfile(ctx, config, client); errProfile != nil {
+			return rollbackApplicationIdentity(ctx, config, client, eksClient, errProfile)
+		}
+	}
 
 	return nil
 }
 
-func ReadApplicationIdentity(ctx context.Context, config *ApplicationIdentityConfig, client IAMClient) error {
+// rollbackApplicationIdentity deletes the role of a create that failed halfway, otherwise it's left out of the
+// state and every retry fails because the role already exists
+func rollbackApplicationIdentity(ctx context.Context, config *ApplicationIdentityConfig, client IAMClient, eksClient EKSClient, err error) error {
+	config.ForceDetachOnDestroy = false
+	if deleteErr := DeleteApplicationIdentity(ctx, config, client, eksClient); deleteErr != nil {
+		return fmt.Errorf("%w (deleting role %s afterwards failed too, remove it manually: %v)", err, config.IAMRoleARN, deleteErr)
+	}
+	return err
+}
+
+func ReadApplicationIdentity(ctx context.Context, config *ApplicationIdentityConfig, client IAMClient, eksClient EKSClient) error {
+	input := iam.GetRoleInput{
+		RoleName: aws.String(config.Name),
+	}
+
+	output, getErr := client.GetRole(ctx, &input)
+	if getErr != nil {
+		if isNoSuchEntityError(getErr) {
+			return &NotFoundError{Resource: fmt.Sprintf("IAM role %s", config.Name), Err: getErr}
+		}
+		return getErr
+	}
+
+	config.Name = aws.ToString(output.Role.RoleName)
+	config.IAMRoleARN = aws.ToString(output.Role.Arn)
+	config.Path = aws.ToString(output.Role.Path)
+	config.Description = aws.ToString(output.Role.Description)
+	config.MaxSessionDuration = aws.ToInt32(output.Role.MaxSessionDuration)
+	config.PermissionsBoundary = ""
+	if output.Role.PermissionsBoundary != nil {
+		config.PermissionsBoundary = aws.ToString(output.Role.PermissionsBoundary.PermissionsBoundaryArn)
+	}
+	config.Tags = tagsToMap(output.Role.Tags)
+
+	// IAM returns the assume role policy URL encoded
+	assumeRolePolicy, decodeErr := url.QueryUnescape(aws.ToString(output.Role.AssumeRolePolicyDocument))
+	if decodeErr != nil {
+		return fmt.Errorf("decoding assume role policy for role %s: %w", config.Name, decodeErr)
+	}
+
+	assumeRolePolicy, config.identityFederationStatements, decodeErr = splitIdentityFederationStatements(assumeRolePolicy)
+	if decodeErr != nil {
+		return decodeErr
+	}
+
+	// only overwrite the configured policy if it is no longer equivalent, so whitespace and ordering don't show as drift
+	policyToSet, policyErr := verify.PolicyToSet(config.AssumeRolePolicy, assumeRolePolicy)
+	if policyErr != nil {
+		return policyErr
+	}
+	config.AssumeRolePolicy = policyToSet
+
+	if config.PodIdentityAssociationARN != "" {
+		if errAssociation := readPodIdentityAssociation(ctx, config, eksClient); errAssociation != nil {
+			return errAssociation
+		}
+	}
+
+	if config.InstanceProfileARN != "" {
+		if errProfile := readInstanceProfile(ctx, config, client); errProfile != nil {
+			return errProfile
+		}
+	}
+
 	return nil
 }
 
-func UpdateApplicationIdentity(ctx context.Context, config *ApplicationIdentityConfig, client IAMClient) error {
+// ImportApplicationIdentity adopts an existing role, identified by config.Name as its name or ARN. The trust policy
+// is imported as the assume role policy, and also as a workload preset and Kubernetes service accounts when it only
+// trusts those.
+// Pod identity associations are per cluster and can't be found from the role, so they aren't imported.
+func ImportApplicationIdentity(ctx context.Context, config *ApplicationIdentityConfig, client IAMClient, eksClient EKSClient) error {
+	roleName, err := roleNameFromImportID(config.Name)
+	if err != nil {
+		return err
+	}
+	config.Name = roleName
+
+	if errRead := ReadApplicationIdentity(ctx, config, client, eksClient); errRead != nil {
+		return errRead
+	}
+
+	workload, rest := workloadFromTrustPolicy(config.AssumeRolePolicy)
+	config.KubernetesSubjects = kubernetesSubjectsFromTrustPolicy(rest)
+	// the workload is only imported when it and the Kubernetes subjects make up the whole trust policy
+	if _, restStatements, _ := parsePolicyStatements(rest); len(config.KubernetesSubjects) > 0 || len(restStatements) == 0 {
+		config.Workload = workload
+	}
+	if config.Workload != "ec2" {
+		return nil
+	}
+
+	// probe for the instance profile create_instance_profile would have created
+	config.CreateInstanceProfile = true
+	return readInstanceProfile(ctx, config, client)
+}
+
+// roleNameFromImportID accepts a role name or an ARN like arn:aws:iam::123456789012:role/path/name
+func roleNameFromImportID(id string) (string, error) {
+	if !strings.HasPrefix(id, "arn:") {
+		return id, nil
+	}
+	segments := strings.SplitN(id, ":role/", 2)
+	if len(segments) != 2 || segments[1] == "" {
+		return "", fmt.Errorf("expected import ID to be a role name or an ARN in the format `arn:aws:iam::{account}:role/{name}` but got %q", id)
+	}
+	return segments[1][strings.LastIndex(segments[1], "/")+1:], nil
+}
+
+func UpdateApplicationIdentity(ctx context.Context, config *ApplicationIdentityConfig, client IAMClient, eksClient EKSClient) error {
+	if buildErr := buildAssumeRolePolicy(ctx, config, client); buildErr != nil {
+		return buildErr
+	}
+
+	current := ApplicationIdentityConfig{
+		Name:             config.Name,
+		AssumeRolePolicy: config.AssumeRolePolicy,
+	}
+	if readErr := ReadApplicationIdentity(ctx, &current, client, eksClient); readErr != nil {
+		return readErr
+	}
+	config.IAMRoleARN = current.IAMRoleARN
+
+	// ReadApplicationIdentity keeps our policy when the remote one is equivalent, so anything else is a real change
+	if current.AssumeRolePolicy != config.AssumeRolePolicy {
+		merged, mergeErr := appendPolicyStatements(config.AssumeRolePolicy, current.identityFederationStatements)
+		if mergeErr != nil {
+			return mergeErr
+		}
+		assumeRolePolicy, assumeErr := structure.NormalizeJsonString(merged)
+		if assumeErr != nil {
+			return assumeErr
+		}
+
+		input := iam.UpdateAssumeRolePolicyInput{
+			PolicyDocument: &assumeRolePolicy,
+			RoleName:       aws.String(config.Name),
+		}
+
+		_, updateErr := client.UpdateAssumeRolePolicy(ctx, &input)
+		if updateErr != nil {
+			return updateErr
+		}
+	}
+
+	if errAttributes := updateRoleAttributes(ctx, config, &current, client); errAttributes != nil {
+		return errAttributes
+	}
+
+	// the association can only be made once the role trusts EKS Pod Identity
+	if errAssociation := updatePodIdentityAssociation(ctx, config, eksClient); errAssociation != nil {
+		return errAssociation
+	}
+
+	switch {
+	case config.CreateInstanceProfile && config.InstanceProfileARN == "":
+		return createInstanceProfile(ctx, config, client)
+	case !config.CreateInstanceProfile && config.InstanceProfileARN != "":
+		return deleteInstanceProfile(ctx, config, client)
+	}
+
 	return nil
 }
 
-func DeleteApplicationIdentity(ctx context.Context, config *ApplicationIdentityConfig, client IAMClient) error {
+func DeleteApplicationIdentity(ctx context.Context, config *ApplicationIdentityConfig, client IAMClient, eksClient EKSClient) error {
+	if errAssociation := deletePodIdentityAssociation(ctx, config.PodIdentityAssociationARN, eksClient); errAssociation != nil {
+		return errAssociation
+	}
+
+	if config.InstanceProfileARN != "" {
+		if errProfile := deleteInstanceProfile(ctx, config, client); errProfile != nil {
+			return errProfile
+		}
+	}
+
+	if config.ForceDetachOnDestroy {
+		if errDetach := detachRoleDependencies(ctx, config, client); errDetach != nil {
+			return roleNotFoundError(config.Name, errDetach)
+		}
+	}
 
 	input := iam.DeleteRoleInput{
 		RoleName: aws.String(config.Name),
@@ -53,8 +300,265 @@ func DeleteApplicationIdentity(ctx context.Context, config *ApplicationIdentityC
 
 	_, deleteErr := client.DeleteRole(ctx, &input)
 	if deleteErr != nil {
-		return deleteErr
+		return roleNotFoundError(config.Name, deleteErr)
 	}
 
 	return nil
 }
+
+// roleNotFoundError turns the NoSuchEntity error of a role deleted outside Terraform into a NotFoundError
+func roleNotFoundError(roleName string, err error) error {
+	if isNoSuchEntityError(err) {
+		return &NotFoundError{Resource: fmt.Sprintf("IAM role %s", roleName), Err: err}
+	}
+	return err
+}
+
+// detachRoleDependencies removes everything IAM requires to be gone before a role can be deleted:
+// managed policy attachments, inline policies and instance profile memberships.
+// Each list is read completely before anything is removed so pagination isn't disturbed.
+func detachRoleDependencies(ctx context.Context, config *ApplicationIdentityConfig, client IAMClient) error {
+	roleName := aws.String(config.Name)
+
+	policyARNs := []string{}
+	attachedPaginator := iam.NewListAttachedRolePoliciesPaginator(client, &iam.ListAttachedRolePoliciesInput{RoleName: roleName})
+	for attachedPaginator.HasMorePages() {
+		page, err := attachedPaginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("listing managed policies of role %s: %w", config.Name, err)
+		}
+		for _, policy := range page.AttachedPolicies {
+			policyARNs = append(policyARNs, aws.ToString(policy.PolicyArn))
+		}
+	}
+	for _, policyARN := range policyARNs {
+		_, err := client.DetachRolePolicy(ctx, &iam.DetachRolePolicyInput{RoleName: roleName, PolicyArn: aws.String(policyARN)})
+		if err != nil {
+			return fmt.Errorf("detaching managed policy %s from role %s: %w", policyARN, config.Name, err)
+		}
+		config.DetachedDependencies = append(config.DetachedDependencies, fmt.Sprintf("managed policy %s", policyARN))
+	}
+
+	policyNames := []string{}
+	inlinePaginator := iam.NewListRolePoliciesPaginator(client, &iam.ListRolePoliciesInput{RoleName: roleName})
+	for inlinePaginator.HasMorePages() {
+		page, err := inlinePaginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("listing inline policies of role %s: %w", config.Name, err)
+		}
+		policyNames = append(policyNames, page.PolicyNames...)
+	}
+	for _, policyName := range policyNames {
+		_, err := client.DeleteRolePolicy(ctx, &iam.DeleteRolePolicyInput{RoleName: roleName, PolicyName: aws.String(policyName)})
+		if err != nil {
+			return fmt.Errorf("deleting inline policy %s from role %s: %w", policyName, config.Name, err)
+		}
+		config.DetachedDependencies = append(config.DetachedDependencies, fmt.Sprintf("inline policy %s", policyName))
+	}
+
+	profileNames := []string{}
+	profilePaginator := iam.NewListInstanceProfilesForRolePaginator(client, &iam.ListInstanceProfilesForRoleInput{RoleName: roleName})
+	for profilePaginator.HasMorePages() {
+		page, err := profilePaginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("listing instance profiles of role %s: %w", config.Name, err)
+		}
+		for _, profile := range page.InstanceProfiles {
+			profileNames = append(profileNames, aws.ToString(profile.InstanceProfileName))
+		}
+	}
+	for _, profileName := range profileNames {
+		_, err := client.RemoveRoleFromInstanceProfile(ctx, &iam.RemoveRoleFromInstanceProfileInput{RoleName: roleName, InstanceProfileName: aws.String(profileName)})
+		if err != nil {
+			return fmt.Errorf("removing role %s from instance profile %s: %w", config.Name, profileName, err)
+		}
+		config.DetachedDependencies = append(config.DetachedDependencies, fmt.Sprintf("instance profile %s", profileName))
+	}
+
+	return nil
+}
+
+// updateRoleAttributes applies the role settings IAM allows changing in place. The path can't be changed.
+func updateRoleAttributes(ctx context.Context, config *ApplicationIdentityConfig, current *ApplicationIdentityConfig, client IAMClient) error {
+	config.Path = current.Path
+
+	if config.MaxSessionDuration == 0 {
+		config.MaxSessionDuration = current.MaxSessionDuration
+	}
+
+	if config.Description != current.Description || config.MaxSessionDuration != current.MaxSessionDuration {
+		_, err := client.UpdateRole(ctx, &iam.UpdateRoleInput{
+			RoleName:           aws.String(config.Name),
+			Description:        aws.String(config.Description),
+			MaxSessionDuration: aws.Int32(config.MaxSessionDuration),
+		})
+		if err != nil {
+			return fmt.Errorf("updating role %s: %w", config.Name, err)
+		}
+	}
+
+	if config.PermissionsBoundary != current.PermissionsBoundary {
+		var err error
+		if config.PermissionsBoundary == "" {
+			_, err = client.DeleteRolePermissionsBoundary(ctx, &iam.DeleteRolePermissionsBoundaryInput{
+				RoleName: aws.String(config.Name),
+			})
+		} else {
+			_, err = client.PutRolePermissionsBoundary(ctx, &iam.PutRolePermissionsBoundaryInput{
+				RoleName:            aws.String(config.Name),
+				PermissionsBoundary: aws.String(config.PermissionsBoundary),
+			})
+		}
+		if err != nil {
+			return fmt.Errorf("updating permissions boundary of role %s: %w", config.Name, err)
+		}
+	}
+
+	removedTags := []string{}
+	for key := range current.Tags {
+		if _, ok := config.Tags[key]; !ok {
+			removedTags = append(removedTags, key)
+		}
+	}
+	sort.Strings(removedTags)
+	if len(removedTags) > 0 {
+		_, err := client.UntagRole(ctx, &iam.UntagRoleInput{
+			RoleName: aws.String(config.Name),
+			TagKeys:  removedTags,
+		})
+		if err != nil {
+			return fmt.Errorf("untagging role %s: %w", config.Name, err)
+		}
+	}
+
+	changedTags := map[string]string{}
+	for key, value := range config.Tags {
+		if currentValue, ok := current.Tags[key]; !ok || currentValue != value {
+			changedTags[key] = value
+		}
+	}
+	if len(changedTags) > 0 {
+		_, err := client.TagRole(ctx, &iam.TagRoleInput{
+			RoleName: aws.String(config.Name),
+			Tags:     tagsFromMap(changedTags),
+		})
+		if err != nil {
+			return fmt.Errorf("tagging role %s: %w", config.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func tagsFromMap(tags map[string]string) []types.Tag {
+	if len(tags) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	result := make([]types.Tag, 0, len(tags))
+	for _, key := range keys {
+		result = append(result, types.Tag{
+			Key:   aws.String(key),
+			Value: aws.String(tags[key]),
+		})
+	}
+	return result
+}
+
+func tagsToMap(tags []types.Tag) map[string]string {
+	result := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		result[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	return result
+}
+
+// buildAssumeRolePolicy generates the trust policy for identities that don't supply their own
+func buildAssumeRolePolicy(ctx context.Context, config *ApplicationIdentityConfig, client IAMClient) error {
+	statements := []trustPolicyStatement{}
+
+	for _, subject := range config.KubernetesSubjects {
+		statement, err := kubernetesTrustStatement(subject.OIDCProviderARN, subject.Namespace, subject.ServiceAccountName)
+		if err != nil {
+			return err
+		}
+		statements = append(statements, statement)
+	}
+
+	if config.PodIdentityClusterName != "" {
+		statements = append(statements, podIdentityTrustStatement())
+	}
+
+	if errProfile := validateInstanceProfile(config); errProfile != nil {
+		return errProfile
+	}
+	workloadStatement, errWorkload := workloadTrustStatement(config)
+	if errWorkload != nil {
+		return errWorkload
+	}
+	if workloadStatement != nil {
+		statements = append(statements, *workloadStatement)
+	}
+
+	if config.OIDCFederation != nil {
+		oidcProviderARN, err := findOIDCProviderARN(ctx, config.OIDCFederation.Issuer, client)
+		if err != nil {
+			return err
+		}
+		statement, err := oidcFederationTrustStatement(oidcProviderARN, config.OIDCFederation.Audience, config.OIDCFederation.Subject)
+		if err != nil {
+			return err
+		}
+		statements = append(statements, statement)
+	}
+
+	if len(statements) == 0 {
+		return nil
+	}
+
+	policy, err := trustPolicyDocument{
+		Version:   "2012-10-17",
+		Statement: statements,
+	}.String()
+	if err != nil {
+		return err
+	}
+
+	config.AssumeRolePolicy = policy
+	return nil
+}
+
+// GenerateAssumeRolePolicy returns the trust policy UpdateApplicationIdentity would apply for config, or "" when
+// config supplies its own
+func GenerateAssumeRolePolicy(ctx context.Context, config *ApplicationIdentityConfig, client IAMClient) (string, error) {
+	generated := *config
+	generated.AssumeRolePolicy = ""
+	if err := buildAssumeRolePolicy(ctx, &generated, client); err != nil {
+		return "", err
+	}
+	return generated.AssumeRolePolicy, nil
+}
+
+// findOIDCProviderARN looks up the IAM OIDC provider of the issuer, e.g. token.actions.githubusercontent.com
+func findOIDCProviderARN(ctx context.Context, issuer string, client IAMClient) (string, error) {
+	providers, err := client.ListOpenIDConnectProviders(ctx, &iam.ListOpenIDConnectProvidersInput{})
+	if err != nil {
+		return "", fmt.Errorf("listing IAM OIDC providers: %w", err)
+	}
+
+	issuerHost := strings.TrimSuffix(strings.TrimPrefix(issuer, "https://"), "/")
+	for _, provider := range providers.OpenIDConnectProviderList {
+		providerIssuer, errIssuer := getIssuerFromOIDCProviderARN(aws.ToString(provider.Arn))
+		if errIssuer == nil && strings.TrimSuffix(providerIssuer, "/") == issuerHost {
+			return aws.ToString(provider.Arn), nil
+		}
+	}
+
+	return "", fmt.Errorf("no IAM OIDC provider found for issuer %s, create one for it first", issuer)
+}
@@ -1,34 +1,772 @@
 package aws_test
 
-// type mockCreateRoleAPI func(ctx context.Context, params *iam.CreateRoleInput, optFns []func(*iam.Options)) (*iam.CreateRoleOutput, error)
-
-// func (m mockCreateRoleAPI) CreateRole(ctx context.Context, params *iam.CreateRoleInput, optFns []func(*iam.Options)) (*iam.CreateRoleOutput, error) {
-// 	return m(ctx, params, optFns)
-// }
-
-// func TestCreate(t *testing.T) {
-// 	m := mockCreateRoleAPI(func(ctx context.Context, params *iam.CreateRoleInput, optFns []func(*iam.Options)) (*iam.CreateRoleOutput, error) {
-// 		t.Helper()
-// 		if params.RoleName == nil {
-// 			t.Fatal("expect role name to not be nil")
-// 		}
-
-// 		arn := fmt.Sprintf("arn:aws:iam::account:role/%s", *params.RoleName)
-// 		role := &types.Role{Arn: aws.String(arn)}
-// 		return &iam.CreateRoleOutput{Role: role}, nil
-// 	})
-
-// 	appIdentityInput := massdriver.AppIdentityInput{
-// 		Name: aws.String("test"),
-// 	}
-
-// 	appIdentityOutput, _ := mdxcaws.AppIdentityCreate(context.TODO(), m, &appIdentityInput)
-// 	got := *appIdentityOutput.AwsIamRole.Arn
-// 	want := "arn:aws:iam::account:role/test"
-
-// 	if want != got {
-// 		t.Errorf("expect %v, got %v", want, got)
-// 	}
-// }
-
-// TODO: Add TestCreateError case
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"terraform-provider-mdxc/internal/cloud/aws"
+	"terraform-provider-mdxc/internal/verify"
+	"testing"
+
+	awssdk "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/eks"
+	ekstypes "github.com/aws/aws-sdk-go-v2/service/eks/types"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/aws-sdk-go-v2/service/iam/types"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/structure"
+)
+
+type mockIAMClient struct {
+	aws.IAMClient
+	role             *types.Role
+	policyUpdates    int
+	attachedPolicies []string
+	inlinePolicies   []string
+	instanceProfiles []string
+	// ListAttachedRolePolicies returns pages of this size when set
+	pageSize int
+}
+
+func (m *mockIAMClient) CreateRole(ctx context.Context, params *iam.CreateRoleInput, optFns ...func(*iam.Options)) (*iam.CreateRoleOutput, error) {
+	m.role = &types.Role{
+		Arn:                      awssdk.String(fmt.Sprintf("arn:aws:iam::account:role/%s", *params.RoleName)),
+		RoleName:                 params.RoleName,
+		Path:                     awssdk.String("/"),
+		Description:              params.Description,
+		MaxSessionDuration:       awssdk.Int32(3600),
+		AssumeRolePolicyDocument: awssdk.String(url.QueryEscape(*params.AssumeRolePolicyDocument)),
+		Tags:                     params.Tags,
+	}
+	return &iam.CreateRoleOutput{Role: m.role}, nil
+}
+
+func (m *mockIAMClient) ListOpenIDConnectProviders(ctx context.Context, params *iam.ListOpenIDConnectProvidersInput, optFns ...func(*iam.Options)) (*iam.ListOpenIDConnectProvidersOutput, error) {
+	return &iam.ListOpenIDConnectProvidersOutput{
+		OpenIDConnectProviderList: []types.OpenIDConnectProviderListEntry{
+			{Arn: awssdk.String("arn:aws:iam::account:oidc-provider/oidc.eks.us-west-2.amazonaws.com/id/EXAMPLE")},
+			{Arn: awssdk.String("arn:aws:iam::account:oidc-provider/token.actions.githubusercontent.com")},
+		},
+	}, nil
+}
+
+func (m *mockIAMClient) GetRole(ctx context.Context, params *iam.GetRoleInput, optFns ...func(*iam.Options)) (*iam.GetRoleOutput, error) {
+	if m.role == nil {
+		return nil, &types.NoSuchEntityException{Message: awssdk.String("role not found")}
+	}
+	return &iam.GetRoleOutput{Role: m.role}, nil
+}
+
+func (m *mockIAMClient) UpdateAssumeRolePolicy(ctx context.Context, params *iam.UpdateAssumeRolePolicyInput, optFns ...func(*iam.Options)) (*iam.UpdateAssumeRolePolicyOutput, error) {
+	m.policyUpdates++
+	m.role.AssumeRolePolicyDocument = awssdk.String(url.QueryEscape(*params.PolicyDocument))
+	return &iam.UpdateAssumeRolePolicyOutput{}, nil
+}
+
+func (m *mockIAMClient) UpdateRole(ctx context.Context, params *iam.UpdateRoleInput, optFns ...func(*iam.Options)) (*iam.UpdateRoleOutput, error) {
+	m.role.Description = params.Description
+	m.role.MaxSessionDuration = params.MaxSessionDuration
+	return &iam.UpdateRoleOutput{}, nil
+}
+
+func (m *mockIAMClient) PutRolePermissionsBoundary(ctx context.Context, params *iam.PutRolePermissionsBoundaryInput, optFns ...func(*iam.Options)) (*iam.PutRolePermissionsBoundaryOutput, error) {
+	m.role.PermissionsBoundary = &types.AttachedPermissionsBoundary{PermissionsBoundaryArn: params.PermissionsBoundary}
+	return &iam.PutRolePermissionsBoundaryOutput{}, nil
+}
+
+func (m *mockIAMClient) TagRole(ctx context.Context, params *iam.TagRoleInput, optFns ...func(*iam.Options)) (*iam.TagRoleOutput, error) {
+	for _, tag := range params.Tags {
+		m.UntagRole(ctx, &iam.UntagRoleInput{TagKeys: []string{*tag.Key}})
+		m.role.Tags = append(m.role.Tags, tag)
+	}
+	return &iam.TagRoleOutput{}, nil
+}
+
+func (m *mockIAMClient) UntagRole(ctx context.Context, params *iam.UntagRoleInput, optFns ...func(*iam.Options)) (*iam.UntagRoleOutput, error) {
+	tags := []types.Tag{}
+	for _, tag := range m.role.Tags {
+		removed := false
+		for _, key := range params.TagKeys {
+			removed = removed || *tag.Key == key
+		}
+		if !removed {
+			tags = append(tags, tag)
+		}
+	}
+	m.role.Tags = tags
+	return &iam.UntagRoleOutput{}, nil
+}
+
+func (m *mockIAMClient) DeleteRole(ctx context.Context, params *iam.DeleteRoleInput, optFns ...func(*iam.Options)) (*iam.DeleteRoleOutput, error) {
+	if m.role == nil {
+		return nil, &types.NoSuchEntityException{Message: awssdk.String("role not found")}
+	}
+	if len(m.attachedPolicies)+len(m.inlinePolicies)+len(m.instanceProfiles) > 0 {
+		return nil, &types.DeleteConflictException{}
+	}
+	m.role = nil
+	return &iam.DeleteRoleOutput{}, nil
+}
+
+func (m *mockIAMClient) ListAttachedRolePolicies(ctx context.Context, params *iam.ListAttachedRolePoliciesInput, optFns ...func(*iam.Options)) (*iam.ListAttachedRolePoliciesOutput, error) {
+	arns := m.attachedPolicies
+	start := 0
+	if params.Marker != nil {
+		start, _ = strconv.Atoi(*params.Marker)
+	}
+	output := &iam.ListAttachedRolePoliciesOutput{}
+	if m.pageSize > 0 && start+m.pageSize < len(arns) {
+		arns = arns[:start+m.pageSize]
+		output.IsTruncated = true
+		output.Marker = awssdk.String(strconv.Itoa(start + m.pageSize))
+	}
+	for _, arn := range arns[start:] {
+		output.AttachedPolicies = append(output.AttachedPolicies, types.AttachedPolicy{PolicyArn: awssdk.String(arn)})
+	}
+	return output, nil
+}
+
+func (m *mockIAMClient) DetachRolePolicy(ctx context.Context, params *iam.DetachRolePolicyInput, optFns ...func(*iam.Options)) (*iam.DetachRolePolicyOutput, error) {
+	m.attachedPolicies = without(m.attachedPolicies, *params.PolicyArn)
+	return &iam.DetachRolePolicyOutput{}, nil
+}
+
+func (m *mockIAMClient) ListRolePolicies(ctx context.Context, params *iam.ListRolePoliciesInput, optFns ...func(*iam.Options)) (*iam.ListRolePoliciesOutput, error) {
+	return &iam.ListRolePoliciesOutput{PolicyNames: m.inlinePolicies}, nil
+}
+
+func (m *mockIAMClient) DeleteRolePolicy(ctx context.Context, params *iam.DeleteRolePolicyInput, optFns ...func(*iam.Options)) (*iam.DeleteRolePolicyOutput, error) {
+	m.inlinePolicies = without(m.inlinePolicies, *params.PolicyName)
+	return &iam.DeleteRolePolicyOutput{}, nil
+}
+
+func (m *mockIAMClient) ListInstanceProfilesForRole(ctx context.Context, params *iam.ListInstanceProfilesForRoleInput, optFns ...func(*iam.Options)) (*iam.ListInstanceProfilesForRoleOutput, error) {
+	profiles := []types.InstanceProfile{}
+	for _, name := range m.instanceProfiles {
+		profiles = append(profiles, types.InstanceProfile{InstanceProfileName: awssdk.String(name)})
+	}
+	return &iam.ListInstanceProfilesForRoleOutput{InstanceProfiles: profiles}, nil
+}
+
+func (m *mockIAMClient) RemoveRoleFromInstanceProfile(ctx context.Context, params *iam.RemoveRoleFromInstanceProfileInput, optFns ...func(*iam.Options)) (*iam.RemoveRoleFromInstanceProfileOutput, error) {
+	m.instanceProfiles = without(m.instanceProfiles, *params.InstanceProfileName)
+	return &iam.RemoveRoleFromInstanceProfileOutput{}, nil
+}
+
+func (m *mockIAMClient) CreateInstanceProfile(ctx context.Context, params *iam.CreateInstanceProfileInput, optFns ...func(*iam.Options)) (*iam.CreateInstanceProfileOutput, error) {
+	return &iam.CreateInstanceProfileOutput{
+		InstanceProfile: &types.InstanceProfile{
+			Arn:                 awssdk.String(fmt.Sprintf("arn:aws:iam::account:instance-profile/%s", *params.InstanceProfileName)),
+			InstanceProfileName: params.InstanceProfileName,
+		},
+	}, nil
+}
+
+func (m *mockIAMClient) AddRoleToInstanceProfile(ctx context.Context, params *iam.AddRoleToInstanceProfileInput, optFns ...func(*iam.Options)) (*iam.AddRoleToInstanceProfileOutput, error) {
+	m.instanceProfiles = append(m.instanceProfiles, *params.InstanceProfileName)
+	return &iam.AddRoleToInstanceProfileOutput{}, nil
+}
+
+func (m *mockIAMClient) GetInstanceProfile(ctx context.Context, params *iam.GetInstanceProfileInput, optFns ...func(*iam.Options)) (*iam.GetInstanceProfileOutput, error) {
+	for _, name := range m.instanceProfiles {
+		if name == *params.InstanceProfileName {
+			return &iam.GetInstanceProfileOutput{
+				InstanceProfile: &types.InstanceProfile{
+					Arn:                 awssdk.String(fmt.Sprintf("arn:aws:iam::account:instance-profile/%s", name)),
+					InstanceProfileName: awssdk.String(name),
+					Roles:               []types.Role{{RoleName: m.role.RoleName}},
+				},
+			}, nil
+		}
+	}
+	return nil, &types.NoSuchEntityException{}
+}
+
+func (m *mockIAMClient) DeleteInstanceProfile(ctx context.Context, params *iam.DeleteInstanceProfileInput, optFns ...func(*iam.Options)) (*iam.DeleteInstanceProfileOutput, error) {
+	return &iam.DeleteInstanceProfileOutput{}, nil
+}
+
+func without(values []string, value string) []string {
+	result := []string{}
+	for _, v := range values {
+		if v != value {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+type mockEKSClient struct {
+	aws.EKSClient
+	associations map[string]*ekstypes.PodIdentityAssociation
+	// CreatePodIdentityAssociation fails with this error when set
+	createErr error
+}
+
+func (m *mockEKSClient) CreatePodIdentityAssociation(ctx context.Context, params *eks.CreatePodIdentityAssociationInput, optFns ...func(*eks.Options)) (*eks.CreatePodIdentityAssociationOutput, error) {
+	if m.createErr != nil {
+		return nil, m.createErr
+	}
+	id := fmt.Sprintf("a-%d", len(m.associations))
+	association := &ekstypes.PodIdentityAssociation{
+		AssociationArn: awssdk.String(fmt.Sprintf("arn:aws:eks:us-west-2:account:podidentityassociation/%s/%s", *params.ClusterName, id)),
+		AssociationId:  awssdk.String(id),
+		ClusterName:    params.ClusterName,
+		Namespace:      params.Namespace,
+		ServiceAccount: params.ServiceAccount,
+		RoleArn:        params.RoleArn,
+	}
+	m.associations[id] = association
+	return &eks.CreatePodIdentityAssociationOutput{Association: association}, nil
+}
+
+func (m *mockEKSClient) DescribePodIdentityAssociation(ctx context.Context, params *eks.DescribePodIdentityAssociationInput, optFns ...func(*eks.Options)) (*eks.DescribePodIdentityAssociationOutput, error) {
+	association, ok := m.associations[*params.AssociationId]
+	if !ok {
+		return nil, &ekstypes.ResourceNotFoundException{}
+	}
+	return &eks.DescribePodIdentityAssociationOutput{Association: association}, nil
+}
+
+func (m *mockEKSClient) DeletePodIdentityAssociation(ctx context.Context, params *eks.DeletePodIdentityAssociationInput, optFns ...func(*eks.Options)) (*eks.DeletePodIdentityAssociationOutput, error) {
+	delete(m.associations, *params.AssociationId)
+	return &eks.DeletePodIdentityAssociationOutput{}, nil
+}
+
+const testAssumeRolePolicy = `{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Principal":{"Service":"lambda.amazonaws.com"},"Action":"sts:AssumeRole"}]}`
+
+func TestCreateIdentity(t *testing.T) {
+	ctx := context.Background()
+	config := &aws.ApplicationIdentityConfig{
+		Name:             "test",
+		AssumeRolePolicy: testAssumeRolePolicy,
+	}
+	client := &mockIAMClient{}
+	if err := aws.CreateApplicationIdentity(ctx, config, client, &mockEKSClient{}); err != nil {
+		t.Fatal(err)
+	}
+
+	compare(t, config.IAMRoleARN, "arn:aws:iam::account:role/test")
+	compare(t, config.Name, "test")
+
+	// without a workload, kubernetes, OIDC federation or policy there is nothing to trust
+	config = &aws.ApplicationIdentityConfig{
+		Name: "test",
+	}
+	if err := aws.CreateApplicationIdentity(ctx, config, &mockIAMClient{}, &mockEKSClient{}); err == nil {
+		t.Error("expect an error for a role without a trust policy")
+	}
+}
+
+func TestCreateIdentityKubernetes(t *testing.T) {
+	ctx := context.Background()
+	config := &aws.ApplicationIdentityConfig{
+		Name: "test",
+		KubernetesSubjects: []aws.KubernetesSubject{
+			{
+				OIDCProviderARN:    "arn:aws:iam::account:oidc-provider/oidc.eks.us-west-2.amazonaws.com/id/EXAMPLE",
+				Namespace:          "default",
+				ServiceAccountName: "app",
+			},
+			{
+				OIDCProviderARN:    "arn:aws:iam::account:oidc-provider/oidc.eks.us-west-2.amazonaws.com/id/EXAMPLE",
+				Namespace:          "canary",
+				ServiceAccountName: "app",
+			},
+		},
+	}
+	client := &mockIAMClient{}
+	if err := aws.CreateApplicationIdentity(ctx, config, client, &mockEKSClient{}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{
+		"Version": "2012-10-17",
+		"Statement": [{
+			"Effect": "Allow",
+			"Principal": {"Federated": "arn:aws:iam::account:oidc-provider/oidc.eks.us-west-2.amazonaws.com/id/EXAMPLE"},
+			"Action": "sts:AssumeRoleWithWebIdentity",
+			"Condition": {
+				"StringEquals": {
+					"oidc.eks.us-west-2.amazonaws.com/id/EXAMPLE:sub": "system:serviceaccount:default:app",
+					"oidc.eks.us-west-2.amazonaws.com/id/EXAMPLE:aud": "sts.amazonaws.com"
+				}
+			}
+		}, {
+			"Effect": "Allow",
+			"Principal": {"Federated": "arn:aws:iam::account:oidc-provider/oidc.eks.us-west-2.amazonaws.com/id/EXAMPLE"},
+			"Action": "sts:AssumeRoleWithWebIdentity",
+			"Condition": {
+				"StringEquals": {
+					"oidc.eks.us-west-2.amazonaws.com/id/EXAMPLE:sub": "system:serviceaccount:canary:app",
+					"oidc.eks.us-west-2.amazonaws.com/id/EXAMPLE:aud": "sts.amazonaws.com"
+				}
+			}
+		}]
+	}`
+	if !verify.PoliciesAreEquivalent(config.AssumeRolePolicy, want) {
+		t.Errorf("expect %v, got %v", want, config.AssumeRolePolicy)
+	}
+}
+
+func TestCreateIdentityOIDCFederation(t *testing.T) {
+	ctx := context.Background()
+	config := &aws.ApplicationIdentityConfig{
+		Name: "test",
+		OIDCFederation: &aws.OIDCFederation{
+			Issuer:  "https://token.actions.githubusercontent.com",
+			Subject: "repo:my-org/my-repo:*",
+		},
+	}
+	client := &mockIAMClient{}
+	if err := aws.CreateApplicationIdentity(ctx, config, client, &mockEKSClient{}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{
+		"Version": "2012-10-17",
+		"Statement": [{
+			"Effect": "Allow",
+			"Principal": {"Federated": "arn:aws:iam::account:oidc-provider/token.actions.githubusercontent.com"},
+			"Action": "sts:AssumeRoleWithWebIdentity",
+			"Condition": {
+				"StringEquals": {
+					"token.actions.githubusercontent.com:aud": "sts.amazonaws.com"
+				},
+				"StringLike": {
+					"token.actions.githubusercontent.com:sub": "repo:my-org/my-repo:*"
+				}
+			}
+		}]
+	}`
+	if !verify.PoliciesAreEquivalent(config.AssumeRolePolicy, want) {
+		t.Errorf("expect %v, got %v", want, config.AssumeRolePolicy)
+	}
+
+	// the issuer's IAM OIDC provider has to exist
+	config.OIDCFederation.Issuer = "https://gitlab.com"
+	if err := aws.UpdateApplicationIdentity(ctx, config, client, &mockEKSClient{}); err == nil {
+		t.Error("expect an error for an issuer without IAM OIDC provider")
+	}
+}
+
+func TestCreateIdentityWorkload(t *testing.T) {
+	ctx := context.Background()
+	config := &aws.ApplicationIdentityConfig{
+		Name:     "test",
+		Workload: "lambda",
+	}
+	client := &mockIAMClient{}
+	if err := aws.CreateApplicationIdentity(ctx, config, client, &mockEKSClient{}); err != nil {
+		t.Fatal(err)
+	}
+	if !verify.PoliciesAreEquivalent(config.AssumeRolePolicy, testAssumeRolePolicy) {
+		t.Errorf("expect %v, got %v", testAssumeRolePolicy, config.AssumeRolePolicy)
+	}
+
+	// ec2 can get an instance profile
+	config = &aws.ApplicationIdentityConfig{
+		Name:                  "test",
+		Workload:              "ec2",
+		CreateInstanceProfile: true,
+	}
+	client = &mockIAMClient{}
+	if err := aws.CreateApplicationIdentity(ctx, config, client, &mockEKSClient{}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(config.AssumeRolePolicy, "ec2.amazonaws.com") {
+		t.Errorf("expect trust policy to trust EC2, got %v", config.AssumeRolePolicy)
+	}
+	compare(t, config.InstanceProfileARN, "arn:aws:iam::account:instance-profile/test")
+
+	// an instance profile removed outside of Terraform is cleared from config
+	client.instanceProfiles = nil
+	if err := aws.ReadApplicationIdentity(ctx, config, client, &mockEKSClient{}); err != nil {
+		t.Fatal(err)
+	}
+	compare(t, fmt.Sprint(config.CreateInstanceProfile), "false")
+	compare(t, config.InstanceProfileARN, "")
+
+	// instance profiles only make sense for EC2
+	config = &aws.ApplicationIdentityConfig{
+		Name:                  "test",
+		Workload:              "lambda",
+		CreateInstanceProfile: true,
+	}
+	if err := aws.CreateApplicationIdentity(ctx, config, &mockIAMClient{}, &mockEKSClient{}); err == nil {
+		t.Error("expect an error for an instance profile of a lambda workload")
+	}
+
+	// presets of the other clouds are rejected
+	config = &aws.ApplicationIdentityConfig{
+		Name:     "test",
+		Workload: "cloud_run",
+	}
+	if err := aws.CreateApplicationIdentity(ctx, config, &mockIAMClient{}, &mockEKSClient{}); err == nil {
+		t.Error("expect an error for a cloud_run workload")
+	}
+
+	// the kubernetes preset needs a Kubernetes configuration
+	config = &aws.ApplicationIdentityConfig{
+		Name:     "test",
+		Workload: "kubernetes",
+	}
+	if err := aws.CreateApplicationIdentity(ctx, config, &mockIAMClient{}, &mockEKSClient{}); err == nil {
+		t.Error("expect an error for a kubernetes workload without kubernetes configuration")
+	}
+}
+
+func TestPodIdentityAssociation(t *testing.T) {
+	ctx := context.Background()
+	config := &aws.ApplicationIdentityConfig{
+		Name:                          "test",
+		PodIdentityClusterName:        "cluster",
+		PodIdentityNamespace:          "default",
+		PodIdentityServiceAccountName: "app",
+	}
+	client := &mockIAMClient{}
+	eksClient := &mockEKSClient{associations: map[string]*ekstypes.PodIdentityAssociation{}}
+	if err := aws.CreateApplicationIdentity(ctx, config, client, eksClient); err != nil {
+		t.Fatal(err)
+	}
+
+	compare(t, config.PodIdentityAssociationARN, "arn:aws:eks:us-west-2:account:podidentityassociation/cluster/a-0")
+	if !strings.Contains(config.AssumeRolePolicy, "pods.eks.amazonaws.com") {
+		t.Errorf("expect trust policy to trust EKS Pod Identity, got %v", config.AssumeRolePolicy)
+	}
+
+	// changing the service account replaces the association
+	config.PodIdentityServiceAccountName = "other"
+	if err := aws.UpdateApplicationIdentity(ctx, config, client, eksClient); err != nil {
+		t.Fatal(err)
+	}
+
+	compare(t, config.PodIdentityAssociationARN, "arn:aws:eks:us-west-2:account:podidentityassociation/cluster/a-0")
+	if len(eksClient.associations) != 1 {
+		t.Errorf("expect 1 association, got %d", len(eksClient.associations))
+	}
+	compare(t, *eksClient.associations["a-0"].ServiceAccount, "other")
+
+	// an association removed outside of Terraform is cleared from config
+	delete(eksClient.associations, "a-0")
+	if err := aws.ReadApplicationIdentity(ctx, config, client, eksClient); err != nil {
+		t.Fatal(err)
+	}
+	compare(t, config.PodIdentityClusterName, "")
+}
+
+func TestCreateIdentityRollback(t *testing.T) {
+	ctx := context.Background()
+	config := &aws.ApplicationIdentityConfig{
+		Name:                          "test",
+		PodIdentityClusterName:        "missing",
+		PodIdentityNamespace:          "default",
+		PodIdentityServiceAccountName: "app",
+	}
+	client := &mockIAMClient{}
+	eksClient := &mockEKSClient{createErr: &ekstypes.ResourceNotFoundException{}}
+	if err := aws.CreateApplicationIdentity(ctx, config, client, eksClient); err == nil {
+		t.Error("expect error for a missing cluster, got nil")
+	}
+	if client.role != nil {
+		t.Errorf("expect role to be deleted, got %v", *client.role.RoleName)
+	}
+}
+
+func TestReadIdentity(t *testing.T) {
+	ctx := context.Background()
+	// formatting differs from what IAM returns but the policy is equivalent
+	formatted := `{
+		"Version": "2012-10-17",
+		"Statement": [{"Action": "sts:AssumeRole", "Effect": "Allow", "Principal": {"Service": "lambda.amazonaws.com"}}]
+	}`
+	client := &mockIAMClient{
+		role: &types.Role{
+			Arn:                      awssdk.String("arn:aws:iam::account:role/test"),
+			RoleName:                 awssdk.String("test"),
+			AssumeRolePolicyDocument: awssdk.String(url.QueryEscape(testAssumeRolePolicy)),
+		},
+	}
+	config := &aws.ApplicationIdentityConfig{
+		Name:             "test",
+		AssumeRolePolicy: formatted,
+	}
+	if err := aws.ReadApplicationIdentity(ctx, config, client, &mockEKSClient{}); err != nil {
+		t.Fatal(err)
+	}
+
+	compare(t, config.IAMRoleARN, "arn:aws:iam::account:role/test")
+	compare(t, config.AssumeRolePolicy, formatted)
+
+	// an out of band change to the trust policy is surfaced
+	changed := `{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Principal":{"Service":"ec2.amazonaws.com"},"Action":"sts:AssumeRole"}]}`
+	client.role.AssumeRolePolicyDocument = awssdk.String(url.QueryEscape(changed))
+	if err := aws.ReadApplicationIdentity(ctx, config, client, &mockEKSClient{}); err != nil {
+		t.Fatal(err)
+	}
+
+	normalized, _ := structure.NormalizeJsonString(changed)
+	compare(t, config.AssumeRolePolicy, normalized)
+}
+
+func TestReadIdentityNotFound(t *testing.T) {
+	config := &aws.ApplicationIdentityConfig{Name: "test"}
+	err := aws.ReadApplicationIdentity(context.Background(), config, &mockIAMClient{}, &mockEKSClient{})
+
+	var notFound *aws.NotFoundError
+	if !errors.As(err, &notFound) {
+		t.Fatalf("expected a not found error, got %v", err)
+	}
+}
+
+func TestImportIdentity(t *testing.T) {
+	ctx := context.Background()
+	subject := aws.KubernetesSubject{
+		OIDCProviderARN:    "arn:aws:iam::account:oidc-provider/oidc.eks.us-west-2.amazonaws.com/id/EXAMPLE",
+		Namespace:          "default",
+		ServiceAccountName: "app",
+	}
+	created := &aws.ApplicationIdentityConfig{
+		Name:               "test",
+		KubernetesSubjects: []aws.KubernetesSubject{subject},
+	}
+	client := &mockIAMClient{}
+	if err := aws.CreateApplicationIdentity(ctx, created, client, &mockEKSClient{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a role ARN with a path, and a trust policy of Kubernetes service accounts only
+	config := &aws.ApplicationIdentityConfig{Name: "arn:aws:iam::account:role/team/test"}
+	if err := aws.ImportApplicationIdentity(ctx, config, client, &mockEKSClient{}); err != nil {
+		t.Fatal(err)
+	}
+	compare(t, config.Name, "test")
+	compare(t, config.IAMRoleARN, "arn:aws:iam::account:role/test")
+	compare(t, fmt.Sprint(config.KubernetesSubjects), fmt.Sprint([]aws.KubernetesSubject{subject}))
+	compare(t, fmt.Sprint(config.CreateInstanceProfile), "false")
+	if !verify.PoliciesAreEquivalent(config.AssumeRolePolicy, created.AssumeRolePolicy) {
+		t.Errorf("expect %v, got %v", created.AssumeRolePolicy, config.AssumeRolePolicy)
+	}
+
+	// a trust policy of a workload preset imports the workload, and ec2 its instance profile
+	client.role.AssumeRolePolicyDocument = awssdk.String(url.QueryEscape(strings.Replace(testAssumeRolePolicy, "lambda", "ec2", 1)))
+	client.instanceProfiles = []string{"test"}
+	config = &aws.ApplicationIdentityConfig{Name: "test"}
+	if err := aws.ImportApplicationIdentity(ctx, config, client, &mockEKSClient{}); err != nil {
+		t.Fatal(err)
+	}
+	compare(t, config.Workload, "ec2")
+	compare(t, fmt.Sprint(len(config.KubernetesSubjects)), "0")
+	compare(t, fmt.Sprint(config.CreateInstanceProfile), "true")
+	compare(t, config.InstanceProfileARN, "arn:aws:iam::account:instance-profile/test")
+
+	// other workloads can't have an instance profile
+	client.role.AssumeRolePolicyDocument = awssdk.String(url.QueryEscape(testAssumeRolePolicy))
+	config = &aws.ApplicationIdentityConfig{Name: "test"}
+	if err := aws.ImportApplicationIdentity(ctx, config, client, &mockEKSClient{}); err != nil {
+		t.Fatal(err)
+	}
+	compare(t, config.Workload, "lambda")
+	compare(t, fmt.Sprint(config.CreateInstanceProfile), "false")
+
+	// Kubernetes service accounts and a workload, as created together
+	created = &aws.ApplicationIdentityConfig{
+		Name:               "test",
+		Workload:           "ecs_task",
+		KubernetesSubjects: []aws.KubernetesSubject{subject},
+	}
+	if err := aws.CreateApplicationIdentity(ctx, created, client, &mockEKSClient{}); err != nil {
+		t.Fatal(err)
+	}
+	config = &aws.ApplicationIdentityConfig{Name: "test"}
+	if err := aws.ImportApplicationIdentity(ctx, config, client, &mockEKSClient{}); err != nil {
+		t.Fatal(err)
+	}
+	compare(t, config.Workload, "ecs_task")
+	compare(t, fmt.Sprint(config.KubernetesSubjects), fmt.Sprint([]aws.KubernetesSubject{subject}))
+
+	// any other trust policy is only imported as the assume role policy
+	client.role.AssumeRolePolicyDocument = awssdk.String(url.QueryEscape(`{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Principal":{"AWS":"arn:aws:iam::account:root"},"Action":"sts:AssumeRole"},{"Effect":"Allow","Principal":{"Service":"lambda.amazonaws.com"},"Action":"sts:AssumeRole"}]}`))
+	config = &aws.ApplicationIdentityConfig{Name: "test"}
+	if err := aws.ImportApplicationIdentity(ctx, config, client, &mockEKSClient{}); err != nil {
+		t.Fatal(err)
+	}
+	compare(t, config.Workload, "")
+	compare(t, fmt.Sprint(len(config.KubernetesSubjects)), "0")
+
+	config = &aws.ApplicationIdentityConfig{Name: "arn:aws:iam::account:user/test"}
+	if err := aws.ImportApplicationIdentity(ctx, config, client, &mockEKSClient{}); err == nil {
+		t.Error("expect an error for the ARN of a user")
+	}
+}
+
+func TestUpdateIdentity(t *testing.T) {
+	ctx := context.Background()
+	client := &mockIAMClient{
+		role: &types.Role{
+			Arn:                      awssdk.String("arn:aws:iam::account:role/test"),
+			RoleName:                 awssdk.String("test"),
+			AssumeRolePolicyDocument: awssdk.String(url.QueryEscape(testAssumeRolePolicy)),
+		},
+	}
+
+	// reformatting the policy is not a change
+	config := &aws.ApplicationIdentityConfig{
+		Name:             "test",
+		AssumeRolePolicy: `{"Statement": [{"Action": "sts:AssumeRole", "Effect": "Allow", "Principal": {"Service": "lambda.amazonaws.com"}}], "Version": "2012-10-17"}`,
+	}
+	if err := aws.UpdateApplicationIdentity(ctx, config, client, &mockEKSClient{}); err != nil {
+		t.Fatal(err)
+	}
+	if client.policyUpdates != 0 {
+		t.Errorf("expect no assume role policy updates, got %d", client.policyUpdates)
+	}
+	compare(t, config.IAMRoleARN, "arn:aws:iam::account:role/test")
+
+	config.AssumeRolePolicy = `{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Principal":{"Service":"ec2.amazonaws.com"},"Action":"sts:AssumeRole"}]}`
+	if err := aws.UpdateApplicationIdentity(ctx, config, client, &mockEKSClient{}); err != nil {
+		t.Fatal(err)
+	}
+	if client.policyUpdates != 1 {
+		t.Errorf("expect 1 assume role policy update, got %d", client.policyUpdates)
+	}
+}
+
+func TestUpdateIdentityGeneratedPolicyDrift(t *testing.T) {
+	ctx := context.Background()
+	config := &aws.ApplicationIdentityConfig{
+		Name: "test",
+		KubernetesSubjects: []aws.KubernetesSubject{{
+			OIDCProviderARN:    "arn:aws:iam::account:oidc-provider/oidc.eks.us-west-2.amazonaws.com/id/EXAMPLE",
+			Namespace:          "default",
+			ServiceAccountName: "app",
+		}},
+	}
+	client := &mockIAMClient{}
+	if err := aws.CreateApplicationIdentity(ctx, config, client, &mockEKSClient{}); err != nil {
+		t.Fatal(err)
+	}
+	generated := config.AssumeRolePolicy
+
+	// without drift the generated policy matches the one read back
+	if err := aws.ReadApplicationIdentity(ctx, config, client, &mockEKSClient{}); err != nil {
+		t.Fatal(err)
+	}
+	planned, err := aws.GenerateAssumeRolePolicy(ctx, config, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !verify.PoliciesAreEquivalent(config.AssumeRolePolicy, planned) {
+		t.Errorf("expect %v, got %v", planned, config.AssumeRolePolicy)
+	}
+
+	// the changed trust policy is read back and no longer matches the generated one
+	client.role.AssumeRolePolicyDocument = awssdk.String(url.QueryEscape(testAssumeRolePolicy))
+	if err := aws.ReadApplicationIdentity(ctx, config, client, &mockEKSClient{}); err != nil {
+		t.Fatal(err)
+	}
+	if verify.PoliciesAreEquivalent(config.AssumeRolePolicy, planned) {
+		t.Errorf("expect the read policy to differ from %v", planned)
+	}
+
+	// applying the generated policy restores it
+	config.AssumeRolePolicy = planned
+	if err := aws.UpdateApplicationIdentity(ctx, config, client, &mockEKSClient{}); err != nil {
+		t.Fatal(err)
+	}
+	if client.policyUpdates != 1 {
+		t.Errorf("expect 1 assume role policy update, got %d", client.policyUpdates)
+	}
+	remote, _ := url.QueryUnescape(awssdk.ToString(client.role.AssumeRolePolicyDocument))
+	if !verify.PoliciesAreEquivalent(remote, generated) {
+		t.Errorf("expect %v, got %v", generated, remote)
+	}
+
+	// a policy supplied by the configuration isn't generated
+	planned, err = aws.GenerateAssumeRolePolicy(ctx, &aws.ApplicationIdentityConfig{Name: "test", AssumeRolePolicy: testAssumeRolePolicy}, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compare(t, planned, "")
+}
+
+func TestUpdateIdentityAttributes(t *testing.T) {
+	ctx := context.Background()
+	config := &aws.ApplicationIdentityConfig{
+		Name:             "test",
+		AssumeRolePolicy: testAssumeRolePolicy,
+		Description:      "before",
+		Tags:             map[string]string{"team": "platform", "cost-center": "1"},
+	}
+	client := &mockIAMClient{}
+	if err := aws.CreateApplicationIdentity(ctx, config, client, &mockEKSClient{}); err != nil {
+		t.Fatal(err)
+	}
+	compare(t, config.Path, "/")
+
+	config.Description = "after"
+	config.MaxSessionDuration = 7200
+	config.PermissionsBoundary = "arn:aws:iam::account:policy/boundary"
+	config.Tags = map[string]string{"team": "data"}
+	if err := aws.UpdateApplicationIdentity(ctx, config, client, &mockEKSClient{}); err != nil {
+		t.Fatal(err)
+	}
+
+	read := &aws.ApplicationIdentityConfig{Name: "test", AssumeRolePolicy: testAssumeRolePolicy}
+	if err := aws.ReadApplicationIdentity(ctx, read, client, &mockEKSClient{}); err != nil {
+		t.Fatal(err)
+	}
+	compare(t, read.Description, "after")
+	compare(t, read.PermissionsBoundary, "arn:aws:iam::account:policy/boundary")
+	compare(t, fmt.Sprint(read.MaxSessionDuration), "7200")
+	compare(t, fmt.Sprint(read.Tags), "map[team:data]")
+}
+
+func TestDeleteIdentityForceDetach(t *testing.T) {
+	ctx := context.Background()
+	client := &mockIAMClient{
+		role:             &types.Role{RoleName: awssdk.String("test")},
+		attachedPolicies: []string{"arn:aws:iam::aws:policy/ReadOnlyAccess"},
+		inlinePolicies:   []string{"inline"},
+		instanceProfiles: []string{"profile"},
+	}
+	config := &aws.ApplicationIdentityConfig{Name: "test"}
+	if err := aws.DeleteApplicationIdentity(ctx, config, client, &mockEKSClient{}); err == nil {
+		t.Fatal("expect delete to conflict without force_detach_on_destroy")
+	}
+
+	config.ForceDetachOnDestroy = true
+	if err := aws.DeleteApplicationIdentity(ctx, config, client, &mockEKSClient{}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "[managed policy arn:aws:iam::aws:policy/ReadOnlyAccess inline policy inline instance profile profile]"
+	compare(t, fmt.Sprint(config.DetachedDependencies), want)
+}
+
+func TestDeleteIdentityNotFound(t *testing.T) {
+	ctx := context.Background()
+	config := &aws.ApplicationIdentityConfig{
+		Name:               "test",
+		InstanceProfileARN: "arn:aws:iam::account:instance-profile/test",
+	}
+	err := aws.DeleteApplicationIdentity(ctx, config, &mockIAMClient{}, &mockEKSClient{})
+	var notFound *aws.NotFoundError
+	if !errors.As(err, &notFound) {
+		t.Errorf("expect NotFoundError, got %v", err)
+	}
+
+	config.ForceDetachOnDestroy = true
+	err = aws.DeleteApplicationIdentity(ctx, config, &mockIAMClient{}, &mockEKSClient{})
+	if !errors.As(err, &notFound) {
+		t.Errorf("expect NotFoundError with force_detach_on_destroy, got %v", err)
+	}
+}
+
+func compare(t *testing.T, got string, want string) {
+	if want != got {
+		t.Errorf("expect %v, got %v", want, got)
+	}
+}
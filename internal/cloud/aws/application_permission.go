@@ -4,7 +4,9 @@ import (
 	"context"
 	"fmt"
 	"regexp"
+	"strings"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/iam"
 )
 
@@ -33,7 +35,34 @@ func CreateApplicationPermission(ctx context.Context, config *ApplicationPermiss
 	return nil
 }
 
+// ReadApplicationPermission returns a NotFoundError when the policy was detached from the role outside Terraform
 func ReadApplicationPermission(ctx context.Context, config *ApplicationPermissionConfig, client IAMClient) error {
+	attached, err := isRolePolicyAttached(ctx, config, client)
+	if err != nil {
+		return err
+	}
+	if !attached {
+		return &NotFoundError{Resource: fmt.Sprintf("policy %s attached to role %s", config.PolicyARN, config.RoleARN)}
+	}
+	return nil
+}
+
+// ImportApplicationPermission adopts the policy attachment with the ID roleArn#policyArn in config.ID
+func ImportApplicationPermission(ctx context.Context, config *ApplicationPermissionConfig, client IAMClient) error {
+	segments := strings.Split(config.ID, "#")
+	if len(segments) != 2 || !strings.HasPrefix(segments[0], "arn:") || !strings.HasPrefix(segments[1], "arn:") {
+		return fmt.Errorf("expected import ID to be in the format `{role_arn}#{policy_arn}` but got %q", config.ID)
+	}
+	config.RoleARN = segments[0]
+	config.PolicyARN = segments[1]
+
+	attached, err := isRolePolicyAttached(ctx, config, client)
+	if err != nil {
+		return err
+	}
+	if !attached {
+		return &NotFoundError{Resource: fmt.Sprintf("policy %s attached to role %s", config.PolicyARN, config.RoleARN)}
+	}
 	return nil
 }
 
@@ -56,6 +85,26 @@ func DeleteApplicationPermission(ctx context.Context, config *ApplicationPermiss
 	return nil
 }
 
+func isRolePolicyAttached(ctx context.Context, config *ApplicationPermissionConfig, client IAMClient) (bool, error) {
+	roleName := getResourceNameFromARN(config.RoleARN)
+	paginator := iam.NewListAttachedRolePoliciesPaginator(client, &iam.ListAttachedRolePoliciesInput{RoleName: &roleName})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			if isNoSuchEntityError(err) {
+				return false, &NotFoundError{Resource: fmt.Sprintf("IAM role %s", roleName), Err: err}
+			}
+			return false, fmt.Errorf("listing policies attached to role %s: %w", roleName, err)
+		}
+		for _, policy := range page.AttachedPolicies {
+			if aws.ToString(policy.PolicyArn) == config.PolicyARN {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
 func getResourceNameFromARN(arn string) string {
 	var nameRegex = regexp.MustCompile(`[^:/]*$`)
 	return nameRegex.FindString(arn)
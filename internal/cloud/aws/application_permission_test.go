@@ -0,0 +1,65 @@
+package aws_test
+
+import (
+	"context"
+	"errors"
+	"terraform-provider-mdxc/internal/cloud/aws"
+	"testing"
+
+	awssdk "github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+)
+
+func TestReadPermission(t *testing.T) {
+	ctx := context.Background()
+	client := &mockIAMClient{
+		attachedPolicies: []string{
+			"arn:aws:iam::aws:policy/ReadOnlyAccess",
+			"arn:aws:iam::aws:policy/AmazonS3ReadOnlyAccess",
+			"arn:aws:iam::aws:policy/AmazonSQSFullAccess",
+		},
+		pageSize: 1,
+	}
+	config := &aws.ApplicationPermissionConfig{
+		ID:        "arn:aws:iam::account:role/test#arn:aws:iam::aws:policy/AmazonSQSFullAccess",
+		RoleARN:   "arn:aws:iam::account:role/test",
+		PolicyARN: "arn:aws:iam::aws:policy/AmazonSQSFullAccess",
+	}
+	if err := aws.ReadApplicationPermission(ctx, config, client); err != nil {
+		t.Fatal(err)
+	}
+
+	// a policy detached outside Terraform is removed from the state
+	client.DetachRolePolicy(ctx, &iam.DetachRolePolicyInput{PolicyArn: awssdk.String(config.PolicyARN)})
+	var notFound *aws.NotFoundError
+	if err := aws.ReadApplicationPermission(ctx, config, client); !errors.As(err, &notFound) {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+}
+
+func TestImportPermission(t *testing.T) {
+	ctx := context.Background()
+	client := &mockIAMClient{attachedPolicies: []string{"arn:aws:iam::aws:policy/ReadOnlyAccess"}}
+	config := &aws.ApplicationPermissionConfig{
+		ID: "arn:aws:iam::account:role/test#arn:aws:iam::aws:policy/ReadOnlyAccess",
+	}
+	if err := aws.ImportApplicationPermission(ctx, config, client); err != nil {
+		t.Fatal(err)
+	}
+	compare(t, config.RoleARN, "arn:aws:iam::account:role/test")
+	compare(t, config.PolicyARN, "arn:aws:iam::aws:policy/ReadOnlyAccess")
+
+	// a policy that isn't attached can't be imported
+	config = &aws.ApplicationPermissionConfig{
+		ID: "arn:aws:iam::account:role/test#arn:aws:iam::aws:policy/AdministratorAccess",
+	}
+	var notFound *aws.NotFoundError
+	if err := aws.ImportApplicationPermission(ctx, config, client); !errors.As(err, &notFound) {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+
+	config = &aws.ApplicationPermissionConfig{ID: "arn:aws:iam::account:role/test"}
+	if err := aws.ImportApplicationPermission(ctx, config, client); err == nil {
+		t.Error("expect an error for an ID without a policy ARN")
+	}
+}
@@ -0,0 +1,30 @@
+package aws
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/service/iam/types"
+)
+
+// NotFoundError reports an IAM role, policy attachment or trust statement that no longer exists
+type NotFoundError struct {
+	Resource string
+	Err      error
+}
+
+func (e *NotFoundError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("%s not found", e.Resource)
+	}
+	return fmt.Sprintf("%s not found: %s", e.Resource, e.Err)
+}
+
+func (e *NotFoundError) Unwrap() error {
+	return e.Err
+}
+
+func isNoSuchEntityError(err error) bool {
+	var notFound *types.NoSuchEntityException
+	return errors.As(err, &notFound)
+}
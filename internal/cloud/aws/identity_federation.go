@@ -0,0 +1,231 @@
+package aws
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/structure"
+)
+
+// IdentityFederationConfig lets an identity of another cloud assume the role with an OIDC token
+type IdentityFederationConfig struct {
+	// <role ARN>#<statement Sid>
+	ID      string
+	RoleARN string
+	// issuer and sub claim of the other cloud's identity token
+	Issuer  string
+	Subject string
+	// the audience the other cloud's identity requests its token for, defaults to sts.amazonaws.com
+	Audience string
+}
+
+// Google issues the tokens of service accounts, AWS trusts it without an IAM OIDC provider
+const googleIssuer = "https://accounts.google.com"
+
+func CreateIdentityFederation(ctx context.Context, config *IdentityFederationConfig, client IAMClient) error {
+	if config.Audience == "" {
+		config.Audience = "sts.amazonaws.com"
+	}
+
+	statement, err := identityFederationTrustStatement(ctx, config, client)
+	if err != nil {
+		return err
+	}
+	raw, err := json.Marshal(statement)
+	if err != nil {
+		return fmt.Errorf("marshalling trust policy statement: %w", err)
+	}
+
+	roleName := getResourceNameFromARN(config.RoleARN)
+	policy, federation, err := getRoleTrustPolicy(ctx, roleName, client)
+	if err != nil {
+		return err
+	}
+
+	for _, existing := range federation {
+		if identityFederationStatementSid(existing) == statement.Sid {
+			return fmt.Errorf("role %s already trusts subject %s of %s for audience %s in statement %s", roleName, config.Subject, config.Issuer, config.Audience, statement.Sid)
+		}
+	}
+	statements := append(federation, raw)
+
+	if errUpdate := updateRoleTrustPolicy(ctx, roleName, policy, statements, client); errUpdate != nil {
+		return errUpdate
+	}
+
+	config.ID = fmt.Sprintf("%s#%s", config.RoleARN, statement.Sid)
+	return nil
+}
+
+func ReadIdentityFederation(ctx context.Context, config *IdentityFederationConfig, client IAMClient) error {
+	roleName, sid, err := parseIdentityFederationID(config)
+	if err != nil {
+		return err
+	}
+
+	_, federation, err := getRoleTrustPolicy(ctx, roleName, client)
+	if err != nil {
+		if isNoSuchEntityError(err) {
+			return &NotFoundError{Resource: fmt.Sprintf("IAM role %s", roleName), Err: err}
+		}
+		return err
+	}
+	for _, statement := range federation {
+		if identityFederationStatementSid(statement) == sid {
+			return readIdentityFederationStatement(config, statement)
+		}
+	}
+
+	return &NotFoundError{Resource: fmt.Sprintf("trust policy statement %s in role %s", sid, roleName)}
+}
+
+// readIdentityFederationStatement refreshes the issuer, subject and audience from the statement
+// identityFederationTrustStatement generated
+func readIdentityFederationStatement(config *IdentityFederationConfig, raw json.RawMessage) error {
+	var statement trustPolicyStatement
+	if err := json.Unmarshal(raw, &statement); err != nil {
+		return fmt.Errorf("unmarshalling trust policy statement: %w", err)
+	}
+
+	federated := statement.Principal["Federated"]
+	issuer := googleIssuer
+	audienceKey := "accounts.google.com:oaud"
+	if federated != "accounts.google.com" {
+		host, err := getIssuerFromOIDCProviderARN(federated)
+		if err != nil {
+			return err
+		}
+		issuer = "https://" + host
+		audienceKey = fmt.Sprintf("%s:aud", host)
+	}
+	subjectKey := fmt.Sprintf("%s:sub", strings.TrimPrefix(issuer, "https://"))
+
+	// keep the configured issuer when it only differs in the trailing slash, like findOIDCProviderARN
+	if strings.TrimSuffix(config.Issuer, "/") != issuer {
+		config.Issuer = issuer
+	}
+	config.Subject = statement.Condition["StringEquals"][subjectKey]
+	if subject, ok := statement.Condition["StringLike"][subjectKey]; ok {
+		config.Subject = subject
+	}
+	config.Audience = statement.Condition["StringEquals"][audienceKey]
+	return nil
+}
+
+func DeleteIdentityFederation(ctx context.Context, config *IdentityFederationConfig, client IAMClient) error {
+	roleName, sid, err := parseIdentityFederationID(config)
+	if err != nil {
+		return err
+	}
+
+	policy, federation, err := getRoleTrustPolicy(ctx, roleName, client)
+	if err != nil {
+		return err
+	}
+	statements := []json.RawMessage{}
+	for _, statement := range federation {
+		if identityFederationStatementSid(statement) != sid {
+			statements = append(statements, statement)
+		}
+	}
+	if len(statements) == len(federation) {
+		return nil
+	}
+
+	return updateRoleTrustPolicy(ctx, roleName, policy, statements, client)
+}
+
+func identityFederationTrustStatement(ctx context.Context, config *IdentityFederationConfig, client IAMClient) (trustPolicyStatement, error) {
+	// every setting that tells federations apart, a statement may only be shared by the federation that created it
+	hash := sha256.Sum256([]byte(strings.Join([]string{config.RoleARN, config.Issuer, config.Subject, config.Audience}, "\x00")))
+	sid := fmt.Sprintf("%s%x", identityFederationSidPrefix, hash[:4])
+
+	// https://docs.aws.amazon.com/IAM/latest/UserGuide/reference_policies_iam-condition-keys.html#condition-keys-wif
+	if strings.TrimSuffix(config.Issuer, "/") == googleIssuer {
+		return trustPolicyStatement{
+			Sid:    sid,
+			Effect: "Allow",
+			Principal: map[string]string{
+				"Federated": "accounts.google.com",
+			},
+			Action: "sts:AssumeRoleWithWebIdentity",
+			Condition: map[string]map[string]string{
+				"StringEquals": {
+					// Google sets the authorized party to the service account, which AWS compares as aud
+					"accounts.google.com:aud":  config.Subject,
+					"accounts.google.com:sub":  config.Subject,
+					"accounts.google.com:oaud": config.Audience,
+				},
+			},
+		}, nil
+	}
+
+	oidcProviderARN, err := findOIDCProviderARN(ctx, config.Issuer, client)
+	if err != nil {
+		return trustPolicyStatement{}, err
+	}
+	statement, err := oidcFederationTrustStatement(oidcProviderARN, config.Audience, config.Subject)
+	if err != nil {
+		return trustPolicyStatement{}, err
+	}
+	statement.Sid = sid
+	return statement, nil
+}
+
+// getRoleTrustPolicy returns the role's trust policy without, and the statements of, its identity federations
+func getRoleTrustPolicy(ctx context.Context, roleName string, client IAMClient) (string, []json.RawMessage, error) {
+	output, err := client.GetRole(ctx, &iam.GetRoleInput{RoleName: aws.String(roleName)})
+	if err != nil {
+		return "", nil, err
+	}
+
+	// IAM returns the assume role policy URL encoded
+	policy, err := url.QueryUnescape(aws.ToString(output.Role.AssumeRolePolicyDocument))
+	if err != nil {
+		return "", nil, fmt.Errorf("decoding assume role policy for role %s: %w", roleName, err)
+	}
+	return splitIdentityFederationStatements(policy)
+}
+
+func updateRoleTrustPolicy(ctx context.Context, roleName string, policy string, federation []json.RawMessage, client IAMClient) error {
+	merged, err := appendPolicyStatements(policy, federation)
+	if err != nil {
+		return err
+	}
+	normalized, err := structure.NormalizeJsonString(merged)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.UpdateAssumeRolePolicy(ctx, &iam.UpdateAssumeRolePolicyInput{
+		PolicyDocument: aws.String(normalized),
+		RoleName:       aws.String(roleName),
+	})
+	if err != nil {
+		return fmt.Errorf("updating assume role policy of role %s: %w", roleName, err)
+	}
+	return nil
+}
+
+func identityFederationStatementSid(statement json.RawMessage) string {
+	var sid struct {
+		Sid string `json:"Sid"`
+	}
+	_ = json.Unmarshal(statement, &sid)
+	return sid.Sid
+}
+
+func parseIdentityFederationID(config *IdentityFederationConfig) (string, string, error) {
+	segments := strings.SplitN(config.ID, "#", 2)
+	if len(segments) != 2 || !strings.HasPrefix(segments[1], identityFederationSidPrefix) {
+		return "", "", fmt.Errorf("expected identity federation ID to be in the format `{role ARN}#{statement Sid}` but got %q", config.ID)
+	}
+	config.RoleARN = segments[0]
+	return getResourceNameFromARN(segments[0]), segments[1], nil
+}
@@ -0,0 +1,104 @@
+package aws_test
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"terraform-provider-mdxc/internal/cloud/aws"
+	"testing"
+)
+
+func TestIdentityFederation(t *testing.T) {
+	ctx := context.Background()
+	client := &mockIAMClient{}
+	identity := &aws.ApplicationIdentityConfig{
+		Name:     "test",
+		Workload: "lambda",
+	}
+	if err := aws.CreateApplicationIdentity(ctx, identity, client, &mockEKSClient{}); err != nil {
+		t.Fatal(err)
+	}
+
+	federation := &aws.IdentityFederationConfig{
+		RoleARN: identity.IAMRoleARN,
+		Issuer:  "https://accounts.google.com",
+		Subject: "123456789",
+	}
+	if err := aws.CreateIdentityFederation(ctx, federation, client); err != nil {
+		t.Fatal(err)
+	}
+	compare(t, federation.Audience, "sts.amazonaws.com")
+	if !strings.HasPrefix(federation.ID, "arn:aws:iam::account:role/test#MdxcIdentityFederation") {
+		t.Errorf("expect the ID to name the trust policy statement, got %v", federation.ID)
+	}
+	if !strings.Contains(trustPolicy(t, client), `"accounts.google.com:sub":"123456789"`) {
+		t.Errorf("expect trust policy to trust the service account, got %v", trustPolicy(t, client))
+	}
+
+	// the same federation can't be created twice, one for another audience can
+	duplicate := &aws.IdentityFederationConfig{
+		RoleARN: identity.IAMRoleARN,
+		Issuer:  "https://accounts.google.com",
+		Subject: "123456789",
+	}
+	if err := aws.CreateIdentityFederation(ctx, duplicate, client); err == nil {
+		t.Error("expect an error for an existing federation")
+	}
+	otherAudience := &aws.IdentityFederationConfig{
+		RoleARN:  identity.IAMRoleARN,
+		Issuer:   "https://accounts.google.com",
+		Subject:  "123456789",
+		Audience: "other",
+	}
+	if err := aws.CreateIdentityFederation(ctx, otherAudience, client); err != nil {
+		t.Fatal(err)
+	}
+	if otherAudience.ID == federation.ID {
+		t.Errorf("expect federations for different audiences to have different IDs, got %v", otherAudience.ID)
+	}
+	if err := aws.DeleteIdentityFederation(ctx, otherAudience, client); err != nil {
+		t.Fatal(err)
+	}
+
+	// the application identity neither sees the federation as drift nor removes it
+	generated := identity.AssumeRolePolicy
+	if err := aws.ReadApplicationIdentity(ctx, identity, client, &mockEKSClient{}); err != nil {
+		t.Fatal(err)
+	}
+	compare(t, identity.AssumeRolePolicy, generated)
+
+	identity.Workload = "ecs_task"
+	if err := aws.UpdateApplicationIdentity(ctx, identity, client, &mockEKSClient{}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(trustPolicy(t, client), "ecs-tasks.amazonaws.com") || !strings.Contains(trustPolicy(t, client), "accounts.google.com") {
+		t.Errorf("expect trust policy to trust ECS tasks and the service account, got %v", trustPolicy(t, client))
+	}
+
+	read := &aws.IdentityFederationConfig{ID: federation.ID}
+	if err := aws.ReadIdentityFederation(ctx, read, client); err != nil {
+		t.Fatal(err)
+	}
+	compare(t, read.RoleARN, identity.IAMRoleARN)
+	compare(t, read.Issuer, "https://accounts.google.com")
+	compare(t, read.Subject, "123456789")
+	compare(t, read.Audience, "sts.amazonaws.com")
+
+	if err := aws.DeleteIdentityFederation(ctx, federation, client); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(trustPolicy(t, client), "accounts.google.com") {
+		t.Errorf("expect the federation to be removed, got %v", trustPolicy(t, client))
+	}
+	if err := aws.ReadIdentityFederation(ctx, read, client); err == nil {
+		t.Error("expect an error for a removed federation")
+	}
+}
+
+func trustPolicy(t *testing.T, client *mockIAMClient) string {
+	policy, err := url.QueryUnescape(*client.role.AssumeRolePolicyDocument)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return policy
+}
@@ -0,0 +1,145 @@
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/eks"
+	ekstypes "github.com/aws/aws-sdk-go-v2/service/eks/types"
+)
+
+// https://docs.aws.amazon.com/eks/latest/userguide/pod-id-role.html
+func podIdentityTrustStatement() trustPolicyStatement {
+	return trustPolicyStatement{
+		Effect: "Allow",
+		Principal: map[string]string{
+			"Service": "pods.eks.amazonaws.com",
+		},
+		Action: []string{
+			"sts:AssumeRole",
+			"sts:TagSession",
+		},
+	}
+}
+
+func createPodIdentityAssociation(ctx context.Context, config *ApplicationIdentityConfig, client EKSClient) error {
+	input := eks.CreatePodIdentityAssociationInput{
+		ClusterName:    aws.String(config.PodIdentityClusterName),
+		Namespace:      aws.String(config.PodIdentityNamespace),
+		ServiceAccount: aws.String(config.PodIdentityServiceAccountName),
+		RoleArn:        aws.String(config.IAMRoleARN),
+	}
+
+	output, err := client.CreatePodIdentityAssociation(ctx, &input)
+	if err != nil {
+		return err
+	}
+
+	config.PodIdentityAssociationARN = aws.ToString(output.Association.AssociationArn)
+	return nil
+}
+
+// readPodIdentityAssociation refreshes the association into config. If the association
+// no longer exists the pod identity fields are cleared so the next plan recreates it.
+func readPodIdentityAssociation(ctx context.Context, config *ApplicationIdentityConfig, client EKSClient) error {
+	clusterName, associationID, parseErr := parsePodIdentityAssociationARN(config.PodIdentityAssociationARN)
+	if parseErr != nil {
+		return parseErr
+	}
+
+	input := eks.DescribePodIdentityAssociationInput{
+		ClusterName:   aws.String(clusterName),
+		AssociationId: aws.String(associationID),
+	}
+
+	output, err := client.DescribePodIdentityAssociation(ctx, &input)
+	if err != nil {
+		var notFound *ekstypes.ResourceNotFoundException
+		if errors.As(err, &notFound) {
+			config.PodIdentityClusterName = ""
+			config.PodIdentityNamespace = ""
+			config.PodIdentityServiceAccountName = ""
+			config.PodIdentityAssociationARN = ""
+			return nil
+		}
+		return err
+	}
+
+	config.PodIdentityClusterName = aws.ToString(output.Association.ClusterName)
+	config.PodIdentityNamespace = aws.ToString(output.Association.Namespace)
+	config.PodIdentityServiceAccountName = aws.ToString(output.Association.ServiceAccount)
+	return nil
+}
+
+// updatePodIdentityAssociation reconciles the association with config. EKS only allows
+// changing the role of an association, so any other change replaces it.
+func updatePodIdentityAssociation(ctx context.Context, config *ApplicationIdentityConfig, client EKSClient) error {
+	if config.PodIdentityAssociationARN != "" {
+		current := ApplicationIdentityConfig{
+			PodIdentityAssociationARN: config.PodIdentityAssociationARN,
+		}
+		if err := readPodIdentityAssociation(ctx, &current, client); err != nil {
+			return err
+		}
+
+		unchanged := current.PodIdentityClusterName == config.PodIdentityClusterName &&
+			current.PodIdentityNamespace == config.PodIdentityNamespace &&
+			current.PodIdentityServiceAccountName == config.PodIdentityServiceAccountName
+		if unchanged {
+			return nil
+		}
+
+		if err := deletePodIdentityAssociation(ctx, current.PodIdentityAssociationARN, client); err != nil {
+			return err
+		}
+		config.PodIdentityAssociationARN = ""
+	}
+
+	if config.PodIdentityClusterName == "" {
+		return nil
+	}
+
+	return createPodIdentityAssociation(ctx, config, client)
+}
+
+func deletePodIdentityAssociation(ctx context.Context, associationARN string, client EKSClient) error {
+	if associationARN == "" {
+		return nil
+	}
+
+	clusterName, associationID, parseErr := parsePodIdentityAssociationARN(associationARN)
+	if parseErr != nil {
+		return parseErr
+	}
+
+	input := eks.DeletePodIdentityAssociationInput{
+		ClusterName:   aws.String(clusterName),
+		AssociationId: aws.String(associationID),
+	}
+
+	_, err := client.DeletePodIdentityAssociation(ctx, &input)
+	if err != nil {
+		var notFound *ekstypes.ResourceNotFoundException
+		if errors.As(err, &notFound) {
+			return nil
+		}
+		return err
+	}
+
+	return nil
+}
+
+// arn:aws:eks:us-west-2:123456789012:podidentityassociation/{cluster}/{associationId}
+func parsePodIdentityAssociationARN(arn string) (string, string, error) {
+	segments := strings.Split(arn, ":podidentityassociation/")
+	if len(segments) == 2 {
+		path := strings.Split(segments[1], "/")
+		if len(path) == 2 && path[0] != "" && path[1] != "" {
+			return path[0], path[1], nil
+		}
+	}
+	return "", "", fmt.Errorf("expected Pod Identity Association ARN to be in the format `arn:aws:eks:{region}:{account}:podidentityassociation/{cluster}/{associationId}` but got %q", arn)
+}
@@ -0,0 +1,209 @@
+package aws
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+type trustPolicyDocument struct {
+	Version   string                 `json:"Version"`
+	Statement []trustPolicyStatement `json:"Statement"`
+}
+
+type trustPolicyStatement struct {
+	Sid       string                       `json:"Sid,omitempty"`
+	Effect    string                       `json:"Effect"`
+	Principal map[string]string            `json:"Principal"`
+	Action    interface{}                  `json:"Action"`
+	Condition map[string]map[string]string `json:"Condition,omitempty"`
+}
+
+func (d trustPolicyDocument) String() (string, error) {
+	policy, err := json.Marshal(d)
+	if err != nil {
+		return "", fmt.Errorf("marshalling trust policy: %w", err)
+	}
+	return string(policy), nil
+}
+
+// https://docs.aws.amazon.com/eks/latest/userguide/associate-service-account-role.html
+func kubernetesTrustStatement(oidcProviderARN string, namespace string, serviceAccountName string) (trustPolicyStatement, error) {
+	issuer, err := getIssuerFromOIDCProviderARN(oidcProviderARN)
+	if err != nil {
+		return trustPolicyStatement{}, err
+	}
+
+	return trustPolicyStatement{
+		Effect: "Allow",
+		Principal: map[string]string{
+			"Federated": oidcProviderARN,
+		},
+		Action: "sts:AssumeRoleWithWebIdentity",
+		Condition: map[string]map[string]string{
+			"StringEquals": {
+				fmt.Sprintf("%s:sub", issuer): fmt.Sprintf("system:serviceaccount:%s:%s", namespace, serviceAccountName),
+				fmt.Sprintf("%s:aud", issuer): "sts.amazonaws.com",
+			},
+		},
+	}, nil
+}
+
+// https://docs.github.com/en/actions/deployment/security-hardening-your-deployments/configuring-openid-connect-in-amazon-web-services
+func oidcFederationTrustStatement(oidcProviderARN string, audience string, subject string) (trustPolicyStatement, error) {
+	issuer, err := getIssuerFromOIDCProviderARN(oidcProviderARN)
+	if err != nil {
+		return trustPolicyStatement{}, err
+	}
+	if audience == "" {
+		audience = "sts.amazonaws.com"
+	}
+
+	statement := trustPolicyStatement{
+		Effect: "Allow",
+		Principal: map[string]string{
+			"Federated": oidcProviderARN,
+		},
+		Action: "sts:AssumeRoleWithWebIdentity",
+		Condition: map[string]map[string]string{
+			"StringEquals": {
+				fmt.Sprintf("%s:aud", issuer): audience,
+			},
+		},
+	}
+	if strings.Contains(subject, "*") {
+		statement.Condition["StringLike"] = map[string]string{
+			fmt.Sprintf("%s:sub", issuer): subject,
+		}
+	} else {
+		statement.Condition["StringEquals"][fmt.Sprintf("%s:sub", issuer)] = subject
+	}
+	return statement, nil
+}
+
+// kubernetesSubjectsFromTrustPolicy returns the Kubernetes service accounts of a policy made of kubernetesTrustStatement
+// statements only, and nil for any other policy
+func kubernetesSubjectsFromTrustPolicy(policy string) []KubernetesSubject {
+	_, statements, err := parsePolicyStatements(policy)
+	if err != nil || len(statements) == 0 {
+		return nil
+	}
+
+	subjects := make([]KubernetesSubject, 0, len(statements))
+	for _, raw := range statements {
+		var statement trustPolicyStatement
+		if err := json.Unmarshal(raw, &statement); err != nil {
+			return nil
+		}
+		oidcProviderARN := statement.Principal["Federated"]
+		issuer, err := getIssuerFromOIDCProviderARN(oidcProviderARN)
+		if err != nil || len(statement.Condition) != 1 || len(statement.Condition["StringEquals"]) != 2 {
+			return nil
+		}
+		serviceAccount := strings.Split(statement.Condition["StringEquals"][fmt.Sprintf("%s:sub", issuer)], ":")
+		if len(serviceAccount) != 4 || serviceAccount[0] != "system" || serviceAccount[1] != "serviceaccount" {
+			return nil
+		}
+
+		subject := KubernetesSubject{
+			OIDCProviderARN:    oidcProviderARN,
+			Namespace:          serviceAccount[2],
+			ServiceAccountName: serviceAccount[3],
+		}
+		expected, _ := kubernetesTrustStatement(subject.OIDCProviderARN, subject.Namespace, subject.ServiceAccountName)
+		if statement.Sid != "" || statement.Effect != expected.Effect || statement.Action != expected.Action || len(statement.Principal) != 1 ||
+			statement.Condition["StringEquals"][fmt.Sprintf("%s:aud", issuer)] != "sts.amazonaws.com" {
+			return nil
+		}
+		subjects = append(subjects, subject)
+	}
+	return subjects
+}
+
+// statements added by identity federations carry a Sid with this prefix, so the application identity owning
+// the rest of the trust policy leaves them alone
+const identityFederationSidPrefix = "MdxcIdentityFederation"
+
+// splitIdentityFederationStatements separates the statements of identity federations from the rest of the policy.
+// The policy is returned unchanged when it has none.
+func splitIdentityFederationStatements(policy string) (string, []json.RawMessage, error) {
+	document, statements, err := parsePolicyStatements(policy)
+	if err != nil {
+		return "", nil, err
+	}
+
+	rest := []json.RawMessage{}
+	federation := []json.RawMessage{}
+	for _, statement := range statements {
+		var sid struct {
+			Sid string `json:"Sid"`
+		}
+		if err := json.Unmarshal(statement, &sid); err != nil {
+			return "", nil, fmt.Errorf("unmarshalling trust policy statement: %w", err)
+		}
+		if strings.HasPrefix(sid.Sid, identityFederationSidPrefix) {
+			federation = append(federation, statement)
+		} else {
+			rest = append(rest, statement)
+		}
+	}
+	if len(federation) == 0 {
+		return policy, nil, nil
+	}
+
+	restPolicy, err := marshalPolicyStatements(document, rest)
+	return restPolicy, federation, err
+}
+
+// appendPolicyStatements adds statements to the policy
+func appendPolicyStatements(policy string, statements []json.RawMessage) (string, error) {
+	if len(statements) == 0 {
+		return policy, nil
+	}
+	document, existing, err := parsePolicyStatements(policy)
+	if err != nil {
+		return "", err
+	}
+	return marshalPolicyStatements(document, append(existing, statements...))
+}
+
+// parsePolicyStatements returns the policy document and its statements, which may be a single object
+func parsePolicyStatements(policy string) (map[string]json.RawMessage, []json.RawMessage, error) {
+	document := map[string]json.RawMessage{}
+	if err := json.Unmarshal([]byte(policy), &document); err != nil {
+		return nil, nil, fmt.Errorf("unmarshalling trust policy: %w", err)
+	}
+
+	statements := []json.RawMessage{}
+	raw := document["Statement"]
+	if len(raw) == 0 {
+		return document, statements, nil
+	}
+	if errList := json.Unmarshal(raw, &statements); errList != nil {
+		statements = []json.RawMessage{raw}
+	}
+	return document, statements, nil
+}
+
+func marshalPolicyStatements(document map[string]json.RawMessage, statements []json.RawMessage) (string, error) {
+	raw, err := json.Marshal(statements)
+	if err != nil {
+		return "", fmt.Errorf("marshalling trust policy statements: %w", err)
+	}
+	document["Statement"] = raw
+
+	policy, err := json.Marshal(document)
+	if err != nil {
+		return "", fmt.Errorf("marshalling trust policy: %w", err)
+	}
+	return string(policy), nil
+}
+
+// arn:aws:iam::123456789012:oidc-provider/oidc.eks.us-west-2.amazonaws.com/id/EXAMPLED539D4633E53DE1B71EXAMPLE
+func getIssuerFromOIDCProviderARN(arn string) (string, error) {
+	segments := strings.SplitN(arn, ":oidc-provider/", 2)
+	if len(segments) != 2 || segments[1] == "" {
+		return "", fmt.Errorf("expected OIDC provider ARN to be in the format `arn:aws:iam::{account}:oidc-provider/{issuer}` but got %q", arn)
+	}
+	return segments[1], nil
+}
@@ -0,0 +1,150 @@
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iam"
+	"github.com/aws/aws-sdk-go-v2/service/iam/types"
+)
+
+// workloadServicePrincipals maps the AWS workload presets to the AWS service allowed to assume the role.
+// The kubernetes preset is served by the kubernetes and pod identity configuration instead.
+var workloadServicePrincipals = map[string]string{
+	"lambda":   "lambda.amazonaws.com",
+	"ecs_task": "ecs-tasks.amazonaws.com",
+	"ec2":      "ec2.amazonaws.com",
+}
+
+func workloadTrustStatement(config *ApplicationIdentityConfig) (*trustPolicyStatement, error) {
+	if config.Workload == "" {
+		return nil, nil
+	}
+	if config.Workload == "kubernetes" {
+		if len(config.KubernetesSubjects) == 0 && config.PodIdentityClusterName == "" {
+			return nil, fmt.Errorf("workload kubernetes requires kubernetes or pod_identity to be configured")
+		}
+		return nil, nil
+	}
+
+	service, ok := workloadServicePrincipals[config.Workload]
+	if !ok {
+		return nil, fmt.Errorf("workload %s is not supported on AWS", config.Workload)
+	}
+	return &trustPolicyStatement{
+		Effect: "Allow",
+		Principal: map[string]string{
+			"Service": service,
+		},
+		Action: "sts:AssumeRole",
+	}, nil
+}
+
+// workloadFromTrustPolicy finds the statement of a workload preset, which buildAssumeRolePolicy puts after the
+// Kubernetes ones, and returns the preset and the policy without it
+func workloadFromTrustPolicy(policy string) (string, string) {
+	document, statements, err := parsePolicyStatements(policy)
+	if err != nil || len(statements) == 0 {
+		return "", policy
+	}
+	var statement trustPolicyStatement
+	if err := json.Unmarshal(statements[len(statements)-1], &statement); err != nil {
+		return "", policy
+	}
+	for workload := range workloadServicePrincipals {
+		expected, _ := workloadTrustStatement(&ApplicationIdentityConfig{Workload: workload})
+		if !reflect.DeepEqual(statement, *expected) {
+			continue
+		}
+		rest, err := marshalPolicyStatements(document, statements[:len(statements)-1])
+		if err != nil {
+			return "", policy
+		}
+		return workload, rest
+	}
+	return "", policy
+}
+
+func validateInstanceProfile(config *ApplicationIdentityConfig) error {
+	if config.CreateInstanceProfile && config.Workload != "ec2" {
+		return fmt.Errorf("create_instance_profile requires workload ec2, got %q", config.Workload)
+	}
+	return nil
+}
+
+// createInstanceProfile creates an instance profile named after the role, so EC2 instances can use it
+func createInstanceProfile(ctx context.Context, config *ApplicationIdentityConfig, client IAMClient) error {
+	input := iam.CreateInstanceProfileInput{
+		InstanceProfileName: aws.String(config.Name),
+	}
+	if config.Path != "" {
+		input.Path = aws.String(config.Path)
+	}
+
+	output, err := client.CreateInstanceProfile(ctx, &input)
+	if err != nil {
+		return fmt.Errorf("creating instance profile %s: %w", config.Name, err)
+	}
+	config.InstanceProfileARN = aws.ToString(output.InstanceProfile.Arn)
+
+	_, err = client.AddRoleToInstanceProfile(ctx, &iam.AddRoleToInstanceProfileInput{
+		InstanceProfileName: aws.String(config.Name),
+		RoleName:            aws.String(config.Name),
+	})
+	if err != nil {
+		return fmt.Errorf("adding role %s to instance profile: %w", config.Name, err)
+	}
+	return nil
+}
+
+// readInstanceProfile clears the instance profile fields when it no longer exists or no longer holds the role,
+// so the next plan recreates it
+func readInstanceProfile(ctx context.Context, config *ApplicationIdentityConfig, client IAMClient) error {
+	output, err := client.GetInstanceProfile(ctx, &iam.GetInstanceProfileInput{
+		InstanceProfileName: aws.String(config.Name),
+	})
+	if err != nil {
+		var notFound *types.NoSuchEntityException
+		if errors.As(err, &notFound) {
+			config.CreateInstanceProfile = false
+			config.InstanceProfileARN = ""
+			return nil
+		}
+		return err
+	}
+
+	for _, role := range output.InstanceProfile.Roles {
+		if aws.ToString(role.RoleName) == config.Name {
+			config.InstanceProfileARN = aws.ToString(output.InstanceProfile.Arn)
+			return nil
+		}
+	}
+	config.CreateInstanceProfile = false
+	config.InstanceProfileARN = ""
+	return nil
+}
+
+func deleteInstanceProfile(ctx context.Context, config *ApplicationIdentityConfig, client IAMClient) error {
+	_, err := client.RemoveRoleFromInstanceProfile(ctx, &iam.RemoveRoleFromInstanceProfileInput{
+		InstanceProfileName: aws.String(config.Name),
+		RoleName:            aws.String(config.Name),
+	})
+	var notFound *types.NoSuchEntityException
+	if err != nil && !errors.As(err, &notFound) {
+		return fmt.Errorf("removing role %s from instance profile: %w", config.Name, err)
+	}
+
+	_, err = client.DeleteInstanceProfile(ctx, &iam.DeleteInstanceProfileInput{
+		InstanceProfileName: aws.String(config.Name),
+	})
+	if err != nil && !errors.As(err, &notFound) {
+		return fmt.Errorf("deleting instance profile %s: %w", config.Name, err)
+	}
+
+	config.InstanceProfileARN = ""
+	return nil
+}
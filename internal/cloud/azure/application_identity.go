@@ -2,9 +2,14 @@ package azure
 
 import (
 	"context"
+	"crypto/sha256"
 	"fmt"
+	"reflect"
+	"regexp"
 	"strings"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/msi/armmsi"
@@ -18,23 +23,45 @@ type ManagedIdentityClient interface {
 
 type FederatedIdentityCredentialClient interface {
 	CreateOrUpdate(ctx context.Context, resourceGroupName string, resourceName string, federatedIdentityCredentialResourceName string, parameters armmsi.FederatedIdentityCredential, options *armmsi.FederatedIdentityCredentialsClientCreateOrUpdateOptions) (armmsi.FederatedIdentityCredentialsClientCreateOrUpdateResponse, error)
+	Get(ctx context.Context, resourceGroupName string, resourceName string, federatedIdentityCredentialResourceName string, options *armmsi.FederatedIdentityCredentialsClientGetOptions) (armmsi.FederatedIdentityCredentialsClientGetResponse, error)
+	NewListPager(resourceGroupName string, resourceName string, options *armmsi.FederatedIdentityCredentialsClientListOptions) *runtime.Pager[armmsi.FederatedIdentityCredentialsClientListResponse]
+	Delete(ctx context.Context, resourceGroupName string, resourceName string, federatedIdentityCredentialResourceName string, options *armmsi.FederatedIdentityCredentialsClientDeleteOptions) (armmsi.FederatedIdentityCredentialsClientDeleteResponse, error)
 }
 
 type ApplicationIdentityConfig struct {
 	// READ-ONLY; Fully qualified resource ID for the resource.
 	// /subscriptions/{subscriptionId}/resourceGroups/{resourceGroupName}/providers/{resourceProviderNamespace}/{resourceType}/{resourceName}
-	ID                           string
-	Name                         string
-	Location                     string
-	ResourceGroupName            string
-	KubernetesNamespace          string
-	KubernetesServiceAccountName string
-	KubernetesOIDCURL            string
-	ClientID                     string
-	TenantID                     string
-	ResourceID                   string
+	ID                 string
+	Name               string
+	Location           string
+	ResourceGroupName  string
+	KubernetesSubjects []KubernetesSubject
+	// the Kubernetes service accounts trusted before an update
+	PreviousKubernetesSubjects []KubernetesSubject
+	OIDCFederation             *OIDCFederation
+	// the OIDC federation before an update
+	PreviousOIDCFederation *OIDCFederation
+	// cloud-agnostic workload preset, recorded as a tag
+	Workload string
+	// the workload preset before an update
+	PreviousWorkload     string
+	ClientID             string
+	TenantID             string
+	ResourceID           string
+	ForceDetachOnDestroy bool
+	DetachedDependencies []string
 }
 
+type KubernetesSubject struct {
+	Namespace          string
+	ServiceAccountName string
+	OIDCIssuerURL      string
+	// defaults to api://AzureADTokenExchange when empty
+	Audiences []string
+}
+
+const defaultFederatedIdentityCredentialAudience = "api://AzureADTokenExchange"
+
 func newManagedIdentityClientFactory(ctx context.Context, config *AzureProviderConfig) (ManagedIdentityClient, error) {
 	cred, err := azidentity.NewClientSecretCredential(config.TenantID.Value, config.ClientID.Value, config.ClientSecret.Value, nil)
 	if err != nil {
@@ -63,15 +90,17 @@ func newFederatedIdentityCredentialClientFactory(ctx context.Context, config *Az
 	return client, nil
 }
 
-func CreateApplicationIdentity(ctx context.Context, config *ApplicationIdentityConfig, client ManagedIdentityClient, fedClient FederatedIdentityCredentialClient) error {
+func CreateApplicationIdentity(ctx context.Context, config *ApplicationIdentityConfig, client ManagedIdentityClient, fedClient FederatedIdentityCredentialClient, raClient RoleAssignmentsClient) error {
+	if errWorkload := validateWorkload(config); errWorkload != nil {
+		return errWorkload
+	}
+
 	identity, errCreate := client.CreateOrUpdate(ctx,
 		config.ResourceGroupName,
 		config.Name,
 		armmsi.Identity{
 			Location: &config.Location,
-			Tags: map[string]*string{
-				"managed-by": to.Ptr("massdriver"),
-			},
+			Tags:     identityTags(config),
 		},
 		nil,
 	)
@@ -87,18 +116,19 @@ func CreateApplicationIdentity(ctx context.Context, config *ApplicationIdentityC
 	config.TenantID = *identity.Properties.TenantID
 	config.ResourceID = id
 
-	// TODO: this is a weak check, we can do better!
-	if config.KubernetesNamespace != "" {
-		if errAddRole := addWorkloadIdentityRole(ctx, config, fedClient); errAddRole != nil {
-			return errAddRole
-		}
+	if errCredentials := updateWorkloadIdentityCredentials(ctx, config, nil, config.KubernetesSubjects, fedClient); errCredentials != nil {
+		return errCredentials
 	}
-	return nil
+
+	return updateOIDCFederationCredential(ctx, config, nil, config.OIDCFederation, fedClient)
 }
 
-func ReadApplicationIdentity(ctx context.Context, config *ApplicationIdentityConfig, client ManagedIdentityClient, fedClient FederatedIdentityCredentialClient) error {
+func ReadApplicationIdentity(ctx context.Context, config *ApplicationIdentityConfig, client ManagedIdentityClient, fedClient FederatedIdentityCredentialClient, raClient RoleAssignmentsClient) error {
 	identity, err := client.Get(ctx, config.ResourceGroupName, config.Name, nil)
 	if err != nil {
+		if errorWasNotFound(err) {
+			return &NotFoundError{Resource: fmt.Sprintf("managed identity %s", config.Name), Err: err}
+		}
 		return err
 	}
 
@@ -107,15 +137,82 @@ func ReadApplicationIdentity(ctx context.Context, config *ApplicationIdentityCon
 	config.ClientID = *identity.Properties.ClientID
 	config.TenantID = *identity.Properties.TenantID
 	config.ResourceID = id
+	if config.Workload != "" {
+		config.Workload = stringValue(identity.Tags[workloadTag])
+	}
 
-	return nil
+	if errCredentials := readWorkloadIdentityCredentials(ctx, config, fedClient); errCredentials != nil {
+		return errCredentials
+	}
+
+	return readOIDCFederationCredential(ctx, config, fedClient)
 }
 
-func UpdateApplicationIdentity(ctx context.Context, config *ApplicationIdentityConfig, client ManagedIdentityClient, fedClient FederatedIdentityCredentialClient) error {
-	return nil
+// ImportApplicationIdentity adopts an existing user-assigned identity, identified by config.ID as its resource ID.
+// The Kubernetes service accounts and the OIDC federation are read back from the federated identity credentials
+// named like this resource names them, and the workload from its tag.
+func ImportApplicationIdentity(ctx context.Context, config *ApplicationIdentityConfig, client ManagedIdentityClient, fedClient FederatedIdentityCredentialClient, raClient RoleAssignmentsClient) error {
+	id, err := arm.ParseResourceID(config.ID)
+	if err != nil {
+		return fmt.Errorf("parsing user-assigned identity resource ID %q: %w", config.ID, err)
+	}
+	if !strings.EqualFold(id.ResourceType.String(), "Microsoft.ManagedIdentity/userAssignedIdentities") {
+		return fmt.Errorf("expected import ID to be a Microsoft.ManagedIdentity/userAssignedIdentities resource ID but got %q", config.ID)
+	}
+	config.ResourceGroupName = id.ResourceGroupName
+	config.Name = id.Name
+
+	identity, err := client.Get(ctx, config.ResourceGroupName, config.Name, nil)
+	if err != nil {
+		if errorWasNotFound(err) {
+			return &NotFoundError{Resource: fmt.Sprintf("managed identity %s", config.Name), Err: err}
+		}
+		return err
+	}
+	config.Location = stringValue(identity.Location)
+	config.Workload = stringValue(identity.Tags[workloadTag])
+
+	if errCredentials := importFederatedIdentityCredentials(ctx, config, fedClient); errCredentials != nil {
+		return errCredentials
+	}
+
+	return ReadApplicationIdentity(ctx, config, client, fedClient, raClient)
 }
 
-func DeleteApplicationIdentity(ctx context.Context, config *ApplicationIdentityConfig, client ManagedIdentityClient, fedClient FederatedIdentityCredentialClient) error {
+func UpdateApplicationIdentity(ctx context.Context, config *ApplicationIdentityConfig, client ManagedIdentityClient, fedClient FederatedIdentityCredentialClient, raClient RoleAssignmentsClient) error {
+	if errWorkload := updateWorkload(ctx, config, client); errWorkload != nil {
+		return errWorkload
+	}
+
+	if errLegacy := deleteLegacyWorkloadIdentityCredential(ctx, config, fedClient); errLegacy != nil {
+		return errLegacy
+	}
+	if errCredentials := updateWorkloadIdentityCredentials(ctx, config, config.PreviousKubernetesSubjects, config.KubernetesSubjects, fedClient); errCredentials != nil {
+		return errCredentials
+	}
+
+	return updateOIDCFederationCredential(ctx, config, config.PreviousOIDCFederation, config.OIDCFederation, fedClient)
+}
+
+// DeleteApplicationIdentity deletes the managed identity. raClient is only used, and only
+// required, when ForceDetachOnDestroy is set.
+func DeleteApplicationIdentity(ctx context.Context, config *ApplicationIdentityConfig, client ManagedIdentityClient, fedClient FederatedIdentityCredentialClient, raClient RoleAssignmentsClient) error {
+	if config.ForceDetachOnDestroy {
+		if errDetach := detachIdentityDependencies(ctx, config, fedClient, raClient); errDetach != nil {
+			return errDetach
+		}
+	}
+
+	if errLegacy := deleteLegacyWorkloadIdentityCredential(ctx, config, fedClient); errLegacy != nil {
+		return errLegacy
+	}
+	if errCredentials := updateWorkloadIdentityCredentials(ctx, config, config.KubernetesSubjects, nil, fedClient); errCredentials != nil {
+		return errCredentials
+	}
+	if errCredential := updateOIDCFederationCredential(ctx, config, config.OIDCFederation, nil, fedClient); errCredential != nil {
+		return errCredential
+	}
+
 	_, err := client.Delete(ctx, config.ResourceGroupName, config.Name, nil)
 	if err != nil {
 		return err
@@ -126,22 +223,253 @@ func DeleteApplicationIdentity(ctx context.Context, config *ApplicationIdentityC
 	return nil
 }
 
-func addWorkloadIdentityRole(ctx context.Context, config *ApplicationIdentityConfig, client FederatedIdentityCredentialClient) error {
+// detachIdentityDependencies removes the identity's federated credentials and every role assignment
+// granted to its principal in the subscription. Azure leaves orphaned role assignments behind otherwise.
+func detachIdentityDependencies(ctx context.Context, config *ApplicationIdentityConfig, fedClient FederatedIdentityCredentialClient, raClient RoleAssignmentsClient) error {
+	credentialNames := []string{}
+	pager := fedClient.NewListPager(config.ResourceGroupName, config.Name, nil)
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("listing federated identity credentials of %s: %w", config.Name, err)
+		}
+		for _, credential := range page.Value {
+			credentialNames = append(credentialNames, *credential.Name)
+		}
+	}
+	for _, credentialName := range credentialNames {
+		if _, err := fedClient.Delete(ctx, config.ResourceGroupName, config.Name, credentialName, nil); err != nil {
+			return fmt.Errorf("deleting federated identity credential %s: %w", credentialName, err)
+		}
+		config.DetachedDependencies = append(config.DetachedDependencies, fmt.Sprintf("federated identity credential %s", credentialName))
+	}
+
+	assignmentIDs := []string{}
+	page, err := raClient.List(ctx, fmt.Sprintf("principalId eq '%s'", config.ID), "")
+	for ; err == nil && page.NotDone(); err = page.NextWithContext(ctx) {
+		for _, assignment := range page.Values() {
+			assignmentIDs = append(assignmentIDs, *assignment.ID)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("listing role assignments of principal %s: %w", config.ID, err)
+	}
+	for _, assignmentID := range assignmentIDs {
+		id, errParse := parseRoleAssignmentId(assignmentID)
+		if errParse != nil {
+			return errParse
+		}
+		if _, errDelete := raClient.Delete(ctx, id.scope, id.name, ""); errDelete != nil {
+			return fmt.Errorf("deleting role assignment %s: %w", assignmentID, errDelete)
+		}
+		config.DetachedDependencies = append(config.DetachedDependencies, fmt.Sprintf("role assignment %s", assignmentID))
+	}
+
+	return nil
+}
+
+// federatedIdentityCredentialName names the credential of a Kubernetes service account. Kubernetes names can't contain
+// underscores, so namespace and service account name can't run into each other, and the issuer hash keeps the same
+// service account in several clusters apart.
+func federatedIdentityCredentialName(subject KubernetesSubject) string {
+	issuerHash := sha256.Sum256([]byte(subject.OIDCIssuerURL))
+	prefix := fmt.Sprintf("%s_%s", subject.Namespace, subject.ServiceAccountName)
+	name := fmt.Sprintf("%s_%x", prefix, issuerHash[:4])
+	sanitized := invalidCredentialNameCharacters.ReplaceAllString(prefix, "-")
+	if sanitized == prefix && len(name) <= maxCredentialNameLength {
+		return name
+	}
+
+	// service account names may contain dots, and may be too long: hash the whole subject so that names that only
+	// differ in what's replaced or cut off stay apart. Namespaces start with a letter or digit, as Azure requires.
+	subjectHash := sha256.Sum256([]byte(strings.Join([]string{subject.OIDCIssuerURL, subject.Namespace, subject.ServiceAccountName}, "\x00")))
+	suffix := fmt.Sprintf("_%x", subjectHash[:4])
+	if len(sanitized) > maxCredentialNameLength-len(suffix) {
+		sanitized = sanitized[:maxCredentialNameLength-len(suffix)]
+	}
+	return sanitized + suffix
+}
+
+// federated identity credential names must match ^[A-Za-z0-9][A-Za-z0-9_-]{2,119}$
+const maxCredentialNameLength = 120
+
+var invalidCredentialNameCharacters = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// deleteLegacyWorkloadIdentityCredential deletes the credential named like the identity itself, which trusted its
+// only Kubernetes service account before credentials were named per service account. Read drops that service
+// account from the state, so the update that recreates its credential under the new name removes the old one first.
+func deleteLegacyWorkloadIdentityCredential(ctx context.Context, config *ApplicationIdentityConfig, client FederatedIdentityCredentialClient) error {
+	credential, err := client.Get(ctx, config.ResourceGroupName, config.Name, config.Name, nil)
+	if err != nil {
+		if errorWasNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("reading federated identity credential %s: %w", config.Name, err)
+	}
+	// only a Kubernetes credential, the identity might just share its name with another credential
+	if credential.Properties == nil {
+		return nil
+	}
+	if _, _, ok := parseServiceAccountSubject(stringValue(credential.Properties.Subject)); !ok {
+		return nil
+	}
+
+	_, err = client.Delete(ctx, config.ResourceGroupName, config.Name, config.Name, nil)
+	if err != nil && !errorWasNotFound(err) {
+		return fmt.Errorf("deleting federated identity credential %s: %w", config.Name, err)
+	}
+	return nil
+}
+
+// updateWorkloadIdentityCredentials creates or updates in place the federated identity credential of every current
+// Kubernetes service account that changed, and deletes the credentials of previous ones no longer configured.
+func updateWorkloadIdentityCredentials(ctx context.Context, config *ApplicationIdentityConfig, previous []KubernetesSubject, current []KubernetesSubject, client FederatedIdentityCredentialClient) error {
+	previousByName := map[string]KubernetesSubject{}
+	for _, subject := range previous {
+		previousByName[federatedIdentityCredentialName(subject)] = subject
+	}
+	currentNames := map[string]bool{}
+
+	for _, subject := range current {
+		credentialName := federatedIdentityCredentialName(subject)
+		currentNames[credentialName] = true
+		if previousSubject, ok := previousByName[credentialName]; ok && reflect.DeepEqual(previousSubject, subject) {
+			continue
+		}
+		if err := addWorkloadIdentityRole(ctx, config, subject, client); err != nil {
+			return err
+		}
+	}
+	for credentialName := range previousByName {
+		if currentNames[credentialName] {
+			continue
+		}
+		_, err := client.Delete(ctx, config.ResourceGroupName, config.Name, credentialName, nil)
+		if err != nil && !errorWasNotFound(err) {
+			return fmt.Errorf("deleting federated identity credential %s: %w", credentialName, err)
+		}
+	}
+
+	return nil
+}
+
+// readWorkloadIdentityCredentials refreshes the Kubernetes service accounts from their federated identity credentials,
+// dropping those whose credential was deleted outside of Terraform
+func readWorkloadIdentityCredentials(ctx context.Context, config *ApplicationIdentityConfig, client FederatedIdentityCredentialClient) error {
+	subjects := make([]KubernetesSubject, 0, len(config.KubernetesSubjects))
+	for _, subject := range config.KubernetesSubjects {
+		credentialName := federatedIdentityCredentialName(subject)
+		credential, err := client.Get(ctx, config.ResourceGroupName, config.Name, credentialName, nil)
+		if err != nil {
+			if errorWasNotFound(err) {
+				continue
+			}
+			return fmt.Errorf("reading federated identity credential %s: %w", credentialName, err)
+		}
+		if credential.Properties == nil {
+			continue
+		}
+
+		read := KubernetesSubject{
+			Namespace:          subject.Namespace,
+			ServiceAccountName: subject.ServiceAccountName,
+			OIDCIssuerURL:      stringValue(credential.Properties.Issuer),
+		}
+		// a subject that isn't a Kubernetes service account shows up as a namespace diff
+		namespace, serviceAccountName, ok := parseServiceAccountSubject(stringValue(credential.Properties.Subject))
+		if ok {
+			read.Namespace = namespace
+			read.ServiceAccountName = serviceAccountName
+		} else {
+			read.Namespace = stringValue(credential.Properties.Subject)
+		}
+		for _, audience := range credential.Properties.Audiences {
+			read.Audiences = append(read.Audiences, stringValue(audience))
+		}
+		if len(subject.Audiences) == 0 && len(read.Audiences) == 1 && read.Audiences[0] == defaultFederatedIdentityCredentialAudience {
+			read.Audiences = nil
+		}
+		subjects = append(subjects, read)
+	}
+	config.KubernetesSubjects = subjects
+
+	return nil
+}
+
+// importFederatedIdentityCredentials finds the Kubernetes service accounts and the OIDC federation among the
+// federated identity credentials. Credentials of identity federations and ones created outside of Terraform are skipped.
+func importFederatedIdentityCredentials(ctx context.Context, config *ApplicationIdentityConfig, client FederatedIdentityCredentialClient) error {
+	config.KubernetesSubjects = nil
+	config.OIDCFederation = nil
+
+	pager := client.NewListPager(config.ResourceGroupName, config.Name, nil)
+	for pager.More() {
+		page, err := pager.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("listing federated identity credentials of %s: %w", config.Name, err)
+		}
+		for _, credential := range page.Value {
+			credentialName := stringValue(credential.Name)
+			if credentialName == oidcFederationCredentialName {
+				// filled in by readOIDCFederationCredential
+				config.OIDCFederation = &OIDCFederation{}
+				continue
+			}
+			if credential.Properties == nil {
+				continue
+			}
+			namespace, serviceAccountName, ok := parseServiceAccountSubject(stringValue(credential.Properties.Subject))
+			if !ok {
+				continue
+			}
+			subject := KubernetesSubject{
+				Namespace:          namespace,
+				ServiceAccountName: serviceAccountName,
+				OIDCIssuerURL:      stringValue(credential.Properties.Issuer),
+			}
+			if federatedIdentityCredentialName(subject) != credentialName {
+				continue
+			}
+			for _, audience := range credential.Properties.Audiences {
+				subject.Audiences = append(subject.Audiences, stringValue(audience))
+			}
+			if len(subject.Audiences) == 1 && subject.Audiences[0] == defaultFederatedIdentityCredentialAudience {
+				subject.Audiences = nil
+			}
+			config.KubernetesSubjects = append(config.KubernetesSubjects, subject)
+		}
+	}
+	return nil
+}
+
+func serviceAccountSubject(namespace string, serviceAccountName string) string {
+	return fmt.Sprintf("system:serviceaccount:%s:%s", namespace, serviceAccountName)
+}
+
+func parseServiceAccountSubject(subject string) (string, string, bool) {
+	parts := strings.Split(subject, ":")
+	if len(parts) != 4 || parts[0] != "system" || parts[1] != "serviceaccount" {
+		return "", "", false
+	}
+	return parts[2], parts[3], true
+}
+
+func addWorkloadIdentityRole(ctx context.Context, config *ApplicationIdentityConfig, subject KubernetesSubject, client FederatedIdentityCredentialClient) error {
+	audiences := subject.Audiences
+	if len(audiences) == 0 {
+		audiences = []string{defaultFederatedIdentityCredentialAudience}
+	}
+
 	_, err := client.CreateOrUpdate(ctx,
 		config.ResourceGroupName,
 		config.Name,
-		// This is the Name of the Federated Identity Credential,
-		// we can use the same name as the resource group, they are guranteed
-		/// to be unique to this application
-		config.Name,
+		federatedIdentityCredentialName(subject),
 		armmsi.FederatedIdentityCredential{
 			Properties: &armmsi.FederatedIdentityCredentialProperties{
-				Audiences: []*string{
-					to.Ptr("api://AzureADTokenExchange"),
-				},
-				Issuer: &config.KubernetesOIDCURL,
+				Audiences: to.SliceOfPtrs(audiences...),
+				Issuer:    to.Ptr(subject.OIDCIssuerURL),
 				// k8s service account
-				Subject: to.Ptr(fmt.Sprintf("system:serviceaccount:%s:%s", config.KubernetesNamespace, config.Name)),
+				Subject: to.Ptr(serviceAccountSubject(subject.Namespace, subject.ServiceAccountName)),
 			},
 		},
 		nil)
@@ -0,0 +1,402 @@
+package azure_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"terraform-provider-mdxc/internal/cloud/azure"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/msi/armmsi"
+)
+
+const identityResourceID = "/subscriptions/00000000-0000-0000-0000-000000000000/resourcegroups/test-rg/providers/Microsoft.ManagedIdentity/userAssignedIdentities/test-name"
+
+func notFound() error {
+	return runtime.NewResponseError(&http.Response{
+		StatusCode: http.StatusNotFound,
+		Status:     "404 Not Found",
+		Body:       io.NopCloser(strings.NewReader("")),
+		Request:    httptest.NewRequest(http.MethodGet, "https://management.azure.com"+identityResourceID, nil),
+	})
+}
+
+type mockManagedIdentityClient struct {
+	identity *armmsi.Identity
+	deleted  bool
+}
+
+func (m *mockManagedIdentityClient) CreateOrUpdate(ctx context.Context, resourceGroupName string, resourceName string, parameters armmsi.Identity, options *armmsi.UserAssignedIdentitiesClientCreateOrUpdateOptions) (armmsi.UserAssignedIdentitiesClientCreateOrUpdateResponse, error) {
+	parameters.ID = to.Ptr(identityResourceID)
+	parameters.Name = to.Ptr(resourceName)
+	parameters.Properties = &armmsi.UserAssignedIdentityProperties{
+		PrincipalID: to.Ptr("principal-id"),
+		ClientID:    to.Ptr("client-id"),
+		TenantID:    to.Ptr("tenant-id"),
+	}
+	m.identity = &parameters
+	return armmsi.UserAssignedIdentitiesClientCreateOrUpdateResponse{Identity: parameters}, nil
+}
+
+func (m *mockManagedIdentityClient) Get(ctx context.Context, resourceGroupName string, resourceName string, options *armmsi.UserAssignedIdentitiesClientGetOptions) (armmsi.UserAssignedIdentitiesClientGetResponse, error) {
+	if m.identity == nil || m.deleted {
+		return armmsi.UserAssignedIdentitiesClientGetResponse{}, notFound()
+	}
+	return armmsi.UserAssignedIdentitiesClientGetResponse{Identity: *m.identity}, nil
+}
+
+func (m *mockManagedIdentityClient) Delete(ctx context.Context, resourceGroupName string, resourceName string, options *armmsi.UserAssignedIdentitiesClientDeleteOptions) (armmsi.UserAssignedIdentitiesClientDeleteResponse, error) {
+	m.deleted = true
+	return armmsi.UserAssignedIdentitiesClientDeleteResponse{}, nil
+}
+
+// mockFederatedIdentityCredentialClient keeps the credentials by name, and records every write
+type mockFederatedIdentityCredentialClient struct {
+	credentials map[string]armmsi.FederatedIdentityCredential
+	writes      []string
+}
+
+func (m *mockFederatedIdentityCredentialClient) CreateOrUpdate(ctx context.Context, resourceGroupName string, resourceName string, federatedIdentityCredentialResourceName string, parameters armmsi.FederatedIdentityCredential, options *armmsi.FederatedIdentityCredentialsClientCreateOrUpdateOptions) (armmsi.FederatedIdentityCredentialsClientCreateOrUpdateResponse, error) {
+	if m.credentials == nil {
+		m.credentials = map[string]armmsi.FederatedIdentityCredential{}
+	}
+	parameters.ID = to.Ptr(fmt.Sprintf("%s/federatedIdentityCredentials/%s", identityResourceID, federatedIdentityCredentialResourceName))
+	parameters.Name = to.Ptr(federatedIdentityCredentialResourceName)
+	m.credentials[federatedIdentityCredentialResourceName] = parameters
+	m.writes = append(m.writes, federatedIdentityCredentialResourceName)
+	return armmsi.FederatedIdentityCredentialsClientCreateOrUpdateResponse{FederatedIdentityCredential: parameters}, nil
+}
+
+func (m *mockFederatedIdentityCredentialClient) Get(ctx context.Context, resourceGroupName string, resourceName string, federatedIdentityCredentialResourceName string, options *armmsi.FederatedIdentityCredentialsClientGetOptions) (armmsi.FederatedIdentityCredentialsClientGetResponse, error) {
+	credential, ok := m.credentials[federatedIdentityCredentialResourceName]
+	if !ok {
+		return armmsi.FederatedIdentityCredentialsClientGetResponse{}, notFound()
+	}
+	return armmsi.FederatedIdentityCredentialsClientGetResponse{FederatedIdentityCredential: credential}, nil
+}
+
+func (m *mockFederatedIdentityCredentialClient) NewListPager(resourceGroupName string, resourceName string, options *armmsi.FederatedIdentityCredentialsClientListOptions) *runtime.Pager[armmsi.FederatedIdentityCredentialsClientListResponse] {
+	return runtime.NewPager(runtime.PagingHandler[armmsi.FederatedIdentityCredentialsClientListResponse]{
+		More: func(page armmsi.FederatedIdentityCredentialsClientListResponse) bool {
+			return false
+		},
+		Fetcher: func(ctx context.Context, page *armmsi.FederatedIdentityCredentialsClientListResponse) (armmsi.FederatedIdentityCredentialsClientListResponse, error) {
+			names := make([]string, 0, len(m.credentials))
+			for name := range m.credentials {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			result := armmsi.FederatedIdentityCredentialsClientListResponse{}
+			for _, name := range names {
+				credential := m.credentials[name]
+				result.Value = append(result.Value, &credential)
+			}
+			return result, nil
+		},
+	})
+}
+
+func (m *mockFederatedIdentityCredentialClient) Delete(ctx context.Context, resourceGroupName string, resourceName string, federatedIdentityCredentialResourceName string, options *armmsi.FederatedIdentityCredentialsClientDeleteOptions) (armmsi.FederatedIdentityCredentialsClientDeleteResponse, error) {
+	if _, ok := m.credentials[federatedIdentityCredentialResourceName]; !ok {
+		return armmsi.FederatedIdentityCredentialsClientDeleteResponse{}, notFound()
+	}
+	delete(m.credentials, federatedIdentityCredentialResourceName)
+	return armmsi.FederatedIdentityCredentialsClientDeleteResponse{}, nil
+}
+
+// subjects lists the sub claims the credentials trust
+func (m *mockFederatedIdentityCredentialClient) subjects() string {
+	subjects := []string{}
+	for _, credential := range m.credentials {
+		subjects = append(subjects, *credential.Properties.Subject)
+	}
+	sort.Strings(subjects)
+	return strings.Join(subjects, ",")
+}
+
+func (m *mockFederatedIdentityCredentialClient) credentialOf(subject string) (string, armmsi.FederatedIdentityCredential) {
+	for name, credential := range m.credentials {
+		if *credential.Properties.Subject == subject {
+			return name, credential
+		}
+	}
+	return "", armmsi.FederatedIdentityCredential{}
+}
+
+var (
+	apiSubject = azure.KubernetesSubject{
+		Namespace:          "default",
+		ServiceAccountName: "api",
+		OIDCIssuerURL:      "https://oidc.example.com/cluster-a",
+	}
+	workerSubject = azure.KubernetesSubject{
+		Namespace:          "jobs",
+		ServiceAccountName: "worker",
+		OIDCIssuerURL:      "https://oidc.example.com/cluster-a",
+		Audiences:          []string{"api://worker"},
+	}
+)
+
+func createIdentity(t *testing.T, subjects ...azure.KubernetesSubject) (*azure.ApplicationIdentityConfig, *mockManagedIdentityClient, *mockFederatedIdentityCredentialClient) {
+	client := &mockManagedIdentityClient{}
+	fedClient := &mockFederatedIdentityCredentialClient{}
+	config := &azure.ApplicationIdentityConfig{
+		Name:               "test-name",
+		Location:           "eastus",
+		ResourceGroupName:  "test-rg",
+		KubernetesSubjects: subjects,
+	}
+
+	if err := azure.CreateApplicationIdentity(context.Background(), config, client, fedClient, nil); err != nil {
+		t.Fatal(err)
+	}
+	return config, client, fedClient
+}
+
+func TestCreateIdentityKubernetes(t *testing.T) {
+	config, _, fedClient := createIdentity(t, apiSubject, workerSubject)
+
+	compare(t, config.ResourceID, strings.Replace(identityResourceID, "resourcegroups", "resourceGroups", 1))
+	compare(t, fedClient.subjects(), "system:serviceaccount:default:api,system:serviceaccount:jobs:worker")
+
+	_, credential := fedClient.credentialOf("system:serviceaccount:default:api")
+	compare(t, *credential.Properties.Issuer, "https://oidc.example.com/cluster-a")
+	compare(t, *credential.Properties.Audiences[0], "api://AzureADTokenExchange")
+}
+
+func TestCreateIdentityKubernetesCredentialNames(t *testing.T) {
+	long := strings.Repeat("a", 200)
+	subjects := []azure.KubernetesSubject{
+		{Namespace: "default", ServiceAccountName: "api.v1", OIDCIssuerURL: "https://oidc.example.com/cluster-a"},
+		{Namespace: "default", ServiceAccountName: "api-v1", OIDCIssuerURL: "https://oidc.example.com/cluster-a"},
+		{Namespace: "default", ServiceAccountName: long + "x", OIDCIssuerURL: "https://oidc.example.com/cluster-a"},
+		{Namespace: "default", ServiceAccountName: long + "y", OIDCIssuerURL: "https://oidc.example.com/cluster-a"},
+	}
+	_, _, fedClient := createIdentity(t, subjects...)
+
+	valid := regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{2,119}$`)
+	names := map[string]bool{}
+	for _, subject := range subjects {
+		name, _ := fedClient.credentialOf(fmt.Sprintf("system:serviceaccount:%s:%s", subject.Namespace, subject.ServiceAccountName))
+		if !valid.MatchString(name) {
+			t.Errorf("expect a valid credential name, got %v", name)
+		}
+		names[name] = true
+	}
+	compare(t, fmt.Sprint(len(names)), "4")
+
+	// names that are already valid keep the format of earlier releases
+	name, _ := fedClient.credentialOf("system:serviceaccount:default:api-v1")
+	issuerHash := sha256.Sum256([]byte("https://oidc.example.com/cluster-a"))
+	compare(t, name, fmt.Sprintf("default_api-v1_%x", issuerHash[:4]))
+}
+
+func TestReadIdentityKubernetes(t *testing.T) {
+	ctx := context.Background()
+	config, client, fedClient := createIdentity(t, apiSubject, workerSubject)
+
+	// deleted outside of Terraform
+	name, _ := fedClient.credentialOf("system:serviceaccount:jobs:worker")
+	delete(fedClient.credentials, name)
+
+	if err := azure.ReadApplicationIdentity(ctx, config, client, fedClient, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(config.KubernetesSubjects) != 1 {
+		t.Fatalf("expect 1 kubernetes subject, got %d", len(config.KubernetesSubjects))
+	}
+	compare(t, config.KubernetesSubjects[0].ServiceAccountName, "api")
+	compare(t, config.KubernetesSubjects[0].OIDCIssuerURL, "https://oidc.example.com/cluster-a")
+	// the default audience isn't written back
+	if config.KubernetesSubjects[0].Audiences != nil {
+		t.Errorf("expect no audiences, got %v", config.KubernetesSubjects[0].Audiences)
+	}
+}
+
+func TestReadIdentityNotFound(t *testing.T) {
+	config, client, fedClient := createIdentity(t)
+	client.deleted = true
+
+	err := azure.ReadApplicationIdentity(context.Background(), config, client, fedClient, nil)
+	var notFoundErr *azure.NotFoundError
+	if !errors.As(err, &notFoundErr) {
+		t.Fatalf("expected a not found error, got %v", err)
+	}
+}
+
+func TestImportIdentity(t *testing.T) {
+	ctx := context.Background()
+	_, client, fedClient := createIdentity(t, apiSubject, workerSubject)
+	// neither named like a Kubernetes credential of this resource
+	fedClient.CreateOrUpdate(ctx, "test-rg", "test-name", "created-elsewhere", armmsi.FederatedIdentityCredential{
+		Properties: &armmsi.FederatedIdentityCredentialProperties{
+			Issuer:  to.Ptr("https://oidc.example.com/cluster-a"),
+			Subject: to.Ptr("system:serviceaccount:default:other"),
+		},
+	}, nil)
+	fedClient.CreateOrUpdate(ctx, "test-rg", "test-name", "federation-12345678", armmsi.FederatedIdentityCredential{
+		Properties: &armmsi.FederatedIdentityCredentialProperties{
+			Issuer:  to.Ptr("https://accounts.google.com"),
+			Subject: to.Ptr("123456789"),
+		},
+	}, nil)
+
+	config := &azure.ApplicationIdentityConfig{ID: identityResourceID}
+	if err := azure.ImportApplicationIdentity(ctx, config, client, fedClient, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	compare(t, config.Name, "test-name")
+	compare(t, config.ResourceGroupName, "test-rg")
+	compare(t, config.Location, "eastus")
+	if len(config.KubernetesSubjects) != 2 {
+		t.Fatalf("expect 2 kubernetes subjects, got %d", len(config.KubernetesSubjects))
+	}
+	serviceAccounts := []string{}
+	for _, subject := range config.KubernetesSubjects {
+		serviceAccounts = append(serviceAccounts, subject.ServiceAccountName)
+		if subject.ServiceAccountName == "worker" {
+			compare(t, strings.Join(subject.Audiences, ","), "api://worker")
+		}
+	}
+	sort.Strings(serviceAccounts)
+	compare(t, strings.Join(serviceAccounts, ","), "api,worker")
+	if config.OIDCFederation != nil {
+		t.Errorf("expect no OIDC federation, got %v", config.OIDCFederation)
+	}
+}
+
+func TestUpdateIdentityKubernetes(t *testing.T) {
+	ctx := context.Background()
+	config, client, fedClient := createIdentity(t, apiSubject, workerSubject)
+	apiCredentialName, _ := fedClient.credentialOf("system:serviceaccount:default:api")
+	fedClient.writes = nil
+
+	changedWorker := workerSubject
+	changedWorker.Audiences = []string{"api://worker", "api://worker-v2"}
+	cron := azure.KubernetesSubject{
+		Namespace:          "jobs",
+		ServiceAccountName: "cron",
+		OIDCIssuerURL:      "https://oidc.example.com/cluster-b",
+	}
+	config.PreviousKubernetesSubjects = config.KubernetesSubjects
+	config.KubernetesSubjects = []azure.KubernetesSubject{apiSubject, changedWorker, cron}
+
+	if err := azure.UpdateApplicationIdentity(ctx, config, client, fedClient, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the unchanged credential isn't rewritten, the changed one is updated in place
+	if len(fedClient.writes) != 2 {
+		t.Fatalf("expect 2 credential writes, got %d", len(fedClient.writes))
+	}
+	for _, name := range fedClient.writes {
+		if name == apiCredentialName {
+			t.Errorf("unchanged credential %s was rewritten", name)
+		}
+	}
+	compare(t, fedClient.subjects(), "system:serviceaccount:default:api,system:serviceaccount:jobs:cron,system:serviceaccount:jobs:worker")
+	_, credential := fedClient.credentialOf("system:serviceaccount:jobs:worker")
+	compare(t, *credential.Properties.Audiences[1], "api://worker-v2")
+
+	config.PreviousKubernetesSubjects = config.KubernetesSubjects
+	config.KubernetesSubjects = []azure.KubernetesSubject{cron}
+
+	if err := azure.UpdateApplicationIdentity(ctx, config, client, fedClient, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	compare(t, fedClient.subjects(), "system:serviceaccount:jobs:cron")
+}
+
+func TestUpdateIdentityLegacyCredential(t *testing.T) {
+	ctx := context.Background()
+	config, client, fedClient := createIdentity(t)
+	// the credential named like the identity, as created before credentials were named per service account
+	fedClient.CreateOrUpdate(ctx, "test-rg", "test-name", "test-name", armmsi.FederatedIdentityCredential{
+		Properties: &armmsi.FederatedIdentityCredentialProperties{
+			Audiences: []*string{to.Ptr("api://AzureADTokenExchange")},
+			Issuer:    to.Ptr(apiSubject.OIDCIssuerURL),
+			Subject:   to.Ptr("system:serviceaccount:default:api"),
+		},
+	}, nil)
+
+	// read doesn't find the service account under its current credential name
+	config.KubernetesSubjects = []azure.KubernetesSubject{apiSubject}
+	if err := azure.ReadApplicationIdentity(ctx, config, client, fedClient, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(config.KubernetesSubjects) != 0 {
+		t.Fatalf("expect no kubernetes subjects, got %d", len(config.KubernetesSubjects))
+	}
+
+	config.PreviousKubernetesSubjects = config.KubernetesSubjects
+	config.KubernetesSubjects = []azure.KubernetesSubject{apiSubject}
+	if err := azure.UpdateApplicationIdentity(ctx, config, client, fedClient, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := fedClient.credentials["test-name"]; ok {
+		t.Errorf("legacy credential wasn't deleted")
+	}
+	compare(t, fedClient.subjects(), "system:serviceaccount:default:api")
+}
+
+func TestUpdateIdentityKeepsUnrelatedCredential(t *testing.T) {
+	ctx := context.Background()
+	config, client, fedClient := createIdentity(t, apiSubject)
+	// shares the identity's name but doesn't trust a Kubernetes service account
+	fedClient.CreateOrUpdate(ctx, "test-rg", "test-name", "test-name", armmsi.FederatedIdentityCredential{
+		Properties: &armmsi.FederatedIdentityCredentialProperties{
+			Issuer:  to.Ptr("https://token.actions.githubusercontent.com"),
+			Subject: to.Ptr("repo:massdriver-cloud/example:ref:refs/heads/main"),
+		},
+	}, nil)
+
+	config.PreviousKubernetesSubjects = config.KubernetesSubjects
+	if err := azure.UpdateApplicationIdentity(ctx, config, client, fedClient, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := fedClient.credentials["test-name"]; !ok {
+		t.Errorf("unrelated credential was deleted")
+	}
+}
+
+func TestDeleteIdentity(t *testing.T) {
+	ctx := context.Background()
+	config, client, fedClient := createIdentity(t, apiSubject, workerSubject)
+	fedClient.CreateOrUpdate(ctx, "test-rg", "test-name", "test-name", armmsi.FederatedIdentityCredential{
+		Properties: &armmsi.FederatedIdentityCredentialProperties{
+			Issuer:  to.Ptr(apiSubject.OIDCIssuerURL),
+			Subject: to.Ptr("system:serviceaccount:default:legacy"),
+		},
+	}, nil)
+
+	if err := azure.DeleteApplicationIdentity(ctx, config, client, fedClient, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	compare(t, fedClient.subjects(), "")
+	if !client.deleted {
+		t.Errorf("managed identity wasn't deleted")
+	}
+	compare(t, config.ID, "")
+}
+
+func compare(t *testing.T, got string, want string) {
+	if want != got {
+		t.Errorf("expect %v, got %v", want, got)
+	}
+}
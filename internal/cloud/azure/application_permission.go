@@ -65,6 +65,7 @@ func getAzureResourceManagerAuthorizer(ctx context.Context, c *AzureConfig) (aut
 type RoleAssignmentsClient interface {
 	Create(ctx context.Context, scope string, roleAssignmentName string, parameters authorization.RoleAssignmentCreateParameters) (result authorization.RoleAssignment, err error)
 	GetByID(ctx context.Context, roleID string, tenantID string) (result authorization.RoleAssignment, err error)
+	List(ctx context.Context, filter string, tenantID string) (result authorization.RoleAssignmentListResultPage, err error)
 	Delete(ctx context.Context, scope string, roleAssignmentName string, tenantID string) (result authorization.RoleAssignment, err error)
 }
 
@@ -139,6 +140,46 @@ func CreateApplicationPermission(ctx context.Context, config *ApplicationPermiss
 }
 
 func ReadApplicationPermission(ctx context.Context, config *ApplicationPermissionConfig, raClient RoleAssignmentsClient, rdClient RoleDefinitionsClient) error {
+	assignment, err := raClient.GetByID(ctx, config.ID, "")
+	if err != nil {
+		if responseWasNotFound(assignment.Response) {
+			return &NotFoundError{Resource: fmt.Sprintf("role assignment %s", config.ID), Err: err}
+		}
+		return fmt.Errorf("reading role assignment %q: %w", config.ID, err)
+	}
+	return nil
+}
+
+// ImportApplicationPermission adopts the role assignment with the ID in config.ID, resolving the principal,
+// role name and scope from the assignment and its role definition
+func ImportApplicationPermission(ctx context.Context, config *ApplicationPermissionConfig, raClient RoleAssignmentsClient, rdClient RoleDefinitionsClient) error {
+	if _, err := parseRoleAssignmentId(config.ID); err != nil {
+		return err
+	}
+
+	assignment, err := raClient.GetByID(ctx, config.ID, "")
+	if err != nil {
+		if responseWasNotFound(assignment.Response) {
+			return &NotFoundError{Resource: fmt.Sprintf("role assignment %s", config.ID), Err: err}
+		}
+		return fmt.Errorf("reading role assignment %q: %w", config.ID, err)
+	}
+	if assignment.RoleAssignmentPropertiesWithScope == nil {
+		return fmt.Errorf("reading role assignment %q: no properties returned", config.ID)
+	}
+
+	roleDefinitionID := stringValue(assignment.RoleDefinitionID)
+	role, err := rdClient.GetByID(ctx, roleDefinitionID)
+	if err != nil {
+		return fmt.Errorf("getting Role Definition by ID %s: %+v", roleDefinitionID, err)
+	}
+	if role.RoleDefinitionProperties == nil {
+		return fmt.Errorf("getting Role Definition by ID %s: no properties returned", roleDefinitionID)
+	}
+
+	config.ServicePrincipalID = stringValue(assignment.PrincipalID)
+	config.Scope = stringValue(assignment.Scope)
+	config.RoleName = stringValue(role.RoleName)
 	return nil
 }
 
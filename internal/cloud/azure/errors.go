@@ -0,0 +1,20 @@
+package azure
+
+import "fmt"
+
+// NotFoundError reports a managed identity, role assignment or federated credential that no longer exists
+type NotFoundError struct {
+	Resource string
+	Err      error
+}
+
+func (e *NotFoundError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("%s not found", e.Resource)
+	}
+	return fmt.Sprintf("%s not found: %s", e.Resource, e.Err)
+}
+
+func (e *NotFoundError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,115 @@
+package azure
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/msi/armmsi"
+)
+
+// IdentityFederationConfig lets an identity of another cloud use the managed identity with an OIDC token,
+// through a federated identity credential
+type IdentityFederationConfig struct {
+	// READ-ONLY; resource ID of the federated identity credential
+	ID string
+	// resource ID of the managed identity
+	IdentityResourceID string
+	// issuer and sub claim of the other cloud's identity token
+	Issuer  string
+	Subject string
+	// the audience the other cloud's identity requests its token for, defaults to api://AzureADTokenExchange
+	Audience string
+}
+
+// identityFederationCredentialName is unique per identity and audience. Without an underscore it can't clash with the
+// credentials of Kubernetes service accounts.
+func identityFederationCredentialName(config *IdentityFederationConfig) string {
+	hash := sha256.Sum256([]byte(strings.Join([]string{config.Issuer, config.Subject, config.Audience}, "\x00")))
+	return fmt.Sprintf("federation-%x", hash[:4])
+}
+
+func CreateIdentityFederation(ctx context.Context, config *IdentityFederationConfig, client FederatedIdentityCredentialClient) error {
+	identity, err := arm.ParseResourceID(config.IdentityResourceID)
+	if err != nil {
+		return fmt.Errorf("parsing managed identity resource ID %q: %w", config.IdentityResourceID, err)
+	}
+	if strings.Contains(config.Subject, "*") {
+		return fmt.Errorf("Azure federated identity credentials require an exact subject, got %q", config.Subject)
+	}
+	if config.Audience == "" {
+		config.Audience = defaultFederatedIdentityCredentialAudience
+	}
+
+	credentialName := identityFederationCredentialName(config)
+	// CreateOrUpdate would take over the credential of another federation
+	_, err = client.Get(ctx, identity.ResourceGroupName, identity.Name, credentialName, nil)
+	if err == nil {
+		return fmt.Errorf("managed identity %s already has federated identity credential %s for subject %s of %s", identity.Name, credentialName, config.Subject, config.Issuer)
+	}
+	if !errorWasNotFound(err) {
+		return fmt.Errorf("reading federated identity credential %s: %w", credentialName, err)
+	}
+
+	credential, err := client.CreateOrUpdate(ctx,
+		identity.ResourceGroupName,
+		identity.Name,
+		credentialName,
+		armmsi.FederatedIdentityCredential{
+			Properties: &armmsi.FederatedIdentityCredentialProperties{
+				Audiences: []*string{to.Ptr(config.Audience)},
+				Issuer:    to.Ptr(config.Issuer),
+				Subject:   to.Ptr(config.Subject),
+			},
+		},
+		nil)
+	if err != nil {
+		return fmt.Errorf("creating federated identity credential %s: %w", credentialName, err)
+	}
+
+	config.ID = stringValue(credential.ID)
+	return nil
+}
+
+func ReadIdentityFederation(ctx context.Context, config *IdentityFederationConfig, client FederatedIdentityCredentialClient) error {
+	id, err := arm.ParseResourceID(config.ID)
+	if err != nil {
+		return fmt.Errorf("parsing federated identity credential ID %q: %w", config.ID, err)
+	}
+
+	credential, err := client.Get(ctx, id.ResourceGroupName, id.Parent.Name, id.Name, nil)
+	if err != nil {
+		if errorWasNotFound(err) {
+			return &NotFoundError{Resource: fmt.Sprintf("federated identity credential %s", id.Name), Err: err}
+		}
+		return fmt.Errorf("reading federated identity credential %s: %w", id.Name, err)
+	}
+
+	config.IdentityResourceID = id.Parent.String()
+	if credential.Properties != nil {
+		config.Issuer = stringValue(credential.Properties.Issuer)
+		config.Subject = stringValue(credential.Properties.Subject)
+		audiences := make([]string, 0, len(credential.Properties.Audiences))
+		for _, audience := range credential.Properties.Audiences {
+			audiences = append(audiences, stringValue(audience))
+		}
+		config.Audience = strings.Join(audiences, ",")
+	}
+	return nil
+}
+
+func DeleteIdentityFederation(ctx context.Context, config *IdentityFederationConfig, client FederatedIdentityCredentialClient) error {
+	id, err := arm.ParseResourceID(config.ID)
+	if err != nil {
+		return fmt.Errorf("parsing federated identity credential ID %q: %w", config.ID, err)
+	}
+
+	_, err = client.Delete(ctx, id.ResourceGroupName, id.Parent.Name, id.Name, nil)
+	if err != nil && !errorWasNotFound(err) {
+		return fmt.Errorf("deleting federated identity credential %s: %w", id.Name, err)
+	}
+	return nil
+}
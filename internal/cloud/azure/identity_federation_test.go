@@ -0,0 +1,66 @@
+package azure_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"terraform-provider-mdxc/internal/cloud/azure"
+	"testing"
+)
+
+func TestIdentityFederation(t *testing.T) {
+	ctx := context.Background()
+	_, _, fedClient := createIdentity(t)
+
+	federation := &azure.IdentityFederationConfig{
+		IdentityResourceID: identityResourceID,
+		Issuer:             "https://accounts.google.com",
+		Subject:            "123456789",
+	}
+	if err := azure.CreateIdentityFederation(ctx, federation, fedClient); err != nil {
+		t.Fatal(err)
+	}
+	compare(t, federation.Audience, "api://AzureADTokenExchange")
+	if !strings.HasPrefix(federation.ID, identityResourceID+"/federatedIdentityCredentials/federation-") {
+		t.Errorf("expect the ID to name the federated identity credential, got %v", federation.ID)
+	}
+
+	// the same federation can't be created twice, one for another audience can
+	duplicate := &azure.IdentityFederationConfig{
+		IdentityResourceID: identityResourceID,
+		Issuer:             "https://accounts.google.com",
+		Subject:            "123456789",
+	}
+	if err := azure.CreateIdentityFederation(ctx, duplicate, fedClient); err == nil {
+		t.Error("expect an error for an existing federation")
+	}
+	otherAudience := &azure.IdentityFederationConfig{
+		IdentityResourceID: identityResourceID,
+		Issuer:             "https://accounts.google.com",
+		Subject:            "123456789",
+		Audience:           "api://other",
+	}
+	if err := azure.CreateIdentityFederation(ctx, otherAudience, fedClient); err != nil {
+		t.Fatal(err)
+	}
+	if otherAudience.ID == federation.ID {
+		t.Errorf("expect federations for different audiences to have different IDs, got %v", otherAudience.ID)
+	}
+
+	read := &azure.IdentityFederationConfig{ID: federation.ID}
+	if err := azure.ReadIdentityFederation(ctx, read, fedClient); err != nil {
+		t.Fatal(err)
+	}
+	compare(t, read.Issuer, "https://accounts.google.com")
+	compare(t, read.Subject, "123456789")
+	compare(t, read.Audience, "api://AzureADTokenExchange")
+
+	if err := azure.DeleteIdentityFederation(ctx, federation, fedClient); err != nil {
+		t.Fatal(err)
+	}
+	err := azure.ReadIdentityFederation(ctx, read, fedClient)
+	var notFoundErr *azure.NotFoundError
+	if !errors.As(err, &notFoundErr) {
+		t.Fatalf("expected a not found error, got %v", err)
+	}
+}
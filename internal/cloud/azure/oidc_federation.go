@@ -0,0 +1,102 @@
+package azure
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/msi/armmsi"
+)
+
+// OIDCFederation trusts the tokens of an external OIDC issuer, e.g. GitHub Actions
+type OIDCFederation struct {
+	Issuer string
+	// defaults to api://AzureADTokenExchange when empty
+	Audience string
+	// the exact sub claim, federated identity credentials don't support patterns
+	Subject string
+}
+
+// the single federated identity credential of the OIDC federation. Kubernetes credential names always contain an underscore.
+const oidcFederationCredentialName = "oidc-federation"
+
+// updateOIDCFederationCredential creates, updates in place or deletes the federated identity credential of the OIDC federation
+func updateOIDCFederationCredential(ctx context.Context, config *ApplicationIdentityConfig, previous *OIDCFederation, current *OIDCFederation, client FederatedIdentityCredentialClient) error {
+	if current == nil {
+		if previous == nil {
+			return nil
+		}
+		_, err := client.Delete(ctx, config.ResourceGroupName, config.Name, oidcFederationCredentialName, nil)
+		if err != nil && !errorWasNotFound(err) {
+			return fmt.Errorf("deleting federated identity credential %s: %w", oidcFederationCredentialName, err)
+		}
+		return nil
+	}
+	if previous != nil && *previous == *current {
+		return nil
+	}
+
+	if strings.Contains(current.Subject, "*") {
+		return fmt.Errorf("Azure federated identity credentials require an exact subject, got %q", current.Subject)
+	}
+	audience := current.Audience
+	if audience == "" {
+		audience = defaultFederatedIdentityCredentialAudience
+	}
+
+	_, err := client.CreateOrUpdate(ctx,
+		config.ResourceGroupName,
+		config.Name,
+		oidcFederationCredentialName,
+		armmsi.FederatedIdentityCredential{
+			Properties: &armmsi.FederatedIdentityCredentialProperties{
+				Audiences: []*string{to.Ptr(audience)},
+				Issuer:    to.Ptr(current.Issuer),
+				Subject:   to.Ptr(current.Subject),
+			},
+		},
+		nil)
+	if err != nil {
+		return fmt.Errorf("creating federated identity credential %s: %w", oidcFederationCredentialName, err)
+	}
+
+	return nil
+}
+
+// readOIDCFederationCredential refreshes the OIDC federation from its federated identity credential,
+// and clears it when the credential was deleted outside of Terraform
+func readOIDCFederationCredential(ctx context.Context, config *ApplicationIdentityConfig, client FederatedIdentityCredentialClient) error {
+	if config.OIDCFederation == nil {
+		return nil
+	}
+
+	credential, err := client.Get(ctx, config.ResourceGroupName, config.Name, oidcFederationCredentialName, nil)
+	if err != nil {
+		if errorWasNotFound(err) {
+			config.OIDCFederation = nil
+			return nil
+		}
+		return fmt.Errorf("reading federated identity credential %s: %w", oidcFederationCredentialName, err)
+	}
+	if credential.Properties == nil {
+		config.OIDCFederation = nil
+		return nil
+	}
+
+	audiences := make([]string, 0, len(credential.Properties.Audiences))
+	for _, audience := range credential.Properties.Audiences {
+		audiences = append(audiences, stringValue(audience))
+	}
+	audience := strings.Join(audiences, ",")
+	if config.OIDCFederation.Audience == "" && audience == defaultFederatedIdentityCredentialAudience {
+		audience = ""
+	}
+	config.OIDCFederation = &OIDCFederation{
+		Issuer:   stringValue(credential.Properties.Issuer),
+		Audience: audience,
+		Subject:  stringValue(credential.Properties.Subject),
+	}
+
+	return nil
+}
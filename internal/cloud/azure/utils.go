@@ -1,9 +1,11 @@
 package azure
 
 import (
+	"errors"
 	"net"
 	"net/http"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/Azure/go-autorest/autorest"
 )
 
@@ -11,6 +13,12 @@ func responseWasNotFound(resp autorest.Response) bool {
 	return responseWasStatusCode(resp, http.StatusNotFound)
 }
 
+// errorWasNotFound is responseWasNotFound for the errors of the azcore based clients
+func errorWasNotFound(err error) bool {
+	var responseErr *azcore.ResponseError
+	return errors.As(err, &responseErr) && responseErr.StatusCode == http.StatusNotFound
+}
+
 func responseWasBadRequest(resp autorest.Response) bool {
 	return responseWasStatusCode(resp, http.StatusBadRequest)
 }
@@ -48,3 +56,10 @@ func responseWasStatusCode(resp autorest.Response, statusCode int) bool { // nol
 
 	return false
 }
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
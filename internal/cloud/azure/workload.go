@@ -0,0 +1,66 @@
+package azure
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/msi/armmsi"
+)
+
+// workloadPresets are the Azure workload presets. A user assigned managed identity needs no trust relationship
+// to be attached to App Service, so the preset is only recorded as a tag. The kubernetes preset is served by
+// the Kubernetes configuration instead.
+var workloadPresets = map[string]bool{
+	"app_service": true,
+	"kubernetes":  true,
+}
+
+const workloadTag = "workload"
+
+func validateWorkload(config *ApplicationIdentityConfig) error {
+	if config.Workload == "" {
+		return nil
+	}
+	if !workloadPresets[config.Workload] {
+		return fmt.Errorf("workload %s is not supported on Azure", config.Workload)
+	}
+	if config.Workload == "kubernetes" && len(config.KubernetesSubjects) == 0 {
+		return fmt.Errorf("workload kubernetes requires kubernetes to be configured")
+	}
+	return nil
+}
+
+func identityTags(config *ApplicationIdentityConfig) map[string]*string {
+	tags := map[string]*string{
+		"managed-by": to.Ptr("massdriver"),
+	}
+	if config.Workload != "" {
+		tags[workloadTag] = to.Ptr(config.Workload)
+	}
+	return tags
+}
+
+// updateWorkload retags the managed identity when its workload preset changed
+func updateWorkload(ctx context.Context, config *ApplicationIdentityConfig, client ManagedIdentityClient) error {
+	if config.PreviousWorkload == config.Workload {
+		return nil
+	}
+	if err := validateWorkload(config); err != nil {
+		return err
+	}
+
+	_, err := client.CreateOrUpdate(ctx,
+		config.ResourceGroupName,
+		config.Name,
+		armmsi.Identity{
+			Location: &config.Location,
+			Tags:     identityTags(config),
+		},
+		nil,
+	)
+	if err != nil {
+		return fmt.Errorf("updating workload of managed identity %s: %w", config.Name, err)
+	}
+	return nil
+}
@@ -5,9 +5,13 @@ package gcp
 import (
 	"context"
 	"fmt"
+	"strings"
+	thirdparty "terraform-provider-mdxc/internal/cloud/gcp/thirdparty/terraform-google-provider"
 	"time"
 
+	"github.com/hashicorp/errwrap"
 	"golang.org/x/oauth2"
+	"google.golang.org/api/cloudresourcemanager/v1"
 	"google.golang.org/api/iam/v1"
 	"google.golang.org/api/option"
 )
@@ -22,12 +26,37 @@ import (
 // 	// TODO func CreateServiceAccountIAMMember()
 
 type ApplicationIdentityConfig struct {
-	ID                           string
-	Project                      string
-	Name                         string
-	ServiceAccountEmail          string
-	KubernetesNamspace           string
-	KubernetesServiceAccountName string
+	ID                  string
+	Project             string
+	Name                string
+	ServiceAccountEmail string
+	// READ-ONLY; the sub claim of the service account's identity tokens
+	UniqueID           string
+	KubernetesSubjects []KubernetesSubject
+	// the Kubernetes service accounts bound before an update
+	PreviousKubernetesSubjects []KubernetesSubject
+	OIDCFederation             *OIDCFederation
+	// the OIDC federation before an update
+	PreviousOIDCFederation *OIDCFederation
+	// cloud-agnostic workload preset, e.g. cloud_run or compute
+	Workload string
+	// the workload preset before an update
+	PreviousWorkload string
+	// project the workload runs in when it isn't Project, whose service agent then needs to create tokens
+	WorkloadProject string
+	// the workload project before an update
+	PreviousWorkloadProject string
+	// READ-ONLY; resource name of the workload identity pool provider of the OIDC federation
+	WorkloadIdentityProvider string
+	ForceDetachOnDestroy     bool
+	DetachedDependencies     []string
+}
+
+type KubernetesSubject struct {
+	Namespace          string
+	ServiceAccountName string
+	// e.g. my-gke-host-project.svc.id.goog, defaults to the pool of the project when empty
+	WorkloadIdentityPool string
 }
 
 type GCPIamIface interface {
@@ -48,7 +77,11 @@ func gcpIAMClientFactory(ctx context.Context, tokenSource oauth2.TokenSource) (G
 	return service.Projects.ServiceAccounts, nil
 }
 
-func CreateApplicationIdentity(ctx context.Context, config *ApplicationIdentityConfig, client GCPIamIface) error {
+func CreateApplicationIdentity(ctx context.Context, config *ApplicationIdentityConfig, client GCPIamIface, rmClient GCPResourceManagerIface, poolsClient GCPWorkloadIdentityPoolsIface, providersClient GCPWorkloadIdentityPoolProvidersIface) error {
+	if errWorkload := validateWorkload(config); errWorkload != nil {
+		return errWorkload
+	}
+
 	request := &iam.CreateServiceAccountRequest{
 		AccountId: config.Name,
 		ServiceAccount: &iam.ServiceAccount{
@@ -72,30 +105,123 @@ func CreateApplicationIdentity(ctx context.Context, config *ApplicationIdentityC
 
 	config.ID = serviceAccount.Email
 	config.ServiceAccountEmail = serviceAccount.Email
+	config.UniqueID = serviceAccount.UniqueId
 	config.Name = serviceAccount.DisplayName
 
-	if config.KubernetesNamspace != "" {
-		if errAddRole := addWorkloadIdentityRole(ctx, config, client); errAddRole != nil {
-			return errAddRole
+	if len(config.KubernetesSubjects) > 0 {
+		if errAddRole := updateWorkloadIdentityRole(ctx, config, nil, config.KubernetesSubjects, client); errAddRole != nil {
+			return rollbackApplicationIdentity(config, client, poolsClient, providersClient, errAddRole)
 		}
 	}
 
+	if config.OIDCFederation != nil {
+		if errOIDC := createOIDCFederation(ctx, config, client, rmClient, poolsClient, providersClient); errOIDC != nil {
+			return rollbackApplicationIdentity(config, client, poolsClient, providersClient, errOIDC)
+		}
+	}
+
+	if errWorkload := updateWorkloadServiceAgent(ctx, config, "", "", config.Workload, config.WorkloadProject, client, rmClient); errWorkload != nil {
+		return rollbackApplicationIdentity(config, client, poolsClient, providersClient, errWorkload)
+	}
 	return nil
 }
 
-func ReadApplicationIdentity(ctx context.Context, config *ApplicationIdentityConfig, iamClient GCPIamIface) error {
+// rollbackApplicationIdentity deletes the service account of a create that failed halfway, otherwise it's left
+// out of the state and every retry fails because the account already exists. Bindings on the service account
+// go with it, the workload identity pool of an OIDC federation has to be deleted separately.
+func rollbackApplicationIdentity(config *ApplicationIdentityConfig, client GCPIamIface, poolsClient GCPWorkloadIdentityPoolsIface, providersClient GCPWorkloadIdentityPoolProvidersIface, err error) error {
+	var rollbackErr error
+	if config.OIDCFederation != nil {
+		if _, errProvider := providersClient.Delete(workloadIdentityPoolProviderName(config)).Do(); errProvider != nil && !isNotFoundError(errProvider) {
+			rollbackErr = errProvider
+		}
+		if _, errPool := poolsClient.Delete(workloadIdentityPoolName(config)).Do(); errPool != nil && !isNotFoundError(errPool) {
+			rollbackErr = errPool
+		}
+	}
+	resourceName := fmt.Sprintf("projects/%s/serviceAccounts/%s", config.Project, config.ID)
+	if _, errDelete := client.Delete(resourceName).Do(); errDelete != nil {
+		rollbackErr = errDelete
+	}
+	if rollbackErr != nil {
+		return fmt.Errorf("%w (deleting service account %s afterwards failed too, remove it manually: %v)", err, config.ID, rollbackErr)
+	}
+	return err
+}
+
+func ReadApplicationIdentity(ctx context.Context, config *ApplicationIdentityConfig, iamClient GCPIamIface, rmClient GCPResourceManagerIface, poolsClient GCPWorkloadIdentityPoolsIface, providersClient GCPWorkloadIdentityPoolProvidersIface) error {
 	resourceName := fmt.Sprintf("projects/%s/serviceAccounts/%s", config.Project, config.ID)
 	serviceAccount, doErr := iamClient.Get(resourceName).Do()
 	if doErr != nil {
+		if isNotFoundError(doErr) {
+			return &NotFoundError{Resource: fmt.Sprintf("service account %s", config.ID), Err: doErr}
+		}
 		return doErr
 	}
 
 	config.Name = serviceAccount.DisplayName
+	config.UniqueID = serviceAccount.UniqueId
+
+	if len(config.KubernetesSubjects) > 0 {
+		if errReadRole := readWorkloadIdentityRole(ctx, config, iamClient); errReadRole != nil {
+			return errReadRole
+		}
+	}
+
+	if config.OIDCFederation != nil {
+		if errOIDC := readOIDCFederation(ctx, config, providersClient); errOIDC != nil {
+			return errOIDC
+		}
+	}
+
+	if errWorkload := readWorkloadServiceAgent(ctx, config, iamClient, rmClient); errWorkload != nil {
+		return errWorkload
+	}
 
 	return nil
 }
 
-func UpdateApplicationIdentity(ctx context.Context, config *ApplicationIdentityConfig, iamClient GCPIamIface) error {
+// ImportApplicationIdentity adopts an existing service account, identified by config.ID as its email or
+// projects/{project}/serviceAccounts/{email}. The Kubernetes service accounts and the OIDC federation are read
+// back from its IAM policy and workload identity pool. Workload presets share service agents, so they aren't imported.
+func ImportApplicationIdentity(ctx context.Context, config *ApplicationIdentityConfig, iamClient GCPIamIface, rmClient GCPResourceManagerIface, poolsClient GCPWorkloadIdentityPoolsIface, providersClient GCPWorkloadIdentityPoolProvidersIface) error {
+	email := config.ID
+	if strings.HasPrefix(email, "projects/") {
+		parts := strings.Split(email, "/")
+		if len(parts) != 4 || parts[2] != "serviceAccounts" {
+			return fmt.Errorf("expected import ID to be a service account email or `projects/{project}/serviceAccounts/{email}` but got %q", config.ID)
+		}
+		if parts[1] != config.Project && parts[1] != "-" {
+			return fmt.Errorf("service account %s is not in the provider's project %s", parts[3], config.Project)
+		}
+		email = parts[3]
+	}
+	if !strings.Contains(email, "@") {
+		return fmt.Errorf("expected import ID to be a service account email or `projects/{project}/serviceAccounts/{email}` but got %q", config.ID)
+	}
+	config.ID = email
+	config.ServiceAccountEmail = email
+
+	if errRead := ReadApplicationIdentity(ctx, config, iamClient, rmClient, poolsClient, providersClient); errRead != nil {
+		return errRead
+	}
+
+	if errKubernetes := importWorkloadIdentityRole(ctx, config, iamClient); errKubernetes != nil {
+		return errKubernetes
+	}
+
+	// the pool is named after the service account, probe for it
+	config.OIDCFederation = &OIDCFederation{}
+	if errOIDC := readOIDCFederation(ctx, config, providersClient); errOIDC != nil {
+		return errOIDC
+	}
+	if config.OIDCFederation != nil {
+		config.OIDCFederation.Subject = oidcSubjectFromAttributeCondition(config.OIDCFederation.Subject)
+	}
+	return nil
+}
+
+func UpdateApplicationIdentity(ctx context.Context, config *ApplicationIdentityConfig, iamClient GCPIamIface, rmClient GCPResourceManagerIface, poolsClient GCPWorkloadIdentityPoolsIface, providersClient GCPWorkloadIdentityPoolProvidersIface) error {
 	request := &iam.PatchServiceAccountRequest{
 		ServiceAccount: &iam.ServiceAccount{
 			DisplayName: config.Name,
@@ -106,39 +232,298 @@ func UpdateApplicationIdentity(ctx context.Context, config *ApplicationIdentityC
 	if doErr != nil {
 		return doErr
 	}
+
+	if errRole := updateWorkloadIdentityRole(ctx, config, config.PreviousKubernetesSubjects, config.KubernetesSubjects, iamClient); errRole != nil {
+		return errRole
+	}
+
+	if errWorkload := updateWorkloadServiceAgent(ctx, config, config.PreviousWorkload, config.PreviousWorkloadProject, config.Workload, config.WorkloadProject, iamClient, rmClient); errWorkload != nil {
+		return errWorkload
+	}
+
+	switch {
+	case config.PreviousOIDCFederation == nil && config.OIDCFederation != nil:
+		return createOIDCFederation(ctx, config, iamClient, rmClient, poolsClient, providersClient)
+	case config.PreviousOIDCFederation != nil && config.OIDCFederation == nil:
+		return deleteOIDCFederation(ctx, config, iamClient, rmClient, poolsClient, providersClient)
+	case config.OIDCFederation != nil && *config.OIDCFederation != *config.PreviousOIDCFederation:
+		return updateOIDCFederation(ctx, config, providersClient)
+	}
+
 	return nil
 }
 
-func DeleteApplicationIdentity(ctx context.Context, config *ApplicationIdentityConfig, client GCPIamIface) error {
+func DeleteApplicationIdentity(ctx context.Context, config *ApplicationIdentityConfig, client GCPIamIface, rmClient GCPResourceManagerIface, poolsClient GCPWorkloadIdentityPoolsIface, providersClient GCPWorkloadIdentityPoolProvidersIface) error {
+	if config.ForceDetachOnDestroy {
+		if errDetach := removeProjectBindings(ctx, config, rmClient); errDetach != nil {
+			return errDetach
+		}
+	}
+
+	if len(config.KubernetesSubjects) > 0 {
+		if errRemoveRole := updateWorkloadIdentityRole(ctx, config, config.KubernetesSubjects, nil, client); errRemoveRole != nil {
+			return serviceAccountNotFoundError(config, errRemoveRole)
+		}
+	}
+
+	if errWorkload := updateWorkloadServiceAgent(ctx, config, config.Workload, config.WorkloadProject, "", "", client, rmClient); errWorkload != nil {
+		return serviceAccountNotFoundError(config, errWorkload)
+	}
+
+	if config.OIDCFederation != nil {
+		if errOIDC := deleteOIDCFederation(ctx, config, client, rmClient, poolsClient, providersClient); errOIDC != nil {
+			return serviceAccountNotFoundError(config, errOIDC)
+		}
+	}
+
 	resourceName := fmt.Sprintf("projects/%s/serviceAccounts/%s", config.Project, config.ID)
 	_, doErr := client.Delete(resourceName).Do()
-	return doErr
+	return serviceAccountNotFoundError(config, doErr)
 }
 
-// google_service_account_iam_member
-// sets an IAM policy for a GCP service account
-func addWorkloadIdentityRole(ctx context.Context, config *ApplicationIdentityConfig, client GCPIamIface) error {
-	k8sEmail := fmt.Sprintf("%s.svc.id.goog[%s/%s]", config.Project, config.KubernetesNamspace, config.KubernetesServiceAccountName)
-	resourceName := fmt.Sprintf("projects/%s/serviceAccounts/%s", config.Project, config.ID)
-	iamPolicy, errGet := client.GetIamPolicy(resourceName).Do()
-	if errGet != nil {
-		return errGet
+// serviceAccountNotFoundError turns the 404 of a service account deleted outside Terraform into a NotFoundError
+func serviceAccountNotFoundError(config *ApplicationIdentityConfig, err error) error {
+	if isNotFoundError(err) {
+		return &NotFoundError{Resource: fmt.Sprintf("service account %s", config.ID), Err: err}
 	}
+	return err
+}
 
-	// TODO: test if idempotent
-	iamPolicy.Bindings = append(iamPolicy.Bindings, &iam.Binding{
-		Role: "roles/iam.workloadIdentityUser",
-		Members: []string{
-			fmt.Sprintf("serviceAccount:%s", k8sEmail),
-		},
+const workloadIdentityUserRole = "roles/iam.workloadIdentityUser"
+
+// https://cloud.google.com/kubernetes-engine/docs/how-to/workload-identity
+// Fleet workload identity uses the pool of the fleet host project, in the same format.
+func defaultWorkloadIdentityPool(project string) string {
+	return fmt.Sprintf("%s.svc.id.goog", project)
+}
+
+func workloadIdentityMember(project string, subject KubernetesSubject) string {
+	pool := subject.WorkloadIdentityPool
+	if pool == "" {
+		pool = defaultWorkloadIdentityPool(project)
+	}
+	return fmt.Sprintf("serviceAccount:%s[%s/%s]", pool, subject.Namespace, subject.ServiceAccountName)
+}
+
+// google_service_account_iam_member, for each subject
+// replaces the previous Kubernetes service accounts in the workload identity user binding of the GCP service account
+// with the current ones.
+func updateWorkloadIdentityRole(ctx context.Context, config *ApplicationIdentityConfig, previous []KubernetesSubject, current []KubernetesSubject, client GCPIamIface) error {
+	previousMembers := make([]string, 0, len(previous))
+	for _, subject := range previous {
+		previousMembers = append(previousMembers, workloadIdentityMember(config.Project, subject))
+	}
+	currentMembers := make([]string, 0, len(current))
+	for _, subject := range current {
+		currentMembers = append(currentMembers, workloadIdentityMember(config.Project, subject))
+	}
+	return updateServiceAccountRoleMembers(ctx, config, workloadIdentityUserRole, previousMembers, currentMembers, client)
+}
+
+// updateServiceAccountRoleMembers replaces the previous members of the role's binding in the IAM policy of the GCP
+// service account with the current ones. Members of both are left untouched, as are members this resource doesn't manage.
+func updateServiceAccountRoleMembers(ctx context.Context, config *ApplicationIdentityConfig, role string, previous []string, current []string, client GCPIamIface) error {
+	toAdd := map[string]bool{}
+	for _, member := range current {
+		toAdd[member] = true
+	}
+	toRemove := map[string]bool{}
+	for _, member := range previous {
+		if toAdd[member] {
+			delete(toAdd, member)
+			continue
+		}
+		toRemove[member] = true
+	}
+	if len(toAdd) == 0 && len(toRemove) == 0 {
+		return nil
+	}
+
+	return readModifyWriteServiceAccountPolicyWithBackoff(ctx, client, serviceAccountResourceName(config), func(policy *iam.Policy) error {
+		var binding *iam.Binding
+		bindings := make([]*iam.Binding, 0, len(policy.Bindings)+1)
+		for _, b := range policy.Bindings {
+			if b.Role == role && b.Condition == nil {
+				members := make([]string, 0, len(b.Members))
+				for _, m := range b.Members {
+					if !toRemove[m] {
+						members = append(members, m)
+					}
+				}
+				b.Members = members
+				binding = b
+			}
+			bindings = append(bindings, b)
+		}
+		if binding == nil {
+			binding = &iam.Binding{Role: role}
+			bindings = append(bindings, binding)
+		}
+		existing := map[string]bool{}
+		for _, m := range binding.Members {
+			existing[m] = true
+		}
+		for _, member := range current {
+			if toAdd[member] && !existing[member] {
+				binding.Members = append(binding.Members, member)
+				existing[member] = true
+			}
+		}
+
+		policy.Bindings = make([]*iam.Binding, 0, len(bindings))
+		for _, b := range bindings {
+			if len(b.Members) > 0 {
+				policy.Bindings = append(policy.Bindings, b)
+			}
+		}
+		return nil
 	})
+}
 
-	_, errSet := client.SetIamPolicy(resourceName, &iam.SetIamPolicyRequest{
-		Policy: iamPolicy,
-	}).Do()
-	if errSet != nil {
-		return errSet
+// readWorkloadIdentityRole drops the Kubernetes subjects whose binding no longer exists
+func readWorkloadIdentityRole(ctx context.Context, config *ApplicationIdentityConfig, client GCPIamIface) error {
+	policy, err := client.GetIamPolicy(serviceAccountResourceName(config)).Do()
+	if err != nil {
+		return err
+	}
+
+	subjects := make([]KubernetesSubject, 0, len(config.KubernetesSubjects))
+	for _, subject := range config.KubernetesSubjects {
+		if hasServiceAccountBindingMember(policy, workloadIdentityUserRole, workloadIdentityMember(config.Project, subject)) {
+			subjects = append(subjects, subject)
+		}
 	}
+	config.KubernetesSubjects = subjects
 
 	return nil
 }
+
+// importWorkloadIdentityRole finds the Kubernetes service accounts in the workload identity user binding
+func importWorkloadIdentityRole(ctx context.Context, config *ApplicationIdentityConfig, client GCPIamIface) error {
+	policy, err := client.GetIamPolicy(serviceAccountResourceName(config)).Do()
+	if err != nil {
+		return err
+	}
+
+	config.KubernetesSubjects = nil
+	for _, binding := range policy.Bindings {
+		if binding.Role != workloadIdentityUserRole || binding.Condition != nil {
+			continue
+		}
+		for _, member := range binding.Members {
+			if subject, ok := parseWorkloadIdentityMember(config.Project, member); ok {
+				config.KubernetesSubjects = append(config.KubernetesSubjects, subject)
+			}
+		}
+	}
+	return nil
+}
+
+// parseWorkloadIdentityMember is the reverse of workloadIdentityMember
+func parseWorkloadIdentityMember(project string, member string) (KubernetesSubject, bool) {
+	identity := strings.TrimPrefix(member, "serviceAccount:")
+	open := strings.Index(identity, "[")
+	if identity == member || open < 0 || !strings.HasSuffix(identity, "]") {
+		return KubernetesSubject{}, false
+	}
+	pool := identity[:open]
+	names := strings.Split(identity[open+1:len(identity)-1], "/")
+	if !strings.HasSuffix(pool, ".svc.id.goog") || len(names) != 2 {
+		return KubernetesSubject{}, false
+	}
+
+	subject := KubernetesSubject{
+		Namespace:          names[0],
+		ServiceAccountName: names[1],
+	}
+	if pool != defaultWorkloadIdentityPool(project) {
+		subject.WorkloadIdentityPool = pool
+	}
+	return subject, true
+}
+
+func hasServiceAccountBindingMember(policy *iam.Policy, role string, member string) bool {
+	for _, binding := range policy.Bindings {
+		if binding.Role != role || binding.Condition != nil {
+			continue
+		}
+		for _, m := range binding.Members {
+			if m == member {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// removeProjectBindings removes the service account from every role binding in the project IAM policy.
+// Deleting the service account alone leaves them behind as deleted:serviceAccount: members.
+func removeProjectBindings(ctx context.Context, config *ApplicationIdentityConfig, client GCPResourceManagerIface) error {
+	member := fmt.Sprintf("serviceAccount:%s", config.ID)
+	deletedMemberPrefix := fmt.Sprintf("deleted:%s?uid=", member)
+
+	var removed []string
+	err := readModifyWriteProjectPolicyWithBackoff(ctx, client, config.Project, func(policy *cloudresourcemanager.Policy) error {
+		removed = nil
+		bindings := make([]*cloudresourcemanager.Binding, 0, len(policy.Bindings))
+		for _, binding := range policy.Bindings {
+			members := make([]string, 0, len(binding.Members))
+			for _, m := range binding.Members {
+				if m == member || strings.HasPrefix(m, deletedMemberPrefix) {
+					removed = append(removed, fmt.Sprintf("project role binding %s", binding.Role))
+					continue
+				}
+				members = append(members, m)
+			}
+			if len(members) == 0 {
+				continue
+			}
+			binding.Members = members
+			bindings = append(bindings, binding)
+		}
+		policy.Bindings = bindings
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	config.DetachedDependencies = append(config.DetachedDependencies, removed...)
+	return nil
+}
+
+// same as readModifyWriteProjectPolicyWithBackoff, for the IAM policy of a service account
+func readModifyWriteServiceAccountPolicyWithBackoff(ctx context.Context, client GCPIamIface, resourceName string, modifyFunc func(policy *iam.Policy) error) error {
+	backoff := time.Second
+
+	for {
+		policy, errGet := client.GetIamPolicy(resourceName).Do()
+		if errGet != nil {
+			return errGet
+		}
+
+		if errModify := modifyFunc(policy); errModify != nil {
+			return errModify
+		}
+
+		_, errSet := client.SetIamPolicy(resourceName, &iam.SetIamPolicyRequest{
+			Policy: policy,
+		}).Do()
+		if errSet == nil {
+			return nil
+		}
+		if thirdparty.IsConflictError(errSet) {
+			time.Sleep(backoff)
+			backoff = backoff * 2
+			if backoff > 30*time.Second {
+				return errwrap.Wrapf(fmt.Sprintf("Error applying IAM policy to %s: Too many conflicts.  Latest error: {{err}}", resourceName), errSet)
+			}
+			continue
+		}
+		return errSet
+	}
+}
+
+func serviceAccountResourceName(config *ApplicationIdentityConfig) string {
+	return fmt.Sprintf("projects/%s/serviceAccounts/%s", config.Project, config.ID)
+}
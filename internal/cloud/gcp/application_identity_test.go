@@ -3,6 +3,7 @@ package gcp_test
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -41,6 +42,98 @@ func createMockIamClient() (gcp.GCPIamIface, error) {
 	return service.Projects.ServiceAccounts, nil
 }
 
+// createMockIamClientWithPolicy serves service accounts like createMockIamClient, and keeps the
+// service account IAM policy set through setIamPolicy
+func createMockIamClientWithPolicy(policy *iam.Policy) (gcp.GCPIamIface, error) {
+	ctx := context.Background()
+	apiService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		project := strings.Split(r.URL.String(), "/")[3]
+
+		var resp interface{}
+		switch {
+		case strings.HasSuffix(r.URL.Path, ":getIamPolicy"):
+			resp = policy
+		case strings.HasSuffix(r.URL.Path, ":setIamPolicy"):
+			request := &iam.SetIamPolicyRequest{}
+			if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+				http.Error(w, "unable to unmarshal request: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			*policy = *request.Policy
+			resp = policy
+		default:
+			resp = &iam.ServiceAccount{
+				Email:       fmt.Sprintf("test-name-prefix@%s.iam.gserviceaccount.com", project),
+				DisplayName: "test-name-prefix",
+				ProjectId:   project,
+			}
+		}
+
+		b, err := json.Marshal(resp)
+		if err != nil {
+			http.Error(w, "unable to marshal request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Write(b)
+	}))
+
+	service, err := iam.NewService(ctx, option.WithoutAuthentication(), option.WithEndpoint(apiService.URL))
+	if err != nil {
+		return nil, err
+	}
+
+	return service.Projects.ServiceAccounts, nil
+}
+
+// createMockWorkloadIdentityPoolClients accepts any workload identity pool, and keeps the providers created,
+// patched and deleted in providers by resource name
+func createMockWorkloadIdentityPoolClients(providers map[string]*iam.WorkloadIdentityPoolProvider) (gcp.GCPWorkloadIdentityPoolsIface, gcp.GCPWorkloadIdentityPoolProvidersIface, error) {
+	ctx := context.Background()
+	apiService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/v1/")
+
+		var resp interface{} = &iam.Operation{Done: true}
+		if strings.Contains(name, "/providers") {
+			switch r.Method {
+			case http.MethodPost, http.MethodPatch:
+				provider := &iam.WorkloadIdentityPoolProvider{}
+				if err := json.NewDecoder(r.Body).Decode(provider); err != nil {
+					http.Error(w, "unable to unmarshal request: "+err.Error(), http.StatusBadRequest)
+					return
+				}
+				if r.Method == http.MethodPost {
+					name = fmt.Sprintf("%s/%s", name, r.URL.Query().Get("workloadIdentityPoolProviderId"))
+				}
+				provider.Name = name
+				providers[name] = provider
+			case http.MethodDelete:
+				delete(providers, name)
+			default:
+				provider, ok := providers[name]
+				if !ok {
+					http.Error(w, "not found", http.StatusNotFound)
+					return
+				}
+				resp = provider
+			}
+		}
+
+		b, err := json.Marshal(resp)
+		if err != nil {
+			http.Error(w, "unable to marshal request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Write(b)
+	}))
+
+	service, err := iam.NewService(ctx, option.WithoutAuthentication(), option.WithEndpoint(apiService.URL))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return service.Projects.Locations.WorkloadIdentityPools, service.Projects.Locations.WorkloadIdentityPools.Providers, nil
+}
+
 func TestCreateIdentity(t *testing.T) {
 	ctx := context.Background()
 	config := &gcp.ApplicationIdentityConfig{
@@ -48,7 +141,8 @@ func TestCreateIdentity(t *testing.T) {
 		Project: "test-project",
 	}
 	client, _ := createMockIamClient()
-	_ = gcp.CreateApplicationIdentity(ctx, config, client)
+	rmClient, _ := createMockPermissionClient()
+	_ = gcp.CreateApplicationIdentity(ctx, config, client, rmClient, nil, nil)
 
 	compare(t, config.ID, "test-name-prefix@test-project.iam.gserviceaccount.com")
 	compare(t, config.Name, "test-name-prefix")
@@ -61,10 +155,286 @@ func TestReadIdentity(t *testing.T) {
 		Project: "test-project",
 	}
 	client, _ := createMockIamClient()
-	_ = gcp.ReadApplicationIdentity(ctx, config, client)
+	rmClient, _ := createMockPermissionClient()
+	_ = gcp.ReadApplicationIdentity(ctx, config, client, rmClient, nil, nil)
+
+	compare(t, config.ID, "test-name-prefix@test-project.iam.gserviceaccount.com")
+	compare(t, config.Name, "test-name-prefix")
+}
+
+func TestReadIdentityNotFound(t *testing.T) {
+	ctx := context.Background()
+	apiService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error": {"code": 404, "message": "service account not found"}}`, http.StatusNotFound)
+	}))
+	service, err := iam.NewService(ctx, option.WithoutAuthentication(), option.WithEndpoint(apiService.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &gcp.ApplicationIdentityConfig{
+		ID:      "test-name-prefix@test-project.iam.gserviceaccount.com",
+		Project: "test-project",
+	}
+	err = gcp.ReadApplicationIdentity(ctx, config, service.Projects.ServiceAccounts, nil, nil, nil)
+
+	var notFound *gcp.NotFoundError
+	if !errors.As(err, &notFound) {
+		t.Fatalf("expected a not found error, got %v", err)
+	}
+}
+
+func TestCreateIdentityRollback(t *testing.T) {
+	ctx := context.Background()
+	deleted := []string{}
+	apiService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, ":getIamPolicy"):
+			http.Error(w, "permission denied", http.StatusForbidden)
+			return
+		case r.Method == http.MethodDelete:
+			deleted = append(deleted, strings.TrimPrefix(r.URL.Path, "/v1/"))
+		}
+		w.Write([]byte(`{"email":"test-name-prefix@test-project.iam.gserviceaccount.com","displayName":"test-name-prefix"}`))
+	}))
+	defer apiService.Close()
+	service, err := iam.NewService(ctx, option.WithoutAuthentication(), option.WithEndpoint(apiService.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rmClient, _ := createMockPermissionClient()
+	config := &gcp.ApplicationIdentityConfig{
+		Name:               "test-name-prefix",
+		Project:            "test-project",
+		KubernetesSubjects: []gcp.KubernetesSubject{{Namespace: "default", ServiceAccountName: "app"}},
+	}
+	if err := gcp.CreateApplicationIdentity(ctx, config, service.Projects.ServiceAccounts, rmClient, nil, nil); err == nil {
+		t.Error("expect error when the workload identity binding fails, got nil")
+	}
+	compare(t, fmt.Sprint(deleted), "[projects/test-project/serviceAccounts/test-name-prefix@test-project.iam.gserviceaccount.com]")
+}
+
+func TestDeleteIdentityNotFound(t *testing.T) {
+	ctx := context.Background()
+	apiService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not found", http.StatusNotFound)
+	}))
+	defer apiService.Close()
+	service, err := iam.NewService(ctx, option.WithoutAuthentication(), option.WithEndpoint(apiService.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rmClient, _ := createMockPermissionClient()
+	config := &gcp.ApplicationIdentityConfig{
+		ID:                 "test-name-prefix@test-project.iam.gserviceaccount.com",
+		Name:               "test-name-prefix",
+		Project:            "test-project",
+		KubernetesSubjects: []gcp.KubernetesSubject{{Namespace: "default", ServiceAccountName: "app"}},
+	}
+	var notFound *gcp.NotFoundError
+	if err := gcp.DeleteApplicationIdentity(ctx, config, service.Projects.ServiceAccounts, rmClient, nil, nil); !errors.As(err, &notFound) {
+		t.Errorf("expect NotFoundError, got %v", err)
+	}
+
+	config.KubernetesSubjects = nil
+	if err := gcp.DeleteApplicationIdentity(ctx, config, service.Projects.ServiceAccounts, rmClient, nil, nil); !errors.As(err, &notFound) {
+		t.Errorf("expect NotFoundError without Kubernetes subjects, got %v", err)
+	}
+}
+
+func TestWorkloadIdentityBinding(t *testing.T) {
+	ctx := context.Background()
+	policy := &iam.Policy{}
+	client, _ := createMockIamClientWithPolicy(policy)
+	rmClient, _ := createMockPermissionClient()
+	config := &gcp.ApplicationIdentityConfig{
+		Name:    "test-name-prefix",
+		Project: "test-project",
+		KubernetesSubjects: []gcp.KubernetesSubject{
+			{Namespace: "default", ServiceAccountName: "app"},
+			{Namespace: "canary", ServiceAccountName: "app"},
+		},
+	}
+	if err := gcp.CreateApplicationIdentity(ctx, config, client, rmClient, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	compare(t, fmt.Sprint(policy.Bindings[0].Members), "[serviceAccount:test-project.svc.id.goog[default/app] serviceAccount:test-project.svc.id.goog[canary/app]]")
+
+	// changing one subject replaces only its member, moving to a fleet pool included
+	config.PreviousKubernetesSubjects = config.KubernetesSubjects
+	config.KubernetesSubjects = []gcp.KubernetesSubject{
+		{Namespace: "default", ServiceAccountName: "app"},
+		{Namespace: "canary", ServiceAccountName: "app", WorkloadIdentityPool: "fleet-host-project.svc.id.goog"},
+	}
+	if err := gcp.UpdateApplicationIdentity(ctx, config, client, rmClient, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	compare(t, fmt.Sprint(len(policy.Bindings)), "1")
+	compare(t, fmt.Sprint(policy.Bindings[0].Members), "[serviceAccount:test-project.svc.id.goog[default/app] serviceAccount:fleet-host-project.svc.id.goog[canary/app]]")
+
+	// a binding removed outside of Terraform drops the subject
+	policy.Bindings[0].Members = policy.Bindings[0].Members[1:]
+	if err := gcp.ReadApplicationIdentity(ctx, config, client, rmClient, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	compare(t, fmt.Sprint(config.KubernetesSubjects), "[{canary app fleet-host-project.svc.id.goog}]")
+
+	// removing every subject removes the binding
+	config.PreviousKubernetesSubjects = config.KubernetesSubjects
+	config.KubernetesSubjects = nil
+	if err := gcp.UpdateApplicationIdentity(ctx, config, client, rmClient, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	compare(t, fmt.Sprint(len(policy.Bindings)), "0")
+}
+
+func TestOIDCFederation(t *testing.T) {
+	ctx := context.Background()
+	policy := &iam.Policy{}
+	providers := map[string]*iam.WorkloadIdentityPoolProvider{}
+	client, _ := createMockIamClientWithPolicy(policy)
+	rmClient, _ := createMockPermissionClient()
+	poolsClient, providersClient, _ := createMockWorkloadIdentityPoolClients(providers)
+	config := &gcp.ApplicationIdentityConfig{
+		Name:    "test-name-prefix",
+		Project: "test-project",
+		OIDCFederation: &gcp.OIDCFederation{
+			Issuer:  "https://token.actions.githubusercontent.com",
+			Subject: "repo:my-org/my.repo:*",
+		},
+	}
+	if err := gcp.CreateApplicationIdentity(ctx, config, client, rmClient, poolsClient, providersClient); err != nil {
+		t.Fatal(err)
+	}
+	providerName := "projects/test-project/locations/global/workloadIdentityPools/test-name-prefix/providers/oidc"
+	compare(t, providers[providerName].AttributeCondition, `assertion.sub.matches("^repo:my-org/my\\.repo:.*$")`)
+	compare(t, providers[providerName].Oidc.IssuerUri, "https://token.actions.githubusercontent.com")
+	compare(t, fmt.Sprint(strings.HasSuffix(policy.Bindings[0].Members[0], "/workloadIdentityPools/test-name-prefix/*")), "true")
+
+	// an exact subject is compared as is
+	config.PreviousOIDCFederation = &gcp.OIDCFederation{}
+	*config.PreviousOIDCFederation = *config.OIDCFederation
+	config.OIDCFederation.Subject = "repo:my-org/my-repo:ref:refs/heads/main"
+	if err := gcp.UpdateApplicationIdentity(ctx, config, client, rmClient, poolsClient, providersClient); err != nil {
+		t.Fatal(err)
+	}
+	compare(t, providers[providerName].AttributeCondition, `assertion.sub == "repo:my-org/my-repo:ref:refs/heads/main"`)
+
+	// a provider deleted outside of Terraform clears the OIDC federation
+	delete(providers, providerName)
+	if err := gcp.ReadApplicationIdentity(ctx, config, client, rmClient, poolsClient, providersClient); err != nil {
+		t.Fatal(err)
+	}
+	if config.OIDCFederation != nil {
+		t.Errorf("expect no OIDC federation, got %v", config.OIDCFederation)
+	}
+}
+
+func TestImportIdentity(t *testing.T) {
+	ctx := context.Background()
+	policy := &iam.Policy{
+		Bindings: []*iam.Binding{{
+			Role: "roles/iam.workloadIdentityUser",
+			Members: []string{
+				"serviceAccount:test-project.svc.id.goog[default/app]",
+				"serviceAccount:fleet-project.svc.id.goog[canary/app]",
+				"user:someone@example.com",
+			},
+		}},
+	}
+	providers := map[string]*iam.WorkloadIdentityPoolProvider{
+		"projects/test-project/locations/global/workloadIdentityPools/test-name-prefix/providers/oidc": {
+			AttributeCondition: `assertion.sub.matches("^repo:my-org/my\\.repo:.*$")`,
+			Oidc:               &iam.Oidc{IssuerUri: "https://token.actions.githubusercontent.com"},
+		},
+	}
+	client, _ := createMockIamClientWithPolicy(policy)
+	rmClient, _ := createMockPermissionClient()
+	poolsClient, providersClient, _ := createMockWorkloadIdentityPoolClients(providers)
+	config := &gcp.ApplicationIdentityConfig{
+		ID:      "projects/test-project/serviceAccounts/test-name-prefix@test-project.iam.gserviceaccount.com",
+		Project: "test-project",
+	}
+	if err := gcp.ImportApplicationIdentity(ctx, config, client, rmClient, poolsClient, providersClient); err != nil {
+		t.Fatal(err)
+	}
 
 	compare(t, config.ID, "test-name-prefix@test-project.iam.gserviceaccount.com")
 	compare(t, config.Name, "test-name-prefix")
+	want := []gcp.KubernetesSubject{
+		{Namespace: "default", ServiceAccountName: "app"},
+		{Namespace: "canary", ServiceAccountName: "app", WorkloadIdentityPool: "fleet-project.svc.id.goog"},
+	}
+	compare(t, fmt.Sprint(config.KubernetesSubjects), fmt.Sprint(want))
+	if config.OIDCFederation == nil {
+		t.Fatal("expect an OIDC federation")
+	}
+	compare(t, config.OIDCFederation.Subject, "repo:my-org/my.repo:*")
+	compare(t, config.OIDCFederation.Issuer, "https://token.actions.githubusercontent.com")
+
+	// service accounts of other projects can't be managed with the provider's project
+	config = &gcp.ApplicationIdentityConfig{
+		ID:      "projects/other-project/serviceAccounts/test-name-prefix@other-project.iam.gserviceaccount.com",
+		Project: "test-project",
+	}
+	if err := gcp.ImportApplicationIdentity(ctx, config, client, rmClient, poolsClient, providersClient); err == nil {
+		t.Error("expect an error for a service account of another project")
+	}
+}
+
+func TestWorkloadServiceAgent(t *testing.T) {
+	ctx := context.Background()
+	policy := &iam.Policy{}
+	client, _ := createMockIamClientWithPolicy(policy)
+	rmClient, _ := createMockPermissionClient()
+	config := &gcp.ApplicationIdentityConfig{
+		Name:     "test-name-prefix",
+		Project:  "test-project",
+		Workload: "cloud_run",
+	}
+	if err := gcp.CreateApplicationIdentity(ctx, config, client, rmClient, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	// a workload in the service account's own project needs no binding
+	if len(policy.Bindings) != 0 {
+		t.Fatalf("expect no bindings, got %v", policy.Bindings)
+	}
+
+	// the service agent of a workload in another project may create tokens
+	config.PreviousWorkloadProject = config.WorkloadProject
+	config.PreviousWorkload = config.Workload
+	config.WorkloadProject = "workload-project"
+	if err := gcp.UpdateApplicationIdentity(ctx, config, client, rmClient, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	compare(t, policy.Bindings[0].Role, "roles/iam.serviceAccountTokenCreator")
+	compare(t, fmt.Sprint(policy.Bindings[0].Members), "[serviceAccount:service-0@serverless-robot-prod.iam.gserviceaccount.com]")
+
+	// changing the workload moves the binding to the other service agent
+	config.PreviousWorkload = config.Workload
+	config.PreviousWorkloadProject = config.WorkloadProject
+	config.Workload = "compute"
+	if err := gcp.UpdateApplicationIdentity(ctx, config, client, rmClient, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	compare(t, fmt.Sprint(policy.Bindings[0].Members), "[serviceAccount:service-0@compute-system.iam.gserviceaccount.com]")
+
+	// a binding removed outside of Terraform clears the workload
+	policy.Bindings = nil
+	if err := gcp.ReadApplicationIdentity(ctx, config, client, rmClient, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	compare(t, config.Workload, "")
+
+	// presets of the other clouds are rejected
+	config = &gcp.ApplicationIdentityConfig{
+		Name:     "test-name-prefix",
+		Project:  "test-project",
+		Workload: "lambda",
+	}
+	if err := gcp.CreateApplicationIdentity(ctx, config, client, rmClient, nil, nil); err == nil {
+		t.Error("expect an error for a lambda workload")
+	}
 }
 
 func compare(t *testing.T, got string, want string) {
@@ -2,11 +2,11 @@ package gcp
 
 import (
 	"context"
+	"crypto/sha256"
 	"fmt"
+	"strings"
 	thirdparty "terraform-provider-mdxc/internal/cloud/gcp/thirdparty/terraform-google-provider"
-	"time"
 
-	"github.com/hashicorp/errwrap"
 	"golang.org/x/oauth2"
 	"google.golang.org/api/cloudresourcemanager/v1"
 	"google.golang.org/api/option"
@@ -16,11 +16,21 @@ type ApplicationPermissionConfig struct {
 	ID               string
 	ServiceAccountID string
 	Project          string
-	Role             string
-	Condition        string
+	// the resource whose IAM policy the role is bound in, the project when empty, see GCPIamPolicyClients.IamPolicyClient
+	Scope     string
+	Role      string
+	Condition *ApplicationPermissionCondition
+}
+
+// ApplicationPermissionCondition is the IAM condition of a role binding, https://cloud.google.com/iam/docs/conditions-overview
+type ApplicationPermissionCondition struct {
+	Expression  string
+	Title       string
+	Description string
 }
 
 type GCPResourceManagerIface interface {
+	Get(projectId string) *cloudresourcemanager.ProjectsGetCall
 	GetIamPolicy(resourceName string, getiampolicyrequest *cloudresourcemanager.GetIamPolicyRequest) *cloudresourcemanager.ProjectsGetIamPolicyCall
 	SetIamPolicy(resourceName string, setiampolicyrequest *cloudresourcemanager.SetIamPolicyRequest) *cloudresourcemanager.ProjectsSetIamPolicyCall
 }
@@ -34,61 +44,180 @@ func gcpResourceManagerClientFactory(ctx context.Context, tokenSource oauth2.Tok
 	return service.Projects, nil
 }
 
-func CreateApplicationPermission(ctx context.Context, config *ApplicationPermissionConfig, client GCPResourceManagerIface) error {
-	return readModifyWriteWithBackoff(ctx, config, client, addToPolicy)
+func CreateApplicationPermission(ctx context.Context, config *ApplicationPermissionConfig, clients *GCPIamPolicyClients) error {
+	return readModifyWriteWithBackoff(ctx, config, clients, addToPolicy)
 }
 
-func ReadApplicationPermission(ctx context.Context, config *ApplicationPermissionConfig, client GCPResourceManagerIface) error {
-	return nil
-}
+// ReadApplicationPermission returns a NotFoundError when the binding was removed from the IAM policy outside Terraform
+func ReadApplicationPermission(ctx context.Context, config *ApplicationPermissionConfig, clients *GCPIamPolicyClients) error {
+	client, err := clients.IamPolicyClient(config.Project, config.Scope)
+	if err != nil {
+		return err
+	}
+	policy, err := client.GetIamPolicy(ctx)
+	if err != nil {
+		if isNotFoundError(err) {
+			return &NotFoundError{Resource: client.DescribeResource(), Err: err}
+		}
+		return err
+	}
 
-func UpdateApplicationPermission(ctx context.Context, config *ApplicationPermissionConfig, client GCPResourceManagerIface) error {
+	if !thirdparty.HasBinding(policy.Bindings, permissionBinding(config)) {
+		return &NotFoundError{Resource: fmt.Sprintf("binding of role %s to serviceAccount:%s in %s", config.Role, config.ServiceAccountID, client.DescribeResource())}
+	}
 	return nil
 }
 
-func DeleteApplicationPermission(ctx context.Context, config *ApplicationPermissionConfig, client GCPResourceManagerIface) error {
-	return readModifyWriteWithBackoff(ctx, config, client, removeFromPolicy)
-}
-
-// https://github.com/hashicorp/terraform-provider-google/blob/2c3be0cf1f9c56231817a2e876fa63b1afdb46e2/google/iam.go#L103
-func readModifyWriteWithBackoff(ctx context.Context, config *ApplicationPermissionConfig, client GCPResourceManagerIface, modifyFunc func(ctx context.Context, config *ApplicationPermissionConfig, policy *cloudresourcemanager.Policy) error) error {
-	backoff := time.Second
+// ImportApplicationPermission adopts the role binding with the ID in config.ID, see ApplicationPermissionID.
+// Without a condition hash the unconditional binding is imported, or the only conditional one.
+func ImportApplicationPermission(ctx context.Context, config *ApplicationPermissionConfig, clients *GCPIamPolicyClients) error {
+	scope, serviceAccountID, role, hash, ok := parseApplicationPermissionID(config.ID)
+	if !ok {
+		return fmt.Errorf("expected import ID to be in the format `[{scope}/]{service_account_email}-{role}[#{condition_hash}]` but got %q", config.ID)
+	}
+	config.Scope = scope
+	config.ServiceAccountID = serviceAccountID
+	config.Role = role
 
-	for {
-		policy, err := getProjectIamPolicy(ctx, client, config.Project)
-		if err != nil {
-			return err
+	client, err := clients.IamPolicyClient(config.Project, config.Scope)
+	if err != nil {
+		return err
+	}
+	policy, err := client.GetIamPolicy(ctx)
+	if err != nil {
+		if isNotFoundError(err) {
+			return &NotFoundError{Resource: client.DescribeResource(), Err: err}
 		}
+		return err
+	}
 
-		errModify := modifyFunc(ctx, config, policy)
-		if errModify != nil {
-			return errModify
+	member := fmt.Sprintf("serviceAccount:%s", config.ServiceAccountID)
+	conditions := []*cloudresourcemanager.Expr{}
+	for _, binding := range policy.Bindings {
+		if binding.Role != config.Role || !containsString(binding.Members, member) {
+			continue
 		}
-
-		errSave := saveProjectIamPolicy(ctx, client, config.Project, policy)
-		if errSave == nil {
-			// TODO: fetch again I think?
-			// https://github.com/hashicorp/terraform-provider-google/blob/2c3be0cf1f9c56231817a2e876fa63b1afdb46e2/google/iam.go#L103
-			break
+		unconditional := binding.Condition == nil || binding.Condition.Expression == ""
+		switch {
+		case hash == "" && unconditional:
+			config.Condition = nil
+			config.ID = ApplicationPermissionID(config)
+			return nil
+		case hash == "" && !unconditional:
+			conditions = append(conditions, binding.Condition)
+		case hash != "" && !unconditional && conditionHash(binding.Condition) == hash:
+			conditions = []*cloudresourcemanager.Expr{binding.Condition}
 		}
-		if thirdparty.IsConflictError(errSave) {
-			time.Sleep(backoff)
-			backoff = backoff * 2
-			if backoff > 30*time.Second {
-				return errwrap.Wrapf("Error applying IAM policy to %s: Too many conflicts.  Latest error: {{err}}", err)
-			}
-			continue
+	}
+	switch len(conditions) {
+	case 0:
+		return &NotFoundError{Resource: fmt.Sprintf("binding of role %s to %s in %s", config.Role, member, client.DescribeResource())}
+	case 1:
+		config.Condition = &ApplicationPermissionCondition{
+			Expression:  conditions[0].Expression,
+			Title:       conditions[0].Title,
+			Description: conditions[0].Description,
 		}
-		if errSave != nil {
-			return errSave
+		config.ID = ApplicationPermissionID(config)
+		return nil
+	}
+	return fmt.Errorf("%s has %d conditional bindings of role %s in %s, add the condition hash to the import ID", member, len(conditions), config.Role, client.DescribeResource())
+}
+
+func UpdateApplicationPermission(ctx context.Context, config *ApplicationPermissionConfig, clients *GCPIamPolicyClients) error {
+	return nil
+}
+
+// DeleteApplicationPermission returns a NotFoundError when the resource the role is bound on no longer exists
+func DeleteApplicationPermission(ctx context.Context, config *ApplicationPermissionConfig, clients *GCPIamPolicyClients) error {
+	return readModifyWriteWithBackoff(ctx, config, clients, removeFromPolicy)
+}
+
+func readModifyWriteWithBackoff(ctx context.Context, config *ApplicationPermissionConfig, clients *GCPIamPolicyClients, modifyFunc func(ctx context.Context, config *ApplicationPermissionConfig, policy *cloudresourcemanager.Policy) error) error {
+	client, err := clients.IamPolicyClient(config.Project, config.Scope)
+	if err != nil {
+		return err
+	}
+	err = readModifyWriteIamPolicyWithBackoff(ctx, client, func(policy *cloudresourcemanager.Policy) error {
+		return modifyFunc(ctx, config, policy)
+	})
+	if err != nil {
+		if isNotFoundError(err) {
+			return &NotFoundError{Resource: client.DescribeResource(), Err: err}
 		}
+		return err
 	}
 
-	config.ID = fmt.Sprintf("%s-%s", config.ServiceAccountID, config.Role)
+	config.ID = ApplicationPermissionID(config)
 
 	return nil
 }
 
+// ApplicationPermissionID is {service_account_email}-{role}, prefixed with {scope}/ for a binding on a resource
+// and followed by #{condition_hash} for a conditional binding, so bindings of the same role with different conditions get different IDs
+func ApplicationPermissionID(config *ApplicationPermissionConfig) string {
+	id := fmt.Sprintf("%s-%s", config.ServiceAccountID, config.Role)
+	if config.Scope != "" {
+		id = fmt.Sprintf("%s/%s", config.Scope, id)
+	}
+	if condition := permissionCondition(config); condition != nil {
+		id = fmt.Sprintf("%s#%s", id, conditionHash(condition))
+	}
+	return id
+}
+
+// conditionHash identifies a condition by its expression, title and description, which IAM compares bindings by
+func conditionHash(condition *cloudresourcemanager.Expr) string {
+	hash := sha256.Sum256([]byte(strings.Join([]string{condition.Expression, condition.Title, condition.Description}, "\x00")))
+	return fmt.Sprintf("%x", hash[:8])
+}
+
+// permissionCondition returns the IAM condition of the binding, nil when it is unconditional
+func permissionCondition(config *ApplicationPermissionConfig) *cloudresourcemanager.Expr {
+	if config.Condition == nil || config.Condition.Expression == "" {
+		return nil
+	}
+	return &cloudresourcemanager.Expr{
+		Expression:  config.Condition.Expression,
+		Title:       config.Condition.Title,
+		Description: config.Condition.Description,
+	}
+}
+
+// parseApplicationPermissionID splits an ApplicationPermissionID into its scope, service account, role and condition hash.
+// The scope ends at the last slash before the email, which has none. Emails contain hyphens, so the role starts at
+// the first of roles/..., projects/.../roles/... or organizations/.../roles/... after the email.
+func parseApplicationPermissionID(id string) (string, string, string, string, bool) {
+	id, hash, _ := strings.Cut(id, "#")
+	at := strings.Index(id, "@")
+	if at < 0 {
+		return "", "", "", "", false
+	}
+	scope := ""
+	if slash := strings.LastIndex(id[:at], "/"); slash >= 0 {
+		scope, id = id[:slash], id[slash+1:]
+	}
+	for _, prefix := range []string{"-roles/", "-projects/", "-organizations/"} {
+		if i := strings.Index(id, prefix); i > 0 {
+			return scope, id[:i], id[i+1:], hash, true
+		}
+	}
+	return "", "", "", "", false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func readModifyWriteProjectPolicyWithBackoff(ctx context.Context, client GCPResourceManagerIface, project string, modifyFunc func(policy *cloudresourcemanager.Policy) error) error {
+	return readModifyWriteIamPolicyWithBackoff(ctx, &projectIamPolicyClient{client: client, project: project}, modifyFunc)
+}
+
 // https://cloud.google.com/iam/docs/reference/rest/v1/projects.serviceAccounts/create
 func getProjectIamPolicy(ctx context.Context, service GCPResourceManagerIface, projectId string) (*cloudresourcemanager.Policy, error) {
 	getCall := service.GetIamPolicy(projectId, &cloudresourcemanager.GetIamPolicyRequest{
@@ -119,35 +248,21 @@ func saveProjectIamPolicy(ctx context.Context, service GCPResourceManagerIface,
 }
 
 func addToPolicy(ctx context.Context, config *ApplicationPermissionConfig, policy *cloudresourcemanager.Policy) error {
-	role := config.Role
-	member := config.ServiceAccountID
-
-	policy.Bindings = thirdparty.AddBinding(policy.Bindings, &cloudresourcemanager.Binding{
-		Role: role,
-		Condition: &cloudresourcemanager.Expr{
-			Expression: config.Condition,
-		},
-		Members: []string{
-			fmt.Sprintf("serviceAccount:%s", member),
-		},
-	})
-
+	policy.Bindings = thirdparty.AddBinding(policy.Bindings, permissionBinding(config))
 	return nil
 }
 
 func removeFromPolicy(ctx context.Context, config *ApplicationPermissionConfig, policy *cloudresourcemanager.Policy) error {
-	role := config.Role
-	member := config.ServiceAccountID
+	policy.Bindings = thirdparty.RemoveBinding(policy.Bindings, permissionBinding(config))
+	return nil
+}
 
-	policy.Bindings = thirdparty.RemoveBinding(policy.Bindings, &cloudresourcemanager.Binding{
-		Role: role,
-		Condition: &cloudresourcemanager.Expr{
-			Expression: config.Condition,
-		},
+func permissionBinding(config *ApplicationPermissionConfig) *cloudresourcemanager.Binding {
+	return &cloudresourcemanager.Binding{
+		Role:      config.Role,
+		Condition: permissionCondition(config),
 		Members: []string{
-			fmt.Sprintf("serviceAccount:%s", member),
+			fmt.Sprintf("serviceAccount:%s", config.ServiceAccountID),
 		},
-	})
-
-	return nil
+	}
 }
@@ -3,30 +3,55 @@ package gcp_test
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"terraform-provider-mdxc/internal/cloud/gcp"
 	"testing"
 
 	"google.golang.org/api/cloudresourcemanager/v1"
+	cloudresourcemanagerv3 "google.golang.org/api/cloudresourcemanager/v3"
 	"google.golang.org/api/option"
+	"google.golang.org/api/pubsub/v1"
+	"google.golang.org/api/secretmanager/v1"
+	"google.golang.org/api/storage/v1"
 )
 
 func createMockPermissionClient() (gcp.GCPResourceManagerIface, error) {
+	clients, err := createMockPermissionClients()
+	if err != nil {
+		return nil, err
+	}
+	return clients.ResourceManager, nil
+}
+
+func createMockPermissionClients() (*gcp.GCPIamPolicyClients, error) {
+	return createMockPermissionClientWithBindings([]*cloudresourcemanager.Binding{
+		{
+			Role: "roles/redis.viewer",
+			Members: []string{
+				"serviceAccount:test-name-prefix@test-project.iam.gserviceaccount.com",
+			},
+			Condition: &cloudresourcemanager.Expr{},
+		},
+	})
+}
+
+func createMockPermissionClientWithBindings(bindings []*cloudresourcemanager.Binding) (*gcp.GCPIamPolicyClients, error) {
+	return createMockScopedPermissionClient("", bindings)
+}
+
+// createMockScopedPermissionClient serves the IAM policy of every API, only for the resource named by scope unless it is empty
+func createMockScopedPermissionClient(scope string, bindings []*cloudresourcemanager.Binding) (*gcp.GCPIamPolicyClients, error) {
 	ctx := context.Background()
 	apiService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		resp := &cloudresourcemanager.Policy{
-			Bindings: []*cloudresourcemanager.Binding{
-				{
-					Role: "roles/redis.viewer",
-					Members: []string{
-						"serviceAccount:test-name-prefix@test-project.iam.gserviceaccount.com",
-					},
-					Condition: &cloudresourcemanager.Expr{},
-				},
-			},
+		if !strings.Contains(r.URL.Path, scope) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
 		}
+		resp := &cloudresourcemanager.Policy{Bindings: bindings}
 		b, err := json.Marshal(resp)
 		if err != nil {
 			http.Error(w, "unable to marshal request: "+err.Error(), http.StatusBadRequest)
@@ -35,12 +60,37 @@ func createMockPermissionClient() (gcp.GCPResourceManagerIface, error) {
 		w.Write(b)
 	}))
 
-	service, err := cloudresourcemanager.NewService(ctx, option.WithoutAuthentication(), option.WithEndpoint(apiService.URL))
+	opts := []option.ClientOption{option.WithoutAuthentication(), option.WithEndpoint(apiService.URL)}
+	resourceManagerService, err := cloudresourcemanager.NewService(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	storageService, err := storage.NewService(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	pubsubService, err := pubsub.NewService(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	secretmanagerService, err := secretmanager.NewService(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	resourceManagerV3Service, err := cloudresourcemanagerv3.NewService(ctx, opts...)
 	if err != nil {
 		return nil, err
 	}
 
-	return service.Projects, nil
+	return &gcp.GCPIamPolicyClients{
+		ResourceManager: resourceManagerService.Projects,
+		Organizations:   resourceManagerService.Organizations,
+		Folders:         resourceManagerV3Service.Folders,
+		Buckets:         storageService.Buckets,
+		Topics:          pubsubService.Projects.Topics,
+		Subscriptions:   pubsubService.Projects.Subscriptions,
+		Secrets:         secretmanagerService.Projects.Secrets,
+	}, nil
 }
 
 func TestCreatePermission(t *testing.T) {
@@ -48,27 +98,245 @@ func TestCreatePermission(t *testing.T) {
 	config := &gcp.ApplicationPermissionConfig{
 		ServiceAccountID: "test-name-prefix@test-project.iam.gserviceaccount.com",
 		Role:             "roles/redis.viewer",
-		Condition:        "resource.name.startsWith(\"projects/test-project/locations/us-central1/instances/test-instance\")",
-		Project:          "test-project",
+		Condition: &gcp.ApplicationPermissionCondition{
+			Expression: "resource.name.startsWith(\"projects/test-project/locations/us-central1/instances/test-instance\")",
+			Title:      "test-instance",
+		},
+		Project: "test-project",
 	}
-	client, _ := createMockPermissionClient()
+	client, _ := createMockPermissionClients()
 	_ = gcp.CreateApplicationPermission(ctx, config, client)
 
-	permissionID := fmt.Sprintf("%s-%s", config.ServiceAccountID, config.Role)
+	if !strings.HasPrefix(config.ID, fmt.Sprintf("%s-%s#", config.ServiceAccountID, config.Role)) {
+		t.Errorf("expected the ID of a conditional binding to end with the condition hash, got %s", config.ID)
+	}
+	compare(t, config.ID, gcp.ApplicationPermissionID(config))
 
-	compare(t, config.ID, permissionID)
+	// the same role with another condition is a different binding
+	other := *config
+	other.Condition = &gcp.ApplicationPermissionCondition{
+		Expression:  config.Condition.Expression,
+		Title:       "test-instance",
+		Description: "same expression, different description",
+	}
+	if gcp.ApplicationPermissionID(&other) == config.ID {
+		t.Errorf("expected bindings with different conditions to have different IDs, got %s for both", config.ID)
+	}
+
+	other.Condition = nil
+	compare(t, gcp.ApplicationPermissionID(&other), fmt.Sprintf("%s-%s", config.ServiceAccountID, config.Role))
 }
 
 func TestReadPermission(t *testing.T) {
 	ctx := context.Background()
 	config := &gcp.ApplicationPermissionConfig{
+		ID:               "test-name-prefix@test-project.iam.gserviceaccount.com-roles/redis.viewer",
 		ServiceAccountID: "test-name-prefix@test-project.iam.gserviceaccount.com",
 		Role:             "roles/redis.viewer",
-		Condition:        "resource.name.startsWith(\"projects/test-project/locations/us-central1/instances/test-instance\")",
 		Project:          "test-project",
 	}
-	client, _ := createMockPermissionClient()
-	_ = gcp.ReadApplicationPermission(ctx, config, client)
+	client, _ := createMockPermissionClients()
+	if err := gcp.ReadApplicationPermission(ctx, config, client); err != nil {
+		t.Fatal(err)
+	}
+	compare(t, config.ID, "test-name-prefix@test-project.iam.gserviceaccount.com-roles/redis.viewer")
+}
+
+func TestReadRemovedPermission(t *testing.T) {
+	ctx := context.Background()
+	member := "serviceAccount:test-name-prefix@test-project.iam.gserviceaccount.com"
+	condition := &gcp.ApplicationPermissionCondition{
+		Expression: "resource.name.startsWith(\"projects/test-project/locations/us-central1/instances/test-instance\")",
+		Title:      "test-instance",
+	}
+	client, _ := createMockPermissionClientWithBindings([]*cloudresourcemanager.Binding{
+		{Role: "roles/redis.viewer", Members: []string{member}},
+		{Role: "roles/redis.admin", Members: []string{"serviceAccount:other@test-project.iam.gserviceaccount.com"}},
+		{
+			Role:      "roles/redis.editor",
+			Members:   []string{member},
+			Condition: &cloudresourcemanager.Expr{Expression: condition.Expression, Title: "other-instance"},
+		},
+	})
+
+	tests := []struct {
+		name      string
+		role      string
+		condition *gcp.ApplicationPermissionCondition
+		removed   bool
+	}{
+		{name: "bound", role: "roles/redis.viewer"},
+		{name: "role removed", role: "roles/redis.dbConnectionUser", removed: true},
+		{name: "member removed", role: "roles/redis.admin", removed: true},
+		{name: "only bound unconditionally", role: "roles/redis.viewer", condition: condition, removed: true},
+		{name: "only bound with another condition", role: "roles/redis.editor", condition: condition, removed: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			config := &gcp.ApplicationPermissionConfig{
+				ServiceAccountID: "test-name-prefix@test-project.iam.gserviceaccount.com",
+				Role:             tc.role,
+				Condition:        tc.condition,
+				Project:          "test-project",
+			}
+			config.ID = gcp.ApplicationPermissionID(config)
+
+			err := gcp.ReadApplicationPermission(ctx, config, client)
+			var notFound *gcp.NotFoundError
+			if errors.As(err, &notFound) != tc.removed {
+				t.Errorf("expected removed %v, got %v", tc.removed, err)
+			}
+		})
+	}
+}
+
+func TestImportPermission(t *testing.T) {
+	ctx := context.Background()
+	client, _ := createMockPermissionClients()
+	config := &gcp.ApplicationPermissionConfig{
+		ID:      "test-name-prefix@test-project.iam.gserviceaccount.com-roles/redis.viewer",
+		Project: "test-project",
+	}
+	if err := gcp.ImportApplicationPermission(ctx, config, client); err != nil {
+		t.Fatal(err)
+	}
+	compare(t, config.ServiceAccountID, "test-name-prefix@test-project.iam.gserviceaccount.com")
+	compare(t, config.Role, "roles/redis.viewer")
+	if config.Condition != nil {
+		t.Errorf("expected an unconditional binding, got %+v", config.Condition)
+	}
+
+	// a binding that doesn't exist can't be imported
+	config = &gcp.ApplicationPermissionConfig{
+		ID:      "test-name-prefix@test-project.iam.gserviceaccount.com-roles/redis.admin",
+		Project: "test-project",
+	}
+	var notFound *gcp.NotFoundError
+	if err := gcp.ImportApplicationPermission(ctx, config, client); !errors.As(err, &notFound) {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+}
+
+func TestImportConditionalPermission(t *testing.T) {
+	ctx := context.Background()
+	member := "serviceAccount:test-name-prefix@test-project.iam.gserviceaccount.com"
+	conditions := []*gcp.ApplicationPermissionCondition{
+		{
+			Expression: "resource.name.startsWith(\"projects/test-project/locations/us-central1/instances/test-instance\")",
+			Title:      "test-instance",
+		},
+		{
+			Expression:  "resource.name.startsWith(\"projects/test-project/locations/us-central1/instances/other-instance\")",
+			Title:       "other-instance",
+			Description: "Read access to other-instance",
+		},
+	}
+	bindings := []*cloudresourcemanager.Binding{}
+	for _, condition := range conditions {
+		bindings = append(bindings, &cloudresourcemanager.Binding{
+			Role:    "roles/redis.viewer",
+			Members: []string{member},
+			Condition: &cloudresourcemanager.Expr{
+				Expression:  condition.Expression,
+				Title:       condition.Title,
+				Description: condition.Description,
+			},
+		})
+	}
+	client, _ := createMockPermissionClientWithBindings(bindings)
+
+	for _, condition := range conditions {
+		id := gcp.ApplicationPermissionID(&gcp.ApplicationPermissionConfig{
+			ServiceAccountID: "test-name-prefix@test-project.iam.gserviceaccount.com",
+			Role:             "roles/redis.viewer",
+			Condition:        condition,
+		})
+		config := &gcp.ApplicationPermissionConfig{ID: id, Project: "test-project"}
+		if err := gcp.ImportApplicationPermission(ctx, config, client); err != nil {
+			t.Fatal(err)
+		}
+		if config.Condition == nil || *config.Condition != *condition {
+			t.Errorf("expect %+v, got %+v", condition, config.Condition)
+		}
+		compare(t, config.ID, id)
+	}
+
+	// without the hash the binding to import is ambiguous
+	config := &gcp.ApplicationPermissionConfig{
+		ID:      "test-name-prefix@test-project.iam.gserviceaccount.com-roles/redis.viewer",
+		Project: "test-project",
+	}
+	var notFound *gcp.NotFoundError
+	if err := gcp.ImportApplicationPermission(ctx, config, client); err == nil || errors.As(err, &notFound) {
+		t.Errorf("expected an ambiguous import error, got %v", err)
+	}
+}
+
+func TestScopedPermission(t *testing.T) {
+	ctx := context.Background()
+	member := "serviceAccount:test-name-prefix@test-project.iam.gserviceaccount.com"
+	bindings := []*cloudresourcemanager.Binding{{Role: "roles/pubsub.publisher", Members: []string{member}}}
+
+	scopes := []string{
+		"organizations/123456789012",
+		"folders/123456789012",
+		"projects/_/buckets/test-bucket",
+		"projects/test-project/topics/test-topic",
+		"projects/test-project/subscriptions/test-subscription",
+		"projects/test-project/secrets/test-secret",
+	}
+	for _, scope := range scopes {
+		client, _ := createMockScopedPermissionClient(strings.TrimPrefix(scope, "projects/_/buckets/"), bindings)
+		config := &gcp.ApplicationPermissionConfig{
+			ServiceAccountID: "test-name-prefix@test-project.iam.gserviceaccount.com",
+			Scope:            scope,
+			Role:             "roles/pubsub.publisher",
+			Project:          "test-project",
+		}
+		if err := gcp.CreateApplicationPermission(ctx, config, client); err != nil {
+			t.Fatal(err)
+		}
+		compare(t, config.ID, fmt.Sprintf("%s/test-name-prefix@test-project.iam.gserviceaccount.com-roles/pubsub.publisher", scope))
+
+		imported := &gcp.ApplicationPermissionConfig{ID: config.ID, Project: "test-project"}
+		if err := gcp.ImportApplicationPermission(ctx, imported, client); err != nil {
+			t.Fatal(err)
+		}
+		compare(t, imported.Scope, scope)
+		compare(t, imported.ServiceAccountID, config.ServiceAccountID)
+		compare(t, imported.Role, config.Role)
+		compare(t, imported.ID, config.ID)
+	}
+
+	// a resource that doesn't exist can't be imported
+	client, _ := createMockScopedPermissionClient("projects/test-project/topics/test-topic", bindings)
+	config := &gcp.ApplicationPermissionConfig{
+		ID:      "projects/test-project/topics/other-topic/test-name-prefix@test-project.iam.gserviceaccount.com-roles/pubsub.publisher",
+		Project: "test-project",
+	}
+	var notFound *gcp.NotFoundError
+	if err := gcp.ImportApplicationPermission(ctx, config, client); !errors.As(err, &notFound) {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+
+	// nor does a binding on it need to be removed
+	config = &gcp.ApplicationPermissionConfig{
+		ServiceAccountID: "test-name-prefix@test-project.iam.gserviceaccount.com",
+		Scope:            "projects/test-project/topics/other-topic",
+		Role:             "roles/pubsub.publisher",
+		Project:          "test-project",
+	}
+	if err := gcp.DeleteApplicationPermission(ctx, config, client); !errors.As(err, &notFound) {
+		t.Errorf("expected a not found error, got %v", err)
+	}
 
-	// TODO: Add assertions
+	config = &gcp.ApplicationPermissionConfig{
+		ServiceAccountID: "test-name-prefix@test-project.iam.gserviceaccount.com",
+		Scope:            "projects/test-project/instances/test-instance",
+		Role:             "roles/redis.viewer",
+		Project:          "test-project",
+	}
+	if err := gcp.CreateApplicationPermission(ctx, config, client); err == nil {
+		t.Errorf("expected an unsupported scope error")
+	}
 }
@@ -19,13 +19,21 @@ type GCPConfig struct {
 	TokenSource               oauth2.TokenSource
 	NewIAMService             func(ctx context.Context, tokenSource oauth2.TokenSource) (GCPIamIface, error)
 	NewResourceManagerService func(ctx context.Context, tokenSource oauth2.TokenSource) (GCPResourceManagerIface, error)
+	// the project and the resources application permissions can bind roles on
+	NewIamPolicyClients func(ctx context.Context, tokenSource oauth2.TokenSource) (*GCPIamPolicyClients, error)
+	// workload identity pools and their providers, for OIDC federation
+	NewWorkloadIdentityPoolsService         func(ctx context.Context, tokenSource oauth2.TokenSource) (GCPWorkloadIdentityPoolsIface, error)
+	NewWorkloadIdentityPoolProvidersService func(ctx context.Context, tokenSource oauth2.TokenSource) (GCPWorkloadIdentityPoolProvidersIface, error)
 }
 
 func Initialize(ctx context.Context, providerConfig *GCPProviderConfig) (*GCPConfig, error) {
 	gcpConfig := GCPConfig{
-		Provider:                  providerConfig,
-		NewIAMService:             gcpIAMClientFactory,
-		NewResourceManagerService: gcpResourceManagerClientFactory,
+		Provider:                                providerConfig,
+		NewIAMService:                           gcpIAMClientFactory,
+		NewResourceManagerService:               gcpResourceManagerClientFactory,
+		NewIamPolicyClients:                     gcpIamPolicyClientsFactory,
+		NewWorkloadIdentityPoolsService:         gcpWorkloadIdentityPoolsClientFactory,
+		NewWorkloadIdentityPoolProvidersService: gcpWorkloadIdentityPoolProvidersClientFactory,
 	}
 
 	cfg, err := google.JWTConfigFromJSON([]byte(providerConfig.Credentials.Value), "https://www.googleapis.com/auth/cloud-platform")
@@ -0,0 +1,488 @@
+package gcp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	thirdparty "terraform-provider-mdxc/internal/cloud/gcp/thirdparty/terraform-google-provider"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/artifactregistry/v1"
+	"google.golang.org/api/bigquery/v2"
+	"google.golang.org/api/cloudkms/v1"
+	"google.golang.org/api/cloudresourcemanager/v1"
+	cloudresourcemanagerv3 "google.golang.org/api/cloudresourcemanager/v3"
+	"google.golang.org/api/option"
+	"google.golang.org/api/pubsub/v1"
+	"google.golang.org/api/secretmanager/v1"
+	"google.golang.org/api/storage/v1"
+)
+
+// IamPolicyClient reads and writes the IAM policy of a project or of a single resource.
+// Every API returns its own Policy type with the same JSON representation, they are all converted to the
+// cloudresourcemanager one so the binding logic and the etag backoff are shared.
+type IamPolicyClient interface {
+	GetIamPolicy(ctx context.Context) (*cloudresourcemanager.Policy, error)
+	SetIamPolicy(ctx context.Context, policy *cloudresourcemanager.Policy) error
+	DescribeResource() string
+}
+
+type GCPOrganizationsIface interface {
+	GetIamPolicy(resource string, getiampolicyrequest *cloudresourcemanager.GetIamPolicyRequest) *cloudresourcemanager.OrganizationsGetIamPolicyCall
+	SetIamPolicy(resource string, setiampolicyrequest *cloudresourcemanager.SetIamPolicyRequest) *cloudresourcemanager.OrganizationsSetIamPolicyCall
+}
+
+// folders are only in v2 and v3 of the Cloud Resource Manager API
+type GCPFoldersIface interface {
+	GetIamPolicy(resource string, getiampolicyrequest *cloudresourcemanagerv3.GetIamPolicyRequest) *cloudresourcemanagerv3.FoldersGetIamPolicyCall
+	SetIamPolicy(resource string, setiampolicyrequest *cloudresourcemanagerv3.SetIamPolicyRequest) *cloudresourcemanagerv3.FoldersSetIamPolicyCall
+}
+
+type GCPStorageBucketsIface interface {
+	GetIamPolicy(bucket string) *storage.BucketsGetIamPolicyCall
+	SetIamPolicy(bucket string, policy *storage.Policy) *storage.BucketsSetIamPolicyCall
+}
+
+type GCPPubSubTopicsIface interface {
+	GetIamPolicy(resource string) *pubsub.ProjectsTopicsGetIamPolicyCall
+	SetIamPolicy(resource string, setiampolicyrequest *pubsub.SetIamPolicyRequest) *pubsub.ProjectsTopicsSetIamPolicyCall
+}
+
+type GCPPubSubSubscriptionsIface interface {
+	GetIamPolicy(resource string) *pubsub.ProjectsSubscriptionsGetIamPolicyCall
+	SetIamPolicy(resource string, setiampolicyrequest *pubsub.SetIamPolicyRequest) *pubsub.ProjectsSubscriptionsSetIamPolicyCall
+}
+
+type GCPSecretManagerSecretsIface interface {
+	GetIamPolicy(resource string) *secretmanager.ProjectsSecretsGetIamPolicyCall
+	SetIamPolicy(resource string, setiampolicyrequest *secretmanager.SetIamPolicyRequest) *secretmanager.ProjectsSecretsSetIamPolicyCall
+}
+
+// BigQuery datasets have no IAM policy API, their access list is read and written as one instead
+type GCPBigQueryDatasetsIface interface {
+	Get(projectId string, datasetId string) *bigquery.DatasetsGetCall
+	Patch(projectId string, datasetId string, dataset *bigquery.Dataset) *bigquery.DatasetsPatchCall
+}
+
+type GCPKMSCryptoKeysIface interface {
+	GetIamPolicy(resource string) *cloudkms.ProjectsLocationsKeyRingsCryptoKeysGetIamPolicyCall
+	SetIamPolicy(resource string, setiampolicyrequest *cloudkms.SetIamPolicyRequest) *cloudkms.ProjectsLocationsKeyRingsCryptoKeysSetIamPolicyCall
+}
+
+type GCPArtifactRegistryRepositoriesIface interface {
+	GetIamPolicy(resource string) *artifactregistry.ProjectsLocationsRepositoriesGetIamPolicyCall
+	SetIamPolicy(resource string, setiampolicyrequest *artifactregistry.SetIamPolicyRequest) *artifactregistry.ProjectsLocationsRepositoriesSetIamPolicyCall
+}
+
+// GCPIamPolicyClients are the APIs whose IAM policies application permissions can bind roles in
+type GCPIamPolicyClients struct {
+	ResourceManager GCPResourceManagerIface
+	Organizations   GCPOrganizationsIface
+	Folders         GCPFoldersIface
+	Buckets         GCPStorageBucketsIface
+	Topics          GCPPubSubTopicsIface
+	Subscriptions   GCPPubSubSubscriptionsIface
+	Secrets         GCPSecretManagerSecretsIface
+	Datasets        GCPBigQueryDatasetsIface
+	CryptoKeys      GCPKMSCryptoKeysIface
+	Repositories    GCPArtifactRegistryRepositoriesIface
+}
+
+func gcpIamPolicyClientsFactory(ctx context.Context, tokenSource oauth2.TokenSource) (*GCPIamPolicyClients, error) {
+	resourceManagerService, err := cloudresourcemanager.NewService(ctx, option.WithTokenSource(tokenSource))
+	if err != nil {
+		return nil, fmt.Errorf("cloudresourcemanager.NewService: %v", err)
+	}
+	resourceManagerV3Service, err := cloudresourcemanagerv3.NewService(ctx, option.WithTokenSource(tokenSource))
+	if err != nil {
+		return nil, fmt.Errorf("cloudresourcemanagerv3.NewService: %v", err)
+	}
+	storageService, err := storage.NewService(ctx, option.WithTokenSource(tokenSource))
+	if err != nil {
+		return nil, fmt.Errorf("storage.NewService: %v", err)
+	}
+	pubsubService, err := pubsub.NewService(ctx, option.WithTokenSource(tokenSource))
+	if err != nil {
+		return nil, fmt.Errorf("pubsub.NewService: %v", err)
+	}
+	secretmanagerService, err := secretmanager.NewService(ctx, option.WithTokenSource(tokenSource))
+	if err != nil {
+		return nil, fmt.Errorf("secretmanager.NewService: %v", err)
+	}
+	bigqueryService, err := bigquery.NewService(ctx, option.WithTokenSource(tokenSource))
+	if err != nil {
+		return nil, fmt.Errorf("bigquery.NewService: %v", err)
+	}
+	cloudkmsService, err := cloudkms.NewService(ctx, option.WithTokenSource(tokenSource))
+	if err != nil {
+		return nil, fmt.Errorf("cloudkms.NewService: %v", err)
+	}
+	artifactregistryService, err := artifactregistry.NewService(ctx, option.WithTokenSource(tokenSource))
+	if err != nil {
+		return nil, fmt.Errorf("artifactregistry.NewService: %v", err)
+	}
+
+	return &GCPIamPolicyClients{
+		ResourceManager: resourceManagerService.Projects,
+		Organizations:   resourceManagerService.Organizations,
+		Folders:         resourceManagerV3Service.Folders,
+		Buckets:         storageService.Buckets,
+		Topics:          pubsubService.Projects.Topics,
+		Subscriptions:   pubsubService.Projects.Subscriptions,
+		Secrets:         secretmanagerService.Projects.Secrets,
+		Datasets:        bigqueryService.Datasets,
+		CryptoKeys:      cloudkmsService.Projects.Locations.KeyRings.CryptoKeys,
+		Repositories:    artifactregistryService.Projects.Locations.Repositories,
+	}, nil
+}
+
+var (
+	organizationScope = regexp.MustCompile(`^organizations/[0-9]+$`)
+	folderScope       = regexp.MustCompile(`^folders/[0-9]+$`)
+	bucketScope       = regexp.MustCompile(`^projects/_/buckets/([^/]+)$`)
+	topicScope        = regexp.MustCompile(`^projects/[^/]+/topics/[^/]+$`)
+	subscriptionScope = regexp.MustCompile(`^projects/[^/]+/subscriptions/[^/]+$`)
+	secretScope       = regexp.MustCompile(`^projects/[^/]+/secrets/[^/]+$`)
+	datasetScope      = regexp.MustCompile(`^projects/([^/]+)/datasets/([^/]+)$`)
+	cryptoKeyScope    = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/keyRings/[^/]+/cryptoKeys/[^/]+$`)
+	repositoryScope   = regexp.MustCompile(`^projects/[^/]+/locations/[^/]+/repositories/[^/]+$`)
+)
+
+// IamPolicyClient returns the client for the IAM policy of the resource named by scope, or of the project when scope is empty.
+// Scopes are organizations/{organization_id}, folders/{folder_id}, or resources named like in IAM conditions:
+// projects/_/buckets/{bucket}, projects/{project}/topics/{topic}, projects/{project}/subscriptions/{subscription}, projects/{project}/secrets/{secret}, projects/{project}/datasets/{dataset},
+// projects/{project}/locations/{location}/keyRings/{key_ring}/cryptoKeys/{key} and
+// projects/{project}/locations/{location}/repositories/{repository}
+func (c *GCPIamPolicyClients) IamPolicyClient(project string, scope string) (IamPolicyClient, error) {
+	switch {
+	case scope == "":
+		return &projectIamPolicyClient{client: c.ResourceManager, project: project}, nil
+	case organizationScope.MatchString(scope):
+		return &resourceIamPolicyClient{
+			resource: scope,
+			get: func(ctx context.Context) (*cloudresourcemanager.Policy, error) {
+				return fromIamPolicy(c.Organizations.GetIamPolicy(scope, &cloudresourcemanager.GetIamPolicyRequest{
+					Options: &cloudresourcemanager.GetPolicyOptions{RequestedPolicyVersion: 3},
+				}).Context(ctx).Do())
+			},
+			set: func(ctx context.Context, policy *cloudresourcemanager.Policy) error {
+				_, err := c.Organizations.SetIamPolicy(scope, &cloudresourcemanager.SetIamPolicyRequest{Policy: policy}).Context(ctx).Do()
+				return err
+			},
+		}, nil
+	case folderScope.MatchString(scope):
+		return &resourceIamPolicyClient{
+			resource: scope,
+			get: func(ctx context.Context) (*cloudresourcemanager.Policy, error) {
+				return fromIamPolicy(c.Folders.GetIamPolicy(scope, &cloudresourcemanagerv3.GetIamPolicyRequest{
+					Options: &cloudresourcemanagerv3.GetPolicyOptions{RequestedPolicyVersion: 3},
+				}).Context(ctx).Do())
+			},
+			set: func(ctx context.Context, policy *cloudresourcemanager.Policy) error {
+				p := &cloudresourcemanagerv3.Policy{}
+				if err := toIamPolicy(policy, p); err != nil {
+					return err
+				}
+				_, err := c.Folders.SetIamPolicy(scope, &cloudresourcemanagerv3.SetIamPolicyRequest{Policy: p}).Context(ctx).Do()
+				return err
+			},
+		}, nil
+	case bucketScope.MatchString(scope):
+		bucket := bucketScope.FindStringSubmatch(scope)[1]
+		return &resourceIamPolicyClient{
+			resource: scope,
+			get: func(ctx context.Context) (*cloudresourcemanager.Policy, error) {
+				return fromIamPolicy(c.Buckets.GetIamPolicy(bucket).OptionsRequestedPolicyVersion(3).Context(ctx).Do())
+			},
+			set: func(ctx context.Context, policy *cloudresourcemanager.Policy) error {
+				p := &storage.Policy{}
+				if err := toIamPolicy(policy, p); err != nil {
+					return err
+				}
+				_, err := c.Buckets.SetIamPolicy(bucket, p).Context(ctx).Do()
+				return err
+			},
+		}, nil
+	case topicScope.MatchString(scope):
+		return &resourceIamPolicyClient{
+			resource: scope,
+			get: func(ctx context.Context) (*cloudresourcemanager.Policy, error) {
+				return fromIamPolicy(c.Topics.GetIamPolicy(scope).OptionsRequestedPolicyVersion(3).Context(ctx).Do())
+			},
+			set: func(ctx context.Context, policy *cloudresourcemanager.Policy) error {
+				p := &pubsub.Policy{}
+				if err := toIamPolicy(policy, p); err != nil {
+					return err
+				}
+				_, err := c.Topics.SetIamPolicy(scope, &pubsub.SetIamPolicyRequest{Policy: p}).Context(ctx).Do()
+				return err
+			},
+		}, nil
+	case subscriptionScope.MatchString(scope):
+		return &resourceIamPolicyClient{
+			resource: scope,
+			get: func(ctx context.Context) (*cloudresourcemanager.Policy, error) {
+				return fromIamPolicy(c.Subscriptions.GetIamPolicy(scope).OptionsRequestedPolicyVersion(3).Context(ctx).Do())
+			},
+			set: func(ctx context.Context, policy *cloudresourcemanager.Policy) error {
+				p := &pubsub.Policy{}
+				if err := toIamPolicy(policy, p); err != nil {
+					return err
+				}
+				_, err := c.Subscriptions.SetIamPolicy(scope, &pubsub.SetIamPolicyRequest{Policy: p}).Context(ctx).Do()
+				return err
+			},
+		}, nil
+	case secretScope.MatchString(scope):
+		return &resourceIamPolicyClient{
+			resource: scope,
+			get: func(ctx context.Context) (*cloudresourcemanager.Policy, error) {
+				return fromIamPolicy(c.Secrets.GetIamPolicy(scope).OptionsRequestedPolicyVersion(3).Context(ctx).Do())
+			},
+			set: func(ctx context.Context, policy *cloudresourcemanager.Policy) error {
+				p := &secretmanager.Policy{}
+				if err := toIamPolicy(policy, p); err != nil {
+					return err
+				}
+				_, err := c.Secrets.SetIamPolicy(scope, &secretmanager.SetIamPolicyRequest{Policy: p}).Context(ctx).Do()
+				return err
+			},
+		}, nil
+	case datasetScope.MatchString(scope):
+		match := datasetScope.FindStringSubmatch(scope)
+		return &datasetIamPolicyClient{client: c.Datasets, project: match[1], dataset: match[2]}, nil
+	case cryptoKeyScope.MatchString(scope):
+		return &resourceIamPolicyClient{
+			resource: scope,
+			get: func(ctx context.Context) (*cloudresourcemanager.Policy, error) {
+				return fromIamPolicy(c.CryptoKeys.GetIamPolicy(scope).OptionsRequestedPolicyVersion(3).Context(ctx).Do())
+			},
+			set: func(ctx context.Context, policy *cloudresourcemanager.Policy) error {
+				p := &cloudkms.Policy{}
+				if err := toIamPolicy(policy, p); err != nil {
+					return err
+				}
+				_, err := c.CryptoKeys.SetIamPolicy(scope, &cloudkms.SetIamPolicyRequest{Policy: p}).Context(ctx).Do()
+				return err
+			},
+		}, nil
+	case repositoryScope.MatchString(scope):
+		return &resourceIamPolicyClient{
+			resource: scope,
+			get: func(ctx context.Context) (*cloudresourcemanager.Policy, error) {
+				return fromIamPolicy(c.Repositories.GetIamPolicy(scope).OptionsRequestedPolicyVersion(3).Context(ctx).Do())
+			},
+			set: func(ctx context.Context, policy *cloudresourcemanager.Policy) error {
+				p := &artifactregistry.Policy{}
+				if err := toIamPolicy(policy, p); err != nil {
+					return err
+				}
+				_, err := c.Repositories.SetIamPolicy(scope, &artifactregistry.SetIamPolicyRequest{Policy: p}).Context(ctx).Do()
+				return err
+			},
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported scope %q, expected an organization, folder, storage bucket, Pub/Sub topic or subscription, Secret Manager secret, BigQuery dataset, KMS crypto key or Artifact Registry repository name", scope)
+}
+
+type projectIamPolicyClient struct {
+	client  GCPResourceManagerIface
+	project string
+}
+
+func (c *projectIamPolicyClient) GetIamPolicy(ctx context.Context) (*cloudresourcemanager.Policy, error) {
+	return getProjectIamPolicy(ctx, c.client, c.project)
+}
+
+func (c *projectIamPolicyClient) SetIamPolicy(ctx context.Context, policy *cloudresourcemanager.Policy) error {
+	return saveProjectIamPolicy(ctx, c.client, c.project, policy)
+}
+
+func (c *projectIamPolicyClient) DescribeResource() string {
+	return fmt.Sprintf("project %s", c.project)
+}
+
+// resourceIamPolicyClient wraps the getIamPolicy and setIamPolicy calls of a resource
+type resourceIamPolicyClient struct {
+	resource string
+	get      func(ctx context.Context) (*cloudresourcemanager.Policy, error)
+	set      func(ctx context.Context, policy *cloudresourcemanager.Policy) error
+}
+
+func (c *resourceIamPolicyClient) GetIamPolicy(ctx context.Context) (*cloudresourcemanager.Policy, error) {
+	return c.get(ctx)
+}
+
+func (c *resourceIamPolicyClient) SetIamPolicy(ctx context.Context, policy *cloudresourcemanager.Policy) error {
+	return c.set(ctx, policy)
+}
+
+func (c *resourceIamPolicyClient) DescribeResource() string {
+	return c.resource
+}
+
+// fromIamPolicy converts the result of a getIamPolicy call
+func fromIamPolicy(policy interface{}, err error) (*cloudresourcemanager.Policy, error) {
+	if err != nil {
+		return nil, err
+	}
+	result := &cloudresourcemanager.Policy{}
+	if err := toIamPolicy(policy, result); err != nil {
+		return nil, err
+	}
+	// policies with conditional role bindings must be version 3, see getProjectIamPolicy
+	result.Version = 3
+	return result, nil
+}
+
+func toIamPolicy(from interface{}, to interface{}) error {
+	b, err := json.Marshal(from)
+	if err != nil {
+		return fmt.Errorf("converting IAM policy: %w", err)
+	}
+	if err := json.Unmarshal(b, to); err != nil {
+		return fmt.Errorf("converting IAM policy: %w", err)
+	}
+	return nil
+}
+
+// datasetIamPolicyClient maps the access list of a BigQuery dataset to role bindings.
+// Entries without a role, i.e. authorized views, routines and datasets, are kept as they are.
+type datasetIamPolicyClient struct {
+	client  GCPBigQueryDatasetsIface
+	project string
+	dataset string
+	// the entries of the last read that aren't role bindings
+	authorized []*bigquery.DatasetAccess
+}
+
+// the basic roles the access list returns for the predefined dataset roles
+var datasetBasicRoles = map[string]string{
+	"OWNER":  "roles/bigquery.dataOwner",
+	"WRITER": "roles/bigquery.dataEditor",
+	"READER": "roles/bigquery.dataViewer",
+}
+
+func (c *datasetIamPolicyClient) GetIamPolicy(ctx context.Context) (*cloudresourcemanager.Policy, error) {
+	dataset, err := c.client.Get(c.project, c.dataset).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+
+	c.authorized = nil
+	bindings := []*cloudresourcemanager.Binding{}
+	for _, access := range dataset.Access {
+		member := datasetAccessMember(access)
+		if access.Role == "" || member == "" {
+			c.authorized = append(c.authorized, access)
+			continue
+		}
+		role := access.Role
+		if predefined, ok := datasetBasicRoles[role]; ok {
+			role = predefined
+		}
+		bindings = thirdparty.AddBinding(bindings, &cloudresourcemanager.Binding{Role: role, Members: []string{member}})
+	}
+	return &cloudresourcemanager.Policy{Bindings: bindings, Etag: dataset.Etag}, nil
+}
+
+func (c *datasetIamPolicyClient) SetIamPolicy(ctx context.Context, policy *cloudresourcemanager.Policy) error {
+	access := append([]*bigquery.DatasetAccess{}, c.authorized...)
+	for _, binding := range policy.Bindings {
+		if binding.Condition != nil {
+			return fmt.Errorf("BigQuery dataset %s doesn't support IAM conditions", c.DescribeResource())
+		}
+		for _, member := range binding.Members {
+			entry, err := datasetAccessEntry(binding.Role, member)
+			if err != nil {
+				return err
+			}
+			access = append(access, entry)
+		}
+	}
+
+	call := c.client.Patch(c.project, c.dataset, &bigquery.Dataset{Access: access}).Context(ctx)
+	// concurrent changes fail with 412 and are retried like setIamPolicy conflicts
+	call.Header().Set("If-Match", policy.Etag)
+	_, err := call.Do()
+	return err
+}
+
+func (c *datasetIamPolicyClient) DescribeResource() string {
+	return fmt.Sprintf("projects/%s/datasets/%s", c.project, c.dataset)
+}
+
+func datasetAccessMember(access *bigquery.DatasetAccess) string {
+	switch {
+	case access.UserByEmail != "" && strings.HasSuffix(access.UserByEmail, ".gserviceaccount.com"):
+		return fmt.Sprintf("serviceAccount:%s", access.UserByEmail)
+	case access.UserByEmail != "":
+		return fmt.Sprintf("user:%s", access.UserByEmail)
+	case access.GroupByEmail != "":
+		return fmt.Sprintf("group:%s", access.GroupByEmail)
+	case access.Domain != "":
+		return fmt.Sprintf("domain:%s", access.Domain)
+	case access.IamMember != "":
+		return access.IamMember
+	case access.SpecialGroup != "":
+		return fmt.Sprintf("specialGroup:%s", access.SpecialGroup)
+	}
+	return ""
+}
+
+func datasetAccessEntry(role string, member string) (*bigquery.DatasetAccess, error) {
+	kind, value, ok := strings.Cut(member, ":")
+	if !ok {
+		return nil, fmt.Errorf("unsupported BigQuery dataset member %q", member)
+	}
+	switch kind {
+	case "serviceAccount", "user":
+		return &bigquery.DatasetAccess{Role: role, UserByEmail: value}, nil
+	case "group":
+		return &bigquery.DatasetAccess{Role: role, GroupByEmail: value}, nil
+	case "domain":
+		return &bigquery.DatasetAccess{Role: role, Domain: value}, nil
+	case "specialGroup":
+		return &bigquery.DatasetAccess{Role: role, SpecialGroup: value}, nil
+	}
+	return &bigquery.DatasetAccess{Role: role, IamMember: member}, nil
+}
+
+// https://github.com/hashicorp/terraform-provider-google/blob/2c3be0cf1f9c56231817a2e876fa63b1afdb46e2/google/iam.go#L103
+func readModifyWriteIamPolicyWithBackoff(ctx context.Context, client IamPolicyClient, modifyFunc func(policy *cloudresourcemanager.Policy) error) error {
+	backoff := time.Second
+
+	for {
+		policy, err := client.GetIamPolicy(ctx)
+		if err != nil {
+			return err
+		}
+
+		errModify := modifyFunc(policy)
+		if errModify != nil {
+			return errModify
+		}
+
+		errSave := client.SetIamPolicy(ctx, policy)
+		if errSave == nil {
+			break
+		}
+		if thirdparty.IsConflictError(errSave) {
+			time.Sleep(backoff)
+			backoff = backoff * 2
+			if backoff > 30*time.Second {
+				return errwrap.Wrapf(fmt.Sprintf("Error applying IAM policy to %s: Too many conflicts.  Latest error: {{err}}", client.DescribeResource()), errSave)
+			}
+			continue
+		}
+		if errSave != nil {
+			return errSave
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,97 @@
+package gcp
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+)
+
+// IdentityFederationConfig lets an identity of another cloud impersonate the service account with an OIDC token,
+// through a workload identity pool of its own
+type IdentityFederationConfig struct {
+	// READ-ONLY; resource name of the workload identity pool provider
+	ID                  string
+	Project             string
+	ServiceAccountEmail string
+	// issuer and sub claim of the other cloud's identity token
+	Issuer  string
+	Subject string
+	// the audience the other cloud's identity requests its token for, defaults to the provider's resource name
+	Audience string
+}
+
+// identityFederationPoolID is 4 to 32 lowercase letters, digits or hyphens, unique per service account, identity
+// and audience. Once created, the pool is taken from the provider's resource name, where the default audience
+// has replaced the empty one.
+func identityFederationPoolID(config *IdentityFederationConfig) string {
+	if segments := strings.Split(config.ID, "/"); len(segments) == 8 && segments[4] == "workloadIdentityPools" {
+		return segments[5]
+	}
+	hash := sha256.Sum256([]byte(strings.Join([]string{config.ServiceAccountEmail, config.Issuer, config.Subject, config.Audience}, "\x00")))
+	return fmt.Sprintf("mdxc-%x", hash[:6])
+}
+
+// the pool and provider are managed like the OIDC federation of an application identity, under the pool ID
+func (config *IdentityFederationConfig) applicationIdentityConfig() *ApplicationIdentityConfig {
+	return &ApplicationIdentityConfig{
+		ID:                       config.ServiceAccountEmail,
+		ServiceAccountEmail:      config.ServiceAccountEmail,
+		Project:                  config.Project,
+		Name:                     identityFederationPoolID(config),
+		WorkloadIdentityProvider: config.ID,
+		OIDCFederation: &OIDCFederation{
+			Issuer:   config.Issuer,
+			Audience: config.Audience,
+			Subject:  config.Subject,
+		},
+	}
+}
+
+func CreateIdentityFederation(ctx context.Context, config *IdentityFederationConfig, client GCPIamIface, rmClient GCPResourceManagerIface, poolsClient GCPWorkloadIdentityPoolsIface, providersClient GCPWorkloadIdentityPoolProvidersIface) error {
+	federation := config.applicationIdentityConfig()
+	// createOIDCFederation takes over an existing provider, which may belong to another federation
+	provider, err := providersClient.Get(workloadIdentityPoolProviderName(federation)).Do()
+	if err == nil && provider.State != "DELETED" {
+		return fmt.Errorf("workload identity pool provider %s already exists for subject %s of %s", provider.Name, config.Subject, config.Issuer)
+	}
+	if err != nil && !isNotFoundError(err) {
+		return err
+	}
+
+	if err := createOIDCFederation(ctx, federation, client, rmClient, poolsClient, providersClient); err != nil {
+		return err
+	}
+
+	config.ID = federation.WorkloadIdentityProvider
+	if config.Audience == "" {
+		// https://cloud.google.com/iam/docs/workload-identity-federation-with-other-providers#prepare
+		config.Audience = fmt.Sprintf("https://iam.googleapis.com/%s", config.ID)
+	}
+	return nil
+}
+
+func ReadIdentityFederation(ctx context.Context, config *IdentityFederationConfig, client GCPIamIface, rmClient GCPResourceManagerIface, poolsClient GCPWorkloadIdentityPoolsIface, providersClient GCPWorkloadIdentityPoolProvidersIface) error {
+	federation := config.applicationIdentityConfig()
+	if strings.HasPrefix(config.Audience, "https://iam.googleapis.com/") {
+		// the default audience isn't configured on the provider
+		federation.OIDCFederation.Audience = ""
+	}
+	if err := readOIDCFederation(ctx, federation, providersClient); err != nil {
+		return err
+	}
+	if federation.OIDCFederation == nil {
+		return &NotFoundError{Resource: fmt.Sprintf("workload identity pool provider %s", config.ID)}
+	}
+
+	config.Issuer = federation.OIDCFederation.Issuer
+	config.Subject = federation.OIDCFederation.Subject
+	if federation.OIDCFederation.Audience != "" {
+		config.Audience = federation.OIDCFederation.Audience
+	}
+	return nil
+}
+
+func DeleteIdentityFederation(ctx context.Context, config *IdentityFederationConfig, client GCPIamIface, rmClient GCPResourceManagerIface, poolsClient GCPWorkloadIdentityPoolsIface, providersClient GCPWorkloadIdentityPoolProvidersIface) error {
+	return deleteOIDCFederation(ctx, config.applicationIdentityConfig(), client, rmClient, poolsClient, providersClient)
+}
@@ -0,0 +1,60 @@
+package gcp_test
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"terraform-provider-mdxc/internal/cloud/gcp"
+	"testing"
+
+	"google.golang.org/api/iam/v1"
+)
+
+func TestIdentityFederation(t *testing.T) {
+	ctx := context.Background()
+	policy := &iam.Policy{}
+	providers := map[string]*iam.WorkloadIdentityPoolProvider{}
+	client, _ := createMockIamClientWithPolicy(policy)
+	rmClient, _ := createMockPermissionClient()
+	poolsClient, providersClient, _ := createMockWorkloadIdentityPoolClients(providers)
+	config := &gcp.IdentityFederationConfig{
+		Project:             "test-project",
+		ServiceAccountEmail: "test-name-prefix@test-project.iam.gserviceaccount.com",
+		Issuer:              "https://sts.windows.net/tenant/",
+		Subject:             "principal",
+	}
+	if err := gcp.CreateIdentityFederation(ctx, config, client, rmClient, poolsClient, providersClient); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(config.ID, "projects/0/locations/global/workloadIdentityPools/mdxc-") {
+		t.Errorf("expect the ID to name the workload identity pool provider, got %v", config.ID)
+	}
+	compare(t, config.Audience, "https://iam.googleapis.com/"+config.ID)
+	compare(t, fmt.Sprint(len(providers)), "1")
+	for _, provider := range providers {
+		compare(t, provider.AttributeCondition, `assertion.sub == "principal"`)
+		compare(t, provider.Oidc.IssuerUri, "https://sts.windows.net/tenant/")
+	}
+	compare(t, policy.Bindings[0].Role, "roles/iam.workloadIdentityUser")
+
+	duplicate := &gcp.IdentityFederationConfig{
+		Project:             config.Project,
+		ServiceAccountEmail: config.ServiceAccountEmail,
+		Issuer:              config.Issuer,
+		Subject:             config.Subject,
+	}
+	if err := gcp.CreateIdentityFederation(ctx, duplicate, client, rmClient, poolsClient, providersClient); err == nil {
+		t.Error("expect an error for an existing federation")
+	}
+
+	if err := gcp.ReadIdentityFederation(ctx, config, client, rmClient, poolsClient, providersClient); err != nil {
+		t.Fatal(err)
+	}
+	compare(t, config.Subject, "principal")
+
+	if err := gcp.DeleteIdentityFederation(ctx, config, client, rmClient, poolsClient, providersClient); err != nil {
+		t.Fatal(err)
+	}
+	compare(t, fmt.Sprint(len(providers)), "0")
+	compare(t, fmt.Sprint(len(policy.Bindings)), "0")
+}
@@ -0,0 +1,266 @@
+package gcp
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	thirdparty "terraform-provider-mdxc/internal/cloud/gcp/thirdparty/terraform-google-provider"
+	"time"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/iam/v1"
+	"google.golang.org/api/option"
+)
+
+// OIDCFederation trusts the tokens of an external OIDC issuer, e.g. GitHub Actions
+type OIDCFederation struct {
+	Issuer string
+	// defaults to the resource name of the workload identity pool provider when empty
+	Audience string
+	// the exact sub claim, or a pattern where * matches any characters
+	Subject string
+}
+
+type GCPWorkloadIdentityPoolsIface interface {
+	Create(parent string, workloadidentitypool *iam.WorkloadIdentityPool) *iam.ProjectsLocationsWorkloadIdentityPoolsCreateCall
+	Get(name string) *iam.ProjectsLocationsWorkloadIdentityPoolsGetCall
+	Delete(name string) *iam.ProjectsLocationsWorkloadIdentityPoolsDeleteCall
+	Undelete(name string, undeleteworkloadidentitypoolrequest *iam.UndeleteWorkloadIdentityPoolRequest) *iam.ProjectsLocationsWorkloadIdentityPoolsUndeleteCall
+}
+
+type GCPWorkloadIdentityPoolProvidersIface interface {
+	Create(parent string, workloadidentitypoolprovider *iam.WorkloadIdentityPoolProvider) *iam.ProjectsLocationsWorkloadIdentityPoolsProvidersCreateCall
+	Get(name string) *iam.ProjectsLocationsWorkloadIdentityPoolsProvidersGetCall
+	Patch(name string, workloadidentitypoolprovider *iam.WorkloadIdentityPoolProvider) *iam.ProjectsLocationsWorkloadIdentityPoolsProvidersPatchCall
+	Delete(name string) *iam.ProjectsLocationsWorkloadIdentityPoolsProvidersDeleteCall
+	Undelete(name string, undeleteworkloadidentitypoolproviderrequest *iam.UndeleteWorkloadIdentityPoolProviderRequest) *iam.ProjectsLocationsWorkloadIdentityPoolsProvidersUndeleteCall
+}
+
+func gcpWorkloadIdentityPoolsClientFactory(ctx context.Context, tokenSource oauth2.TokenSource) (GCPWorkloadIdentityPoolsIface, error) {
+	service, err := iam.NewService(ctx, option.WithTokenSource(tokenSource))
+	if err != nil {
+		return nil, fmt.Errorf("iam.NewService: %v", err)
+	}
+
+	return service.Projects.Locations.WorkloadIdentityPools, nil
+}
+
+func gcpWorkloadIdentityPoolProvidersClientFactory(ctx context.Context, tokenSource oauth2.TokenSource) (GCPWorkloadIdentityPoolProvidersIface, error) {
+	service, err := iam.NewService(ctx, option.WithTokenSource(tokenSource))
+	if err != nil {
+		return nil, fmt.Errorf("iam.NewService: %v", err)
+	}
+
+	return service.Projects.Locations.WorkloadIdentityPools.Providers, nil
+}
+
+// each application identity gets its own pool, named after its service account, with a single provider
+const oidcFederationProviderID = "oidc"
+
+func workloadIdentityPoolName(config *ApplicationIdentityConfig) string {
+	return fmt.Sprintf("projects/%s/locations/global/workloadIdentityPools/%s", config.Project, config.Name)
+}
+
+func workloadIdentityPoolProviderName(config *ApplicationIdentityConfig) string {
+	return fmt.Sprintf("%s/providers/%s", workloadIdentityPoolName(config), oidcFederationProviderID)
+}
+
+// oidcFederationMember is every identity of the pool. The provider's attribute condition limits them to the configured subject.
+func oidcFederationMember(projectNumber int64, config *ApplicationIdentityConfig) string {
+	return fmt.Sprintf("principalSet://iam.googleapis.com/projects/%d/locations/global/workloadIdentityPools/%s/*", projectNumber, config.Name)
+}
+
+// oidcAttributeCondition translates the subject into a CEL condition on the sub claim
+func oidcAttributeCondition(subject string) string {
+	if !strings.Contains(subject, "*") {
+		return fmt.Sprintf("assertion.sub == %s", strconv.Quote(subject))
+	}
+
+	parts := strings.Split(subject, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	return fmt.Sprintf("assertion.sub.matches(%s)", strconv.Quote("^"+strings.Join(parts, ".*")+"$"))
+}
+
+// oidcSubjectFromAttributeCondition is the reverse of oidcAttributeCondition. A condition it didn't generate is
+// returned as is.
+func oidcSubjectFromAttributeCondition(condition string) string {
+	var subject string
+	switch {
+	case strings.HasPrefix(condition, "assertion.sub == "):
+		unquoted, err := strconv.Unquote(strings.TrimPrefix(condition, "assertion.sub == "))
+		if err != nil {
+			return condition
+		}
+		subject = unquoted
+	case strings.HasPrefix(condition, "assertion.sub.matches(") && strings.HasSuffix(condition, ")"):
+		pattern, err := strconv.Unquote(strings.TrimSuffix(strings.TrimPrefix(condition, "assertion.sub.matches("), ")"))
+		if err != nil || !strings.HasPrefix(pattern, "^") || !strings.HasSuffix(pattern, "$") {
+			return condition
+		}
+		parts := strings.Split(pattern[1:len(pattern)-1], ".*")
+		for i, part := range parts {
+			parts[i] = unquoteMeta(part)
+		}
+		subject = strings.Join(parts, "*")
+	default:
+		return condition
+	}
+
+	if oidcAttributeCondition(subject) != condition {
+		return condition
+	}
+	return subject
+}
+
+// unquoteMeta undoes regexp.QuoteMeta
+func unquoteMeta(quoted string) string {
+	var unquoted strings.Builder
+	escaped := false
+	for _, r := range quoted {
+		if r == '\\' && !escaped {
+			escaped = true
+			continue
+		}
+		escaped = false
+		unquoted.WriteRune(r)
+	}
+	return unquoted.String()
+}
+
+func oidcWorkloadIdentityPoolProvider(config *ApplicationIdentityConfig) *iam.WorkloadIdentityPoolProvider {
+	provider := &iam.WorkloadIdentityPoolProvider{
+		DisplayName: config.Name,
+		AttributeMapping: map[string]string{
+			"google.subject": "assertion.sub",
+		},
+		AttributeCondition: oidcAttributeCondition(config.OIDCFederation.Subject),
+		Oidc: &iam.Oidc{
+			IssuerUri: config.OIDCFederation.Issuer,
+		},
+	}
+	if config.OIDCFederation.Audience != "" {
+		provider.Oidc.AllowedAudiences = []string{config.OIDCFederation.Audience}
+	}
+	return provider
+}
+
+// createOIDCFederation creates the workload identity pool and provider and allows the pool to impersonate
+// the service account. Pools and providers are only soft deleted, so ones left over from a previous identity
+// of the same name are restored instead.
+func createOIDCFederation(ctx context.Context, config *ApplicationIdentityConfig, client GCPIamIface, rmClient GCPResourceManagerIface, poolsClient GCPWorkloadIdentityPoolsIface, providersClient GCPWorkloadIdentityPoolProvidersIface) error {
+	project, errProject := rmClient.Get(config.Project).Do()
+	if errProject != nil {
+		return fmt.Errorf("reading project %s: %w", config.Project, errProject)
+	}
+
+	poolName := workloadIdentityPoolName(config)
+	_, errPool := poolsClient.Create(fmt.Sprintf("projects/%s/locations/global", config.Project), &iam.WorkloadIdentityPool{
+		DisplayName: config.Name,
+	}).WorkloadIdentityPoolId(config.Name).Do()
+	if errPool != nil {
+		if !thirdparty.IsConflictError(errPool) {
+			return fmt.Errorf("creating workload identity pool %s: %w", poolName, errPool)
+		}
+		if _, errUndelete := poolsClient.Undelete(poolName, &iam.UndeleteWorkloadIdentityPoolRequest{}).Do(); errUndelete != nil && !isBadRequestError(errUndelete) {
+			return fmt.Errorf("restoring workload identity pool %s: %w", poolName, errUndelete)
+		}
+	}
+	errWait := retry(5, time.Second, func() error {
+		_, errGet := poolsClient.Get(poolName).Do()
+		return errGet
+	})
+	if errWait != nil {
+		return errWait
+	}
+
+	providerName := workloadIdentityPoolProviderName(config)
+	_, errProvider := providersClient.Create(poolName, oidcWorkloadIdentityPoolProvider(config)).WorkloadIdentityPoolProviderId(oidcFederationProviderID).Do()
+	if errProvider != nil {
+		if !thirdparty.IsConflictError(errProvider) {
+			return fmt.Errorf("creating workload identity pool provider %s: %w", providerName, errProvider)
+		}
+		if _, errUndelete := providersClient.Undelete(providerName, &iam.UndeleteWorkloadIdentityPoolProviderRequest{}).Do(); errUndelete != nil && !isBadRequestError(errUndelete) {
+			return fmt.Errorf("restoring workload identity pool provider %s: %w", providerName, errUndelete)
+		}
+		if errPatch := updateOIDCFederation(ctx, config, providersClient); errPatch != nil {
+			return errPatch
+		}
+	}
+	errWait = retry(5, time.Second, func() error {
+		_, errGet := providersClient.Get(providerName).Do()
+		return errGet
+	})
+	if errWait != nil {
+		return errWait
+	}
+
+	config.WorkloadIdentityProvider = fmt.Sprintf("projects/%d/locations/global/workloadIdentityPools/%s/providers/%s", project.ProjectNumber, config.Name, oidcFederationProviderID)
+	return updateServiceAccountRoleMembers(ctx, config, workloadIdentityUserRole, nil, []string{oidcFederationMember(project.ProjectNumber, config)}, client)
+}
+
+// readOIDCFederation refreshes the issuer, audience and subject from the provider, and clears them
+// when the provider was deleted outside of Terraform
+func readOIDCFederation(ctx context.Context, config *ApplicationIdentityConfig, providersClient GCPWorkloadIdentityPoolProvidersIface) error {
+	provider, err := providersClient.Get(workloadIdentityPoolProviderName(config)).Do()
+	if err != nil {
+		if isNotFoundError(err) {
+			config.OIDCFederation = nil
+			config.WorkloadIdentityProvider = ""
+			return nil
+		}
+		return err
+	}
+	if provider.State == "DELETED" || provider.Oidc == nil {
+		config.OIDCFederation = nil
+		config.WorkloadIdentityProvider = ""
+		return nil
+	}
+
+	if config.WorkloadIdentityProvider == "" {
+		config.WorkloadIdentityProvider = provider.Name
+	}
+	config.OIDCFederation.Issuer = provider.Oidc.IssuerUri
+	config.OIDCFederation.Audience = strings.Join(provider.Oidc.AllowedAudiences, ",")
+	if provider.AttributeCondition != oidcAttributeCondition(config.OIDCFederation.Subject) {
+		// a condition changed outside of Terraform can't be translated back, show it as the subject to surface the drift
+		config.OIDCFederation.Subject = provider.AttributeCondition
+	}
+
+	return nil
+}
+
+func updateOIDCFederation(ctx context.Context, config *ApplicationIdentityConfig, providersClient GCPWorkloadIdentityPoolProvidersIface) error {
+	providerName := workloadIdentityPoolProviderName(config)
+	_, err := providersClient.Patch(providerName, oidcWorkloadIdentityPoolProvider(config)).UpdateMask("attributeCondition,attributeMapping,oidc").Do()
+	if err != nil {
+		return fmt.Errorf("updating workload identity pool provider %s: %w", providerName, err)
+	}
+	return nil
+}
+
+// deleteOIDCFederation removes the pool from the service account and deletes the provider and pool
+func deleteOIDCFederation(ctx context.Context, config *ApplicationIdentityConfig, client GCPIamIface, rmClient GCPResourceManagerIface, poolsClient GCPWorkloadIdentityPoolsIface, providersClient GCPWorkloadIdentityPoolProvidersIface) error {
+	project, errProject := rmClient.Get(config.Project).Do()
+	if errProject != nil {
+		return fmt.Errorf("reading project %s: %w", config.Project, errProject)
+	}
+	if errRemove := updateServiceAccountRoleMembers(ctx, config, workloadIdentityUserRole, []string{oidcFederationMember(project.ProjectNumber, config)}, nil, client); errRemove != nil {
+		return errRemove
+	}
+
+	providerName := workloadIdentityPoolProviderName(config)
+	if _, err := providersClient.Delete(providerName).Do(); err != nil && !isNotFoundError(err) {
+		return fmt.Errorf("deleting workload identity pool provider %s: %w", providerName, err)
+	}
+	poolName := workloadIdentityPoolName(config)
+	if _, err := poolsClient.Delete(poolName).Do(); err != nil && !isNotFoundError(err) {
+		return fmt.Errorf("deleting workload identity pool %s: %w", poolName, err)
+	}
+
+	config.WorkloadIdentityProvider = ""
+	return nil
+}
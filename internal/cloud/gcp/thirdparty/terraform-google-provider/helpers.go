@@ -43,6 +43,20 @@ func RemoveBinding(bindings []*cloudresourcemanager.Binding, binding *cloudresou
 	return subtractFromBindings(bindings, binding)
 }
 
+// Whether all members of the given Binding are bound to its role+condition
+func HasBinding(bindings []*cloudresourcemanager.Binding, binding *cloudresourcemanager.Binding) bool {
+	members, ok := createIamBindingsMap(bindings)[iamBindingKey{binding.Role, conditionKeyFromCondition(binding.Condition)}]
+	if !ok {
+		return false
+	}
+	for _, m := range binding.Members {
+		if _, ok := members[m]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
 // Removes given role+condition/bound-member pairs from the given Bindings (i.e subtraction).
 func subtractFromBindings(bindings []*cloudresourcemanager.Binding, toRemove ...*cloudresourcemanager.Binding) []*cloudresourcemanager.Binding {
 	currMap := createIamBindingsMap(bindings)
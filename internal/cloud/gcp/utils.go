@@ -1,7 +1,11 @@
 package gcp
 
 import (
+	"errors"
+	"net/http"
 	"time"
+
+	"google.golang.org/api/googleapi"
 )
 
 type stop struct {
@@ -23,3 +27,14 @@ func retry(attempts int, sleep time.Duration, fn func() error) error {
 	}
 	return nil
 }
+
+func isNotFoundError(err error) bool {
+	var e *googleapi.Error
+	return errors.As(err, &e) && e.Code == http.StatusNotFound
+}
+
+// e.g. restoring a workload identity pool that isn't deleted
+func isBadRequestError(err error) bool {
+	e, ok := err.(*googleapi.Error)
+	return ok && e.Code == http.StatusBadRequest
+}
@@ -0,0 +1,98 @@
+package gcp
+
+import (
+	"context"
+	"fmt"
+)
+
+// workloadServiceAgents maps the GCP workload presets to the Google service agent that runs them.
+// The kubernetes preset is served by the Kubernetes configuration instead.
+var workloadServiceAgents = map[string]string{
+	"cloud_run": "serverless-robot-prod",
+	"compute":   "compute-system",
+}
+
+func validateWorkload(config *ApplicationIdentityConfig) error {
+	if config.Workload == "" {
+		return nil
+	}
+	if config.Workload == "kubernetes" {
+		if len(config.KubernetesSubjects) == 0 {
+			return fmt.Errorf("workload kubernetes requires kubernetes to be configured")
+		}
+		return nil
+	}
+	if _, ok := workloadServiceAgents[config.Workload]; !ok {
+		return fmt.Errorf("workload %s is not supported on GCP", config.Workload)
+	}
+	return nil
+}
+
+// A workload runs as a service account of its own project through the actAs permission of whoever deploys it.
+// A workload in another project runs as it through its service agent, which needs to create tokens for it.
+// https://cloud.google.com/run/docs/configuring/services/service-identity#cross-project
+const serviceAccountTokenCreatorRole = "roles/iam.serviceAccountTokenCreator"
+
+// workloadServiceAgentMember returns the service agent member of the workload in workloadProject, or "" when
+// it needs no binding
+func workloadServiceAgentMember(config *ApplicationIdentityConfig, workload string, workloadProject string, rmClient GCPResourceManagerIface) (string, error) {
+	agent, ok := workloadServiceAgents[workload]
+	if !ok || workloadProject == "" || workloadProject == config.Project {
+		return "", nil
+	}
+	project, err := rmClient.Get(workloadProject).Do()
+	if err != nil {
+		return "", fmt.Errorf("reading project %s: %w", workloadProject, err)
+	}
+	return fmt.Sprintf("serviceAccount:service-%d@%s.iam.gserviceaccount.com", project.ProjectNumber, agent), nil
+}
+
+// updateWorkloadServiceAgent moves the token creator binding from the service agent of the previous workload
+// to the one of the current workload
+func updateWorkloadServiceAgent(ctx context.Context, config *ApplicationIdentityConfig, previousWorkload string, previousProject string, currentWorkload string, currentProject string, client GCPIamIface, rmClient GCPResourceManagerIface) error {
+	if previousWorkload == currentWorkload && previousProject == currentProject {
+		return nil
+	}
+	if err := validateWorkload(config); err != nil {
+		return err
+	}
+
+	previousMember, errPrevious := workloadServiceAgentMember(config, previousWorkload, previousProject, rmClient)
+	if errPrevious != nil {
+		return errPrevious
+	}
+	currentMember, errCurrent := workloadServiceAgentMember(config, currentWorkload, currentProject, rmClient)
+	if errCurrent != nil {
+		return errCurrent
+	}
+	if previousMember == currentMember {
+		return nil
+	}
+
+	previousMembers := []string{}
+	if previousMember != "" {
+		previousMembers = append(previousMembers, previousMember)
+	}
+	currentMembers := []string{}
+	if currentMember != "" {
+		currentMembers = append(currentMembers, currentMember)
+	}
+	return updateServiceAccountRoleMembers(ctx, config, serviceAccountTokenCreatorRole, previousMembers, currentMembers, client)
+}
+
+// readWorkloadServiceAgent clears the workload when its service agent binding was removed outside of Terraform
+func readWorkloadServiceAgent(ctx context.Context, config *ApplicationIdentityConfig, client GCPIamIface, rmClient GCPResourceManagerIface) error {
+	member, err := workloadServiceAgentMember(config, config.Workload, config.WorkloadProject, rmClient)
+	if err != nil || member == "" {
+		return err
+	}
+
+	policy, err := client.GetIamPolicy(serviceAccountResourceName(config)).Do()
+	if err != nil {
+		return err
+	}
+	if !hasServiceAccountBindingMember(policy, serviceAccountTokenCreatorRole, member) {
+		config.Workload = ""
+	}
+	return nil
+}
@@ -2,38 +2,72 @@ package mdxc
 
 import (
 	"context"
+	"fmt"
+	"strings"
 	"terraform-provider-mdxc/internal/cloud/aws"
 	"terraform-provider-mdxc/internal/cloud/azure"
 	"terraform-provider-mdxc/internal/cloud/gcp"
+	"terraform-provider-mdxc/internal/verify"
 
+	"github.com/hashicorp/terraform-plugin-framework/attr"
 	"github.com/hashicorp/terraform-plugin-framework/diag"
 	"github.com/hashicorp/terraform-plugin-framework/types"
 )
 
 type AWSApplicationIdentityInputData struct {
-	AssumeRolePolicy types.String `tfsdk:"assume_role_policy"`
+	AssumeRolePolicy      types.String                     `tfsdk:"assume_role_policy"`
+	Path                  types.String                     `tfsdk:"path"`
+	Description           types.String                     `tfsdk:"description"`
+	MaxSessionDuration    types.Int64                      `tfsdk:"max_session_duration"`
+	PermissionsBoundary   types.String                     `tfsdk:"permissions_boundary"`
+	Tags                  types.Map                        `tfsdk:"tags"`
+	Kubernetes            []AWSKubernetesIdentityInputData `tfsdk:"kubernetes"`
+	PodIdentity           *AWSPodIdentityInputData         `tfsdk:"pod_identity"`
+	CreateInstanceProfile types.Bool                       `tfsdk:"create_instance_profile"`
 }
-type GCPApplicationIdentityInputData struct {
-	Kubernetes *GCPKubernetesIdentityInputData `tfsdk:"kubernetes"`
+type AWSKubernetesIdentityInputData struct {
+	OIDCProviderARN    types.String `tfsdk:"oidc_provider_arn"`
+	Namespace          types.String `tfsdk:"namespace"`
+	ServiceAccountName types.String `tfsdk:"service_account_name"`
 }
-type GCPKubernetesIdentityInputData struct {
+type AWSPodIdentityInputData struct {
+	ClusterName        types.String `tfsdk:"cluster_name"`
 	Namespace          types.String `tfsdk:"namespace"`
 	ServiceAccountName types.String `tfsdk:"service_account_name"`
 }
+type GCPApplicationIdentityInputData struct {
+	Kubernetes      []GCPKubernetesIdentityInputData `tfsdk:"kubernetes"`
+	WorkloadProject types.String                     `tfsdk:"workload_project"`
+}
+type GCPKubernetesIdentityInputData struct {
+	Namespace            types.String `tfsdk:"namespace"`
+	ServiceAccountName   types.String `tfsdk:"service_account_name"`
+	WorkloadIdentityPool types.String `tfsdk:"workload_identity_pool"`
+}
 
 type AzureApplicationIdentityInputData struct {
-	Location          types.String                      `tfsdk:"location"`
-	ResourceGroupName types.String                      `tfsdk:"resource_group_name"`
-	Kubernetes        *AzureKubernetesIdentityInputData `tfsdk:"kubernetes"`
+	Location          types.String                       `tfsdk:"location"`
+	ResourceGroupName types.String                       `tfsdk:"resource_group_name"`
+	Kubernetes        []AzureKubernetesIdentityInputData `tfsdk:"kubernetes"`
 }
 type AzureKubernetesIdentityInputData struct {
 	Namespace          types.String `tfsdk:"namespace"`
 	ServiceAccountName types.String `tfsdk:"service_account_name"`
 	OIDCURL            types.String `tfsdk:"oidc_issuer_url"`
+	Audiences          types.List   `tfsdk:"audiences"`
+}
+
+// OIDCFederationData is shared by every cloud
+type OIDCFederationData struct {
+	Issuer   types.String `tfsdk:"issuer"`
+	Audience types.String `tfsdk:"audience"`
+	Subject  types.String `tfsdk:"subject"`
 }
 
 type AWSApplicationIdentityOutputData struct {
-	IAMRoleARN types.String `tfsdk:"iam_role_arn"`
+	IAMRoleARN                types.String `tfsdk:"iam_role_arn"`
+	PodIdentityAssociationARN types.String `tfsdk:"pod_identity_association_arn"`
+	InstanceProfileARN        types.String `tfsdk:"instance_profile_arn"`
 }
 type AzureApplicationIdentityOutputData struct {
 	ClientID   types.String `tfsdk:"client_id"`
@@ -41,29 +75,105 @@ type AzureApplicationIdentityOutputData struct {
 	ResourceID types.String `tfsdk:"resource_id"`
 }
 type GCPApplicationIdentityOutputData struct {
-	ServiceAccountEmail types.String `tfsdk:"service_account_email"`
+	ServiceAccountEmail      types.String `tfsdk:"service_account_email"`
+	UniqueID                 types.String `tfsdk:"unique_id"`
+	WorkloadIdentityProvider types.String `tfsdk:"workload_identity_provider"`
 }
 
 type ApplicationIdentityData struct {
-	Id          types.String                        `tfsdk:"id"`
-	Name        types.String                        `tfsdk:"name"`
-	Cloud       types.String                        `tfsdk:"cloud"`
-	AWSInput    *AWSApplicationIdentityInputData    `tfsdk:"aws_configuration"`
-	AzureInput  *AzureApplicationIdentityInputData  `tfsdk:"azure_configuration"`
-	GCPInput    *GCPApplicationIdentityInputData    `tfsdk:"gcp_configuration"`
-	AWSOutput   *AWSApplicationIdentityOutputData   `tfsdk:"aws_application_identity"`
-	AzureOutput *AzureApplicationIdentityOutputData `tfsdk:"azure_application_identity"`
-	GCPOutput   *GCPApplicationIdentityOutputData   `tfsdk:"gcp_application_identity"`
+	Id                                  types.String                        `tfsdk:"id"`
+	Name                                types.String                        `tfsdk:"name"`
+	Cloud                               types.String                        `tfsdk:"cloud"`
+	Principal                           types.String                        `tfsdk:"principal"`
+	PrincipalType                       types.String                        `tfsdk:"principal_type"`
+	ForceDetachOnDestroy                types.Bool                          `tfsdk:"force_detach_on_destroy"`
+	Workload                            types.String                        `tfsdk:"workload"`
+	KubernetesServiceAccountAnnotations types.Map                           `tfsdk:"kubernetes_service_account_annotations"`
+	KubernetesPodLabels                 types.Map                           `tfsdk:"kubernetes_pod_labels"`
+	KubernetesServiceAccountManifest    types.String                        `tfsdk:"kubernetes_service_account_manifest"`
+	OIDCFederation                      *OIDCFederationData                 `tfsdk:"oidc_federation"`
+	AWSInput                            *AWSApplicationIdentityInputData    `tfsdk:"aws_configuration"`
+	AzureInput                          *AzureApplicationIdentityInputData  `tfsdk:"azure_configuration"`
+	GCPInput                            *GCPApplicationIdentityInputData    `tfsdk:"gcp_configuration"`
+	AWSOutput                           *AWSApplicationIdentityOutputData   `tfsdk:"aws_application_identity"`
+	AzureOutput                         *AzureApplicationIdentityOutputData `tfsdk:"azure_application_identity"`
+	GCPOutput                           *GCPApplicationIdentityOutputData   `tfsdk:"gcp_application_identity"`
+}
+
+// ApplicationIdentityDataV0 is the state of schema version 0, when azure_configuration.kubernetes and
+// gcp_configuration.kubernetes were a single service account instead of a set
+type ApplicationIdentityDataV0 struct {
+	Id                                  types.String                         `tfsdk:"id"`
+	Name                                types.String                         `tfsdk:"name"`
+	Cloud                               types.String                         `tfsdk:"cloud"`
+	Principal                           types.String                         `tfsdk:"principal"`
+	PrincipalType                       types.String                         `tfsdk:"principal_type"`
+	ForceDetachOnDestroy                types.Bool                           `tfsdk:"force_detach_on_destroy"`
+	Workload                            types.String                         `tfsdk:"workload"`
+	KubernetesServiceAccountAnnotations types.Map                            `tfsdk:"kubernetes_service_account_annotations"`
+	KubernetesPodLabels                 types.Map                            `tfsdk:"kubernetes_pod_labels"`
+	KubernetesServiceAccountManifest    types.String                         `tfsdk:"kubernetes_service_account_manifest"`
+	OIDCFederation                      *OIDCFederationData                  `tfsdk:"oidc_federation"`
+	AWSInput                            *AWSApplicationIdentityInputData     `tfsdk:"aws_configuration"`
+	AzureInput                          *AzureApplicationIdentityInputDataV0 `tfsdk:"azure_configuration"`
+	GCPInput                            *GCPApplicationIdentityInputDataV0   `tfsdk:"gcp_configuration"`
+	AWSOutput                           *AWSApplicationIdentityOutputData    `tfsdk:"aws_application_identity"`
+	AzureOutput                         *AzureApplicationIdentityOutputData  `tfsdk:"azure_application_identity"`
+	GCPOutput                           *GCPApplicationIdentityOutputData    `tfsdk:"gcp_application_identity"`
+}
+type AzureApplicationIdentityInputDataV0 struct {
+	Location          types.String                      `tfsdk:"location"`
+	ResourceGroupName types.String                      `tfsdk:"resource_group_name"`
+	Kubernetes        *AzureKubernetesIdentityInputData `tfsdk:"kubernetes"`
+}
+type GCPApplicationIdentityInputDataV0 struct {
+	Kubernetes *GCPKubernetesIdentityInputData `tfsdk:"kubernetes"`
+}
+
+// UpgradeApplicationIdentityV0 wraps the Kubernetes service account of schema version 0 in a one-element set
+func UpgradeApplicationIdentityV0(prior *ApplicationIdentityDataV0, d *ApplicationIdentityData) {
+	*d = ApplicationIdentityData{
+		Id:                                  prior.Id,
+		Name:                                prior.Name,
+		Cloud:                               prior.Cloud,
+		Principal:                           prior.Principal,
+		PrincipalType:                       prior.PrincipalType,
+		ForceDetachOnDestroy:                prior.ForceDetachOnDestroy,
+		Workload:                            prior.Workload,
+		KubernetesServiceAccountAnnotations: prior.KubernetesServiceAccountAnnotations,
+		KubernetesPodLabels:                 prior.KubernetesPodLabels,
+		KubernetesServiceAccountManifest:    prior.KubernetesServiceAccountManifest,
+		OIDCFederation:                      prior.OIDCFederation,
+		AWSInput:                            prior.AWSInput,
+		AWSOutput:                           prior.AWSOutput,
+		AzureOutput:                         prior.AzureOutput,
+		GCPOutput:                           prior.GCPOutput,
+	}
+	if prior.AzureInput != nil {
+		d.AzureInput = &AzureApplicationIdentityInputData{
+			Location:          prior.AzureInput.Location,
+			ResourceGroupName: prior.AzureInput.ResourceGroupName,
+		}
+		if prior.AzureInput.Kubernetes != nil {
+			d.AzureInput.Kubernetes = []AzureKubernetesIdentityInputData{*prior.AzureInput.Kubernetes}
+		}
+	}
+	if prior.GCPInput != nil {
+		d.GCPInput = &GCPApplicationIdentityInputData{WorkloadProject: types.String{Null: true}}
+		if prior.GCPInput.Kubernetes != nil {
+			d.GCPInput.Kubernetes = []GCPKubernetesIdentityInputData{*prior.GCPInput.Kubernetes}
+		}
+	}
 }
 
 func (c *MDXCClient) CreateApplicationIdentity(ctx context.Context, d *ApplicationIdentityData) diag.Diagnostics {
 	switch c.Cloud {
 	case "aws":
-		return runApplicationIdentityFunctionAWS(aws.CreateApplicationIdentity, ctx, d, c.AWSConfig)
+		return runApplicationIdentityFunctionAWS(aws.CreateApplicationIdentity, ctx, d, c.AWSConfig, false)
 	case "azure":
-		return runApplicationIdentityFunctionAzure(azure.CreateApplicationIdentity, ctx, d, c.AzureConfig)
+		return runApplicationIdentityFunctionAzure(azure.CreateApplicationIdentity, ctx, d, c.AzureConfig, false)
 	case "gcp":
-		return runApplicationIdentityFunctionGCP(gcp.CreateApplicationIdentity, ctx, d, c.GCPConfig)
+		return runApplicationIdentityFunctionGCP(gcp.CreateApplicationIdentity, ctx, d, c.GCPConfig, false)
 	}
 	return diag.Diagnostics{diag.NewErrorDiagnostic("Cloud not supported", "Provider does not support specified cloud: "+c.Cloud)}
 }
@@ -71,103 +181,367 @@ func (c *MDXCClient) CreateApplicationIdentity(ctx context.Context, d *Applicati
 func (c *MDXCClient) ReadApplicationIdentity(ctx context.Context, d *ApplicationIdentityData) diag.Diagnostics {
 	switch c.Cloud {
 	case "aws":
-		return runApplicationIdentityFunctionAWS(aws.ReadApplicationIdentity, ctx, d, c.AWSConfig)
+		return runApplicationIdentityFunctionAWS(aws.ReadApplicationIdentity, ctx, d, c.AWSConfig, true)
 	case "azure":
-		return runApplicationIdentityFunctionAzure(azure.ReadApplicationIdentity, ctx, d, c.AzureConfig)
+		return runApplicationIdentityFunctionAzure(azure.ReadApplicationIdentity, ctx, d, c.AzureConfig, true)
 	case "gcp":
-		return runApplicationIdentityFunctionGCP(gcp.ReadApplicationIdentity, ctx, d, c.GCPConfig)
+		return runApplicationIdentityFunctionGCP(gcp.ReadApplicationIdentity, ctx, d, c.GCPConfig, true)
 	}
 	return diag.Diagnostics{diag.NewErrorDiagnostic("Cloud not supported", "Provider does not support specified cloud: "+c.Cloud)}
 }
 
-func (c *MDXCClient) UpdateApplicationIdentity(ctx context.Context, d *ApplicationIdentityData) diag.Diagnostics {
+// ImportApplicationIdentity fills d with the existing identity identified by id: an IAM role name or ARN on AWS,
+// a service account email or projects/{project}/serviceAccounts/{email} on GCP, a user-assigned identity resource ID on Azure
+func (c *MDXCClient) ImportApplicationIdentity(ctx context.Context, id string, d *ApplicationIdentityData) diag.Diagnostics {
+	d.Id = types.String{Value: id}
+	d.ForceDetachOnDestroy = types.Bool{Null: true}
+	d.Workload = types.String{Null: true}
+
+	var diags diag.Diagnostics
+	switch c.Cloud {
+	case "aws":
+		diags = runApplicationIdentityFunctionAWS(withImportApplicationIdentityAWS(id, d), ctx, d, c.AWSConfig, false)
+	case "azure":
+		diags = runApplicationIdentityFunctionAzure(withImportApplicationIdentityAzure(d), ctx, d, c.AzureConfig, false)
+	case "gcp":
+		diags = runApplicationIdentityFunctionGCP(withImportApplicationIdentityGCP(d), ctx, d, c.GCPConfig, false)
+	default:
+		return diag.Diagnostics{diag.NewErrorDiagnostic("Cloud not supported", "Provider does not support specified cloud: "+c.Cloud)}
+	}
+	return diags
+}
+
+// UpdateApplicationIdentity applies the planned identity d. prior is the current state, used to find
+// cloud resources whose identifiers are replaced by the update.
+func (c *MDXCClient) UpdateApplicationIdentity(ctx context.Context, prior *ApplicationIdentityData, d *ApplicationIdentityData) diag.Diagnostics {
 	switch c.Cloud {
 	case "aws":
-		return runApplicationIdentityFunctionAWS(aws.UpdateApplicationIdentity, ctx, d, c.AWSConfig)
+		carryForwardApplicationIdentityOutputsAWS(prior, d)
+		return runApplicationIdentityFunctionAWS(aws.UpdateApplicationIdentity, ctx, d, c.AWSConfig, false)
 	case "azure":
-		return runApplicationIdentityFunctionAzure(azure.UpdateApplicationIdentity, ctx, d, c.AzureConfig)
+		return runApplicationIdentityFunctionAzure(withPriorApplicationIdentityAzure(prior, azure.UpdateApplicationIdentity), ctx, d, c.AzureConfig, false)
 	case "gcp":
-		return runApplicationIdentityFunctionGCP(gcp.UpdateApplicationIdentity, ctx, d, c.GCPConfig)
+		return runApplicationIdentityFunctionGCP(withPriorApplicationIdentityGCP(prior, gcp.UpdateApplicationIdentity), ctx, d, c.GCPConfig, false)
 	}
 	return diag.Diagnostics{diag.NewErrorDiagnostic("Cloud not supported", "Provider does not support specified cloud: "+c.Cloud)}
 }
 
+// PlanApplicationIdentity sets the AWS trust policy of the planned identity d to the one generated from its inputs
+// when the two aren't equivalent, so a generated trust policy changed outside of Terraform plans an update
+func (c *MDXCClient) PlanApplicationIdentity(ctx context.Context, d *ApplicationIdentityData) diag.Diagnostics {
+	if c.Cloud != "aws" || d.AWSInput == nil {
+		return nil
+	}
+
+	a := aws.ApplicationIdentityConfig{}
+	convertApplicationIdentityConfigTerraformToAWS(d, &a)
+	generated, err := aws.GenerateAssumeRolePolicy(ctx, &a, c.AWSConfig.NewIAMService())
+	if err != nil {
+		return cloudFunctionDiagnostics(err, &d.Id, false)
+	}
+	if generated != "" && !verify.PoliciesAreEquivalent(d.AWSInput.AssumeRolePolicy.Value, generated) {
+		d.AWSInput.AssumeRolePolicy = types.String{Value: generated}
+	}
+	return nil
+}
+
 func (c *MDXCClient) DeleteApplicationIdentity(ctx context.Context, d *ApplicationIdentityData) diag.Diagnostics {
 	switch c.Cloud {
 	case "aws":
-		return runApplicationIdentityFunctionAWS(aws.DeleteApplicationIdentity, ctx, d, c.AWSConfig)
+		return runApplicationIdentityFunctionAWS(aws.DeleteApplicationIdentity, ctx, d, c.AWSConfig, true)
 	case "azure":
-		return runApplicationIdentityFunctionAzure(azure.DeleteApplicationIdentity, ctx, d, c.AzureConfig)
+		return runApplicationIdentityFunctionAzure(azure.DeleteApplicationIdentity, ctx, d, c.AzureConfig, true)
 	case "gcp":
-		return runApplicationIdentityFunctionGCP(gcp.DeleteApplicationIdentity, ctx, d, c.GCPConfig)
+		return runApplicationIdentityFunctionGCP(gcp.DeleteApplicationIdentity, ctx, d, c.GCPConfig, true)
 	}
 	return diag.Diagnostics{diag.NewErrorDiagnostic("Cloud not supported", "Provider does not support specified cloud: "+c.Cloud)}
 }
 
+func detachedDependenciesDiagnostics(detached []string) diag.Diagnostics {
+	if len(detached) == 0 {
+		return nil
+	}
+	return diag.Diagnostics{
+		diag.NewWarningDiagnostic(
+			"Detached dependencies before deleting application identity",
+			"force_detach_on_destroy removed the following:\n  - "+strings.Join(detached, "\n  - "),
+		),
+	}
+}
+
 // -------------- AWS --------------
-type applicationIdentityFunctionAWS func(context.Context, *aws.ApplicationIdentityConfig, aws.IAMClient) error
+type applicationIdentityFunctionAWS func(context.Context, *aws.ApplicationIdentityConfig, aws.IAMClient, aws.EKSClient) error
 
 func convertApplicationIdentityConfigTerraformToAWS(d *ApplicationIdentityData, a *aws.ApplicationIdentityConfig) {
 	a.Name = d.Name.Value
+	a.ForceDetachOnDestroy = d.ForceDetachOnDestroy.Value
+	a.Workload = d.Workload.Value
 	if d.AWSInput != nil {
 		a.AssumeRolePolicy = d.AWSInput.AssumeRolePolicy.Value
+		a.CreateInstanceProfile = d.AWSInput.CreateInstanceProfile.Value
+		a.Path = d.AWSInput.Path.Value
+		a.Description = d.AWSInput.Description.Value
+		a.MaxSessionDuration = int32(d.AWSInput.MaxSessionDuration.Value)
+		a.PermissionsBoundary = d.AWSInput.PermissionsBoundary.Value
+		a.Tags = map[string]string{}
+		for key, value := range d.AWSInput.Tags.Elems {
+			a.Tags[key] = value.(types.String).Value
+		}
+
+		for _, subject := range d.AWSInput.Kubernetes {
+			a.KubernetesSubjects = append(a.KubernetesSubjects, aws.KubernetesSubject{
+				OIDCProviderARN:    subject.OIDCProviderARN.Value,
+				Namespace:          subject.Namespace.Value,
+				ServiceAccountName: subject.ServiceAccountName.Value,
+			})
+		}
+
+		if d.AWSInput.PodIdentity != nil {
+			a.PodIdentityClusterName = d.AWSInput.PodIdentity.ClusterName.Value
+			a.PodIdentityNamespace = d.AWSInput.PodIdentity.Namespace.Value
+			a.PodIdentityServiceAccountName = d.AWSInput.PodIdentity.ServiceAccountName.Value
+		}
+	}
+	if d.OIDCFederation != nil {
+		a.OIDCFederation = &aws.OIDCFederation{
+			Issuer:   d.OIDCFederation.Issuer.Value,
+			Audience: d.OIDCFederation.Audience.Value,
+			Subject:  d.OIDCFederation.Subject.Value,
+		}
 	}
 	if d.AWSOutput != nil {
 		a.IAMRoleARN = d.AWSOutput.IAMRoleARN.Value
+		a.PodIdentityAssociationARN = d.AWSOutput.PodIdentityAssociationARN.Value
+		a.InstanceProfileARN = d.AWSOutput.InstanceProfileARN.Value
+	}
+}
+
+// the association and instance profile ARNs are unknown in the plan when they are replaced, so pick them up from state
+func carryForwardApplicationIdentityOutputsAWS(prior *ApplicationIdentityData, d *ApplicationIdentityData) {
+	if prior == nil || prior.AWSOutput == nil {
+		return
+	}
+	if d.AWSOutput == nil {
+		d.AWSOutput = &AWSApplicationIdentityOutputData{}
+	}
+	d.AWSOutput.PodIdentityAssociationARN = prior.AWSOutput.PodIdentityAssociationARN
+	d.AWSOutput.InstanceProfileARN = prior.AWSOutput.InstanceProfileARN
+}
+
+// withImportApplicationIdentityAWS imports the role named id, and sets the inputs only found on import in d
+func withImportApplicationIdentityAWS(id string, d *ApplicationIdentityData) applicationIdentityFunctionAWS {
+	return func(ctx context.Context, a *aws.ApplicationIdentityConfig, iamClient aws.IAMClient, eksClient aws.EKSClient) error {
+		a.Name = id
+		if err := aws.ImportApplicationIdentity(ctx, a, iamClient, eksClient); err != nil {
+			return err
+		}
+		d.Workload = types.String{Value: a.Workload, Null: a.Workload == ""}
+		d.AWSInput = &AWSApplicationIdentityInputData{
+			CreateInstanceProfile: types.Bool{Value: a.CreateInstanceProfile, Null: !a.CreateInstanceProfile},
+			Tags:                  types.Map{ElemType: types.StringType, Null: true},
+		}
+		for _, subject := range a.KubernetesSubjects {
+			d.AWSInput.Kubernetes = append(d.AWSInput.Kubernetes, AWSKubernetesIdentityInputData{
+				OIDCProviderARN:    types.String{Value: subject.OIDCProviderARN},
+				Namespace:          types.String{Value: subject.Namespace},
+				ServiceAccountName: types.String{Value: subject.ServiceAccountName},
+			})
+		}
+		return nil
 	}
 }
 
 func convertApplicationIdentityConfigAWSToTerraform(a *aws.ApplicationIdentityConfig, d *ApplicationIdentityData) {
 	d.Id = types.String{Value: a.IAMRoleARN}
 	d.Name = types.String{Value: a.Name}
-	if d.AWSInput == nil {
-		d.AWSInput = &AWSApplicationIdentityInputData{}
-	}
+	d.Cloud = types.String{Value: "aws"}
+	d.Principal = types.String{Value: a.IAMRoleARN}
+	d.PrincipalType = types.String{Value: "iam_role"}
 	if d.AWSOutput == nil {
 		d.AWSOutput = &AWSApplicationIdentityOutputData{}
 	}
-	d.AWSInput.AssumeRolePolicy = types.String{Value: a.AssumeRolePolicy}
+	// without aws_configuration the trust policy only comes from the workload, and there's nothing to read back
+	if d.AWSInput != nil {
+		d.AWSInput.AssumeRolePolicy = types.String{Value: a.AssumeRolePolicy}
+		if !a.CreateInstanceProfile && d.AWSInput.CreateInstanceProfile.Value {
+			// the instance profile was removed outside of Terraform
+			d.AWSInput.CreateInstanceProfile = types.Bool{Value: false}
+		}
+		d.AWSInput.Path = types.String{Value: a.Path}
+		d.AWSInput.Description = types.String{Value: a.Description, Null: a.Description == ""}
+		d.AWSInput.MaxSessionDuration = types.Int64{Value: int64(a.MaxSessionDuration)}
+		d.AWSInput.PermissionsBoundary = types.String{Value: a.PermissionsBoundary, Null: a.PermissionsBoundary == ""}
+		// tags = {} stays empty instead of turning null
+		d.AWSInput.Tags = types.Map{ElemType: types.StringType, Elems: map[string]attr.Value{}, Null: d.AWSInput.Tags.Null && len(a.Tags) == 0}
+		for key, value := range a.Tags {
+			d.AWSInput.Tags.Elems[key] = types.String{Value: value}
+		}
+		if a.PodIdentityClusterName == "" {
+			// the association was removed outside of Terraform
+			d.AWSInput.PodIdentity = nil
+		} else {
+			d.AWSInput.PodIdentity = &AWSPodIdentityInputData{
+				ClusterName:        types.String{Value: a.PodIdentityClusterName},
+				Namespace:          types.String{Value: a.PodIdentityNamespace},
+				ServiceAccountName: types.String{Value: a.PodIdentityServiceAccountName},
+			}
+		}
+	}
+	if a.OIDCFederation == nil {
+		d.OIDCFederation = nil
+	} else {
+		d.OIDCFederation = &OIDCFederationData{
+			Issuer:   types.String{Value: a.OIDCFederation.Issuer},
+			Audience: types.String{Value: a.OIDCFederation.Audience, Null: a.OIDCFederation.Audience == ""},
+			Subject:  types.String{Value: a.OIDCFederation.Subject},
+		}
+	}
 	d.AWSOutput.IAMRoleARN = types.String{Value: a.IAMRoleARN}
+	d.AWSOutput.PodIdentityAssociationARN = types.String{Value: a.PodIdentityAssociationARN, Null: a.PodIdentityAssociationARN == ""}
+	d.AWSOutput.InstanceProfileARN = types.String{Value: a.InstanceProfileARN, Null: a.InstanceProfileARN == ""}
+
+	// EKS Pod Identity needs no annotation, and IRSA would fail without the role trusting the cluster's OIDC provider
+	annotations := map[string]string{}
+	if len(a.KubernetesSubjects) > 0 {
+		annotations["eks.amazonaws.com/role-arn"] = a.IAMRoleARN
+	}
+	serviceAccounts := []kubernetesServiceAccount{}
+	for _, subject := range a.KubernetesSubjects {
+		serviceAccounts = append(serviceAccounts, kubernetesServiceAccount{namespace: subject.Namespace, name: subject.ServiceAccountName})
+	}
+	if a.PodIdentityClusterName != "" {
+		serviceAccounts = append(serviceAccounts, kubernetesServiceAccount{namespace: a.PodIdentityNamespace, name: a.PodIdentityServiceAccountName})
+	}
+	setKubernetesOutputs(d, annotations, nil, serviceAccounts)
 }
 
-func runApplicationIdentityFunctionAWS(function applicationIdentityFunctionAWS, ctx context.Context, d *ApplicationIdentityData, config *aws.AWSConfig) diag.Diagnostics {
+func runApplicationIdentityFunctionAWS(function applicationIdentityFunctionAWS, ctx context.Context, d *ApplicationIdentityData, config *aws.AWSConfig, removeIfNotFound bool) diag.Diagnostics {
 	var diags diag.Diagnostics
 	iamClient := config.NewIAMService()
+	eksClient := config.NewEKSService()
 	cloudApplicationIdentityConfig := aws.ApplicationIdentityConfig{}
 	convertApplicationIdentityConfigTerraformToAWS(d, &cloudApplicationIdentityConfig)
-	err := function(ctx, &cloudApplicationIdentityConfig, iamClient)
+	err := function(ctx, &cloudApplicationIdentityConfig, iamClient, eksClient)
 	if err != nil {
-		diags.Append(
-			diag.NewErrorDiagnostic(err.Error(), ""),
-		)
-		return diags
+		return cloudFunctionDiagnostics(err, &d.Id, removeIfNotFound)
 	}
+	diags.Append(detachedDependenciesDiagnostics(cloudApplicationIdentityConfig.DetachedDependencies)...)
 	convertApplicationIdentityConfigAWSToTerraform(&cloudApplicationIdentityConfig, d)
 	return diags
 }
 
 // -------------- Azure --------------
-type applicationIdentityFunctionAzure func(context.Context, *azure.ApplicationIdentityConfig, azure.ManagedIdentityClient, azure.FederatedIdentityCredentialClient) error
+type applicationIdentityFunctionAzure func(context.Context, *azure.ApplicationIdentityConfig, azure.ManagedIdentityClient, azure.FederatedIdentityCredentialClient, azure.RoleAssignmentsClient) error
 
 func convertApplicationIdentityConfigTerraformToAzure(d *ApplicationIdentityData, a *azure.ApplicationIdentityConfig) {
 	a.ID = d.Id.Value
 	a.Name = d.Name.Value
+	a.ForceDetachOnDestroy = d.ForceDetachOnDestroy.Value
+	a.Workload = d.Workload.Value
 
 	if d.AzureInput != nil {
 		a.Location = d.AzureInput.Location.Value
 		a.ResourceGroupName = d.AzureInput.ResourceGroupName.Value
 
-		if d.AzureInput.Kubernetes != nil {
-			a.KubernetesNamespace = d.AzureInput.Kubernetes.Namespace.Value
-			a.KubernetesServiceAccountName = d.AzureInput.Kubernetes.ServiceAccountName.Value
-			a.KubernetesOIDCURL = d.AzureInput.Kubernetes.OIDCURL.Value
+		a.KubernetesSubjects = convertKubernetesSubjectsTerraformToAzure(d.AzureInput.Kubernetes)
+	}
+	a.OIDCFederation = convertOIDCFederationTerraformToAzure(d.OIDCFederation)
+}
+
+func convertOIDCFederationTerraformToAzure(o *OIDCFederationData) *azure.OIDCFederation {
+	if o == nil {
+		return nil
+	}
+	return &azure.OIDCFederation{
+		Issuer:   o.Issuer.Value,
+		Audience: o.Audience.Value,
+		Subject:  o.Subject.Value,
+	}
+}
+
+func convertKubernetesSubjectsTerraformToAzure(kubernetes []AzureKubernetesIdentityInputData) []azure.KubernetesSubject {
+	subjects := []azure.KubernetesSubject{}
+	for _, subject := range kubernetes {
+		audiences := []string{}
+		for _, audience := range subject.Audiences.Elems {
+			audiences = append(audiences, audience.(types.String).Value)
 		}
+		if len(audiences) == 0 {
+			audiences = nil
+		}
+		subjects = append(subjects, azure.KubernetesSubject{
+			Namespace:          subject.Namespace.Value,
+			ServiceAccountName: subject.ServiceAccountName.Value,
+			OIDCIssuerURL:      subject.OIDCURL.Value,
+			Audiences:          audiences,
+		})
+	}
+	return subjects
+}
+
+// withPriorApplicationIdentityAzure passes the federated credentials in prior state to function, so they can be replaced
+func withPriorApplicationIdentityAzure(prior *ApplicationIdentityData, function applicationIdentityFunctionAzure) applicationIdentityFunctionAzure {
+	return func(ctx context.Context, a *azure.ApplicationIdentityConfig, client azure.ManagedIdentityClient, fedClient azure.FederatedIdentityCredentialClient, raClient azure.RoleAssignmentsClient) error {
+		if prior != nil && prior.AzureInput != nil {
+			a.PreviousKubernetesSubjects = convertKubernetesSubjectsTerraformToAzure(prior.AzureInput.Kubernetes)
+		}
+		if prior != nil {
+			a.PreviousOIDCFederation = convertOIDCFederationTerraformToAzure(prior.OIDCFederation)
+			a.PreviousWorkload = prior.Workload.Value
+		}
+		return function(ctx, a, client, fedClient, raClient)
+	}
+}
+
+// withImportApplicationIdentityAzure imports the identity with the resource ID in d, and sets the inputs only found on import in d
+func withImportApplicationIdentityAzure(d *ApplicationIdentityData) applicationIdentityFunctionAzure {
+	return func(ctx context.Context, a *azure.ApplicationIdentityConfig, client azure.ManagedIdentityClient, fedClient azure.FederatedIdentityCredentialClient, raClient azure.RoleAssignmentsClient) error {
+		if err := azure.ImportApplicationIdentity(ctx, a, client, fedClient, raClient); err != nil {
+			return err
+		}
+		d.AzureInput = &AzureApplicationIdentityInputData{
+			Location:          types.String{Value: a.Location},
+			ResourceGroupName: types.String{Value: a.ResourceGroupName},
+		}
+		return nil
 	}
 }
 
 func convertApplicationIdentityConfigAzureToTerraform(a *azure.ApplicationIdentityConfig, d *ApplicationIdentityData) {
 	d.Id = types.String{Value: a.ID}
 	d.Name = types.String{Value: a.Name}
+	d.Cloud = types.String{Value: "azure"}
+	d.Principal = types.String{Value: a.ID}
+	d.PrincipalType = types.String{Value: "managed_identity"}
+	d.Workload = types.String{Value: a.Workload, Null: a.Workload == ""}
+
+	if d.AzureInput != nil {
+		// subjects whose federated identity credential was deleted outside of Terraform are dropped
+		var kubernetes []AzureKubernetesIdentityInputData
+		for _, subject := range a.KubernetesSubjects {
+			audiences := types.List{ElemType: types.StringType, Null: len(subject.Audiences) == 0}
+			for _, audience := range subject.Audiences {
+				audiences.Elems = append(audiences.Elems, types.String{Value: audience})
+			}
+			kubernetes = append(kubernetes, AzureKubernetesIdentityInputData{
+				Namespace:          types.String{Value: subject.Namespace},
+				ServiceAccountName: types.String{Value: subject.ServiceAccountName},
+				OIDCURL:            types.String{Value: subject.OIDCIssuerURL},
+				Audiences:          audiences,
+			})
+		}
+		d.AzureInput.Kubernetes = kubernetes
+	}
+	if a.OIDCFederation == nil {
+		// removed outside of Terraform
+		d.OIDCFederation = nil
+	} else {
+		d.OIDCFederation = &OIDCFederationData{
+			Issuer:   types.String{Value: a.OIDCFederation.Issuer},
+			Audience: types.String{Value: a.OIDCFederation.Audience, Null: a.OIDCFederation.Audience == ""},
+			Subject:  types.String{Value: a.OIDCFederation.Subject},
+		}
+	}
 
 	if d.AzureOutput == nil {
 		d.AzureOutput = &AzureApplicationIdentityOutputData{}
@@ -175,9 +549,25 @@ func convertApplicationIdentityConfigAzureToTerraform(a *azure.ApplicationIdenti
 	d.AzureOutput.ClientID = types.String{Value: a.ClientID}
 	d.AzureOutput.TenantID = types.String{Value: a.TenantID}
 	d.AzureOutput.ResourceID = types.String{Value: a.ResourceID}
+
+	// https://azure.github.io/azure-workload-identity/docs/topics/service-account-labels-and-annotations.html
+	serviceAccounts := []kubernetesServiceAccount{}
+	for _, subject := range a.KubernetesSubjects {
+		serviceAccounts = append(serviceAccounts, kubernetesServiceAccount{namespace: subject.Namespace, name: subject.ServiceAccountName})
+	}
+	setKubernetesOutputs(d,
+		map[string]string{
+			"azure.workload.identity/client-id": a.ClientID,
+			"azure.workload.identity/tenant-id": a.TenantID,
+		},
+		map[string]string{
+			"azure.workload.identity/use": "true",
+		},
+		serviceAccounts,
+	)
 }
 
-func runApplicationIdentityFunctionAzure(function applicationIdentityFunctionAzure, ctx context.Context, d *ApplicationIdentityData, config *azure.AzureConfig) diag.Diagnostics {
+func runApplicationIdentityFunctionAzure(function applicationIdentityFunctionAzure, ctx context.Context, d *ApplicationIdentityData, config *azure.AzureConfig, removeIfNotFound bool) diag.Diagnostics {
 	var diags diag.Diagnostics
 	client, err := config.NewManagedIdentityClient(ctx, config.Provider)
 	if err != nil {
@@ -193,44 +583,149 @@ func runApplicationIdentityFunctionAzure(function applicationIdentityFunctionAzu
 		)
 		return diags
 	}
+	// building the role assignments client fetches a token, so only do it when it will be used
+	var raClient azure.RoleAssignmentsClient
+	if d.ForceDetachOnDestroy.Value {
+		var raErr error
+		raClient, raErr = config.NewRoleAssignmentsClient(ctx)
+		if raErr != nil {
+			diags.Append(
+				diag.NewErrorDiagnostic(raErr.Error(), ""),
+			)
+			return diags
+		}
+	}
 
 	cloudApplicationIdentityConfig := azure.ApplicationIdentityConfig{}
 	convertApplicationIdentityConfigTerraformToAzure(d, &cloudApplicationIdentityConfig)
-	errRunFunc := function(ctx, &cloudApplicationIdentityConfig, client, fedClient)
+	errRunFunc := function(ctx, &cloudApplicationIdentityConfig, client, fedClient, raClient)
 	if errRunFunc != nil {
-		diags.Append(
-			diag.NewErrorDiagnostic(errRunFunc.Error(), ""),
-		)
-		return diags
+		return cloudFunctionDiagnostics(errRunFunc, &d.Id, removeIfNotFound)
 	}
+	diags.Append(detachedDependenciesDiagnostics(cloudApplicationIdentityConfig.DetachedDependencies)...)
 	convertApplicationIdentityConfigAzureToTerraform(&cloudApplicationIdentityConfig, d)
 	return diags
 }
 
 // -------------- GCP --------------
-type applicationIdentityFunctionGCP func(context.Context, *gcp.ApplicationIdentityConfig, gcp.GCPIamIface) error
+type applicationIdentityFunctionGCP func(context.Context, *gcp.ApplicationIdentityConfig, gcp.GCPIamIface, gcp.GCPResourceManagerIface, gcp.GCPWorkloadIdentityPoolsIface, gcp.GCPWorkloadIdentityPoolProvidersIface) error
 
 func convertApplicationIdentityConfigTerraformToGCP(d *ApplicationIdentityData, a *gcp.ApplicationIdentityConfig, c *gcp.GCPConfig) {
 	a.ID = d.Id.Value
 	a.ServiceAccountEmail = d.Id.Value
 	a.Name = d.Name.Value
 	a.Project = c.Provider.Project.Value
-	if d.GCPInput != nil && d.GCPInput.Kubernetes != nil {
-		a.KubernetesNamspace = d.GCPInput.Kubernetes.Namespace.Value
-		a.KubernetesServiceAccountName = d.GCPInput.Kubernetes.ServiceAccountName.Value
+	a.ForceDetachOnDestroy = d.ForceDetachOnDestroy.Value
+	a.Workload = d.Workload.Value
+	if d.GCPInput != nil {
+		a.KubernetesSubjects = convertKubernetesSubjectsTerraformToGCP(d.GCPInput.Kubernetes)
+		a.WorkloadProject = d.GCPInput.WorkloadProject.Value
+	}
+	a.OIDCFederation = convertOIDCFederationTerraformToGCP(d.OIDCFederation)
+	if d.GCPOutput != nil {
+		a.UniqueID = d.GCPOutput.UniqueID.Value
+		a.WorkloadIdentityProvider = d.GCPOutput.WorkloadIdentityProvider.Value
+	}
+}
+
+func convertOIDCFederationTerraformToGCP(o *OIDCFederationData) *gcp.OIDCFederation {
+	if o == nil {
+		return nil
+	}
+	return &gcp.OIDCFederation{
+		Issuer:   o.Issuer.Value,
+		Audience: o.Audience.Value,
+		Subject:  o.Subject.Value,
+	}
+}
+
+func convertKubernetesSubjectsTerraformToGCP(kubernetes []GCPKubernetesIdentityInputData) []gcp.KubernetesSubject {
+	subjects := []gcp.KubernetesSubject{}
+	for _, subject := range kubernetes {
+		subjects = append(subjects, gcp.KubernetesSubject{
+			Namespace:            subject.Namespace.Value,
+			ServiceAccountName:   subject.ServiceAccountName.Value,
+			WorkloadIdentityPool: subject.WorkloadIdentityPool.Value,
+		})
+	}
+	return subjects
+}
+
+// withPriorApplicationIdentityGCP passes the bindings in prior state to function, so they can be replaced
+func withPriorApplicationIdentityGCP(prior *ApplicationIdentityData, function applicationIdentityFunctionGCP) applicationIdentityFunctionGCP {
+	return func(ctx context.Context, a *gcp.ApplicationIdentityConfig, iamClient gcp.GCPIamIface, rmClient gcp.GCPResourceManagerIface, poolsClient gcp.GCPWorkloadIdentityPoolsIface, providersClient gcp.GCPWorkloadIdentityPoolProvidersIface) error {
+		if prior != nil && prior.GCPInput != nil {
+			a.PreviousKubernetesSubjects = convertKubernetesSubjectsTerraformToGCP(prior.GCPInput.Kubernetes)
+			a.PreviousWorkloadProject = prior.GCPInput.WorkloadProject.Value
+		}
+		if prior != nil {
+			a.PreviousOIDCFederation = convertOIDCFederationTerraformToGCP(prior.OIDCFederation)
+			a.PreviousWorkload = prior.Workload.Value
+			if prior.GCPOutput != nil {
+				a.WorkloadIdentityProvider = prior.GCPOutput.WorkloadIdentityProvider.Value
+			}
+		}
+		return function(ctx, a, iamClient, rmClient, poolsClient, providersClient)
+	}
+}
+
+// withImportApplicationIdentityGCP imports the service account in d, and sets the inputs only found on import in d
+func withImportApplicationIdentityGCP(d *ApplicationIdentityData) applicationIdentityFunctionGCP {
+	return func(ctx context.Context, a *gcp.ApplicationIdentityConfig, iamClient gcp.GCPIamIface, rmClient gcp.GCPResourceManagerIface, poolsClient gcp.GCPWorkloadIdentityPoolsIface, providersClient gcp.GCPWorkloadIdentityPoolProvidersIface) error {
+		if err := gcp.ImportApplicationIdentity(ctx, a, iamClient, rmClient, poolsClient, providersClient); err != nil {
+			return err
+		}
+		if len(a.KubernetesSubjects) > 0 {
+			d.GCPInput = &GCPApplicationIdentityInputData{WorkloadProject: types.String{Null: true}}
+		}
+		return nil
 	}
 }
 
 func convertApplicationIdentityConfigGCPToTerraform(a *gcp.ApplicationIdentityConfig, d *ApplicationIdentityData) {
 	d.Id = types.String{Value: a.ID}
 	d.Name = types.String{Value: a.Name}
+	d.Cloud = types.String{Value: "gcp"}
+	d.Principal = types.String{Value: fmt.Sprintf("serviceAccount:%s", a.ID)}
+	d.PrincipalType = types.String{Value: "service_account"}
+	// cleared when the service agent binding was removed outside of Terraform
+	d.Workload = types.String{Value: a.Workload, Null: a.Workload == ""}
+	if d.GCPInput != nil {
+		// subjects whose workload identity binding was removed outside of Terraform are dropped
+		var kubernetes []GCPKubernetesIdentityInputData
+		for _, subject := range a.KubernetesSubjects {
+			kubernetes = append(kubernetes, GCPKubernetesIdentityInputData{
+				Namespace:            types.String{Value: subject.Namespace},
+				ServiceAccountName:   types.String{Value: subject.ServiceAccountName},
+				WorkloadIdentityPool: types.String{Value: subject.WorkloadIdentityPool, Null: subject.WorkloadIdentityPool == ""},
+			})
+		}
+		d.GCPInput.Kubernetes = kubernetes
+	}
 	if d.GCPOutput == nil {
 		d.GCPOutput = &GCPApplicationIdentityOutputData{}
 	}
 	d.GCPOutput.ServiceAccountEmail = types.String{Value: a.ID}
+	d.GCPOutput.UniqueID = types.String{Value: a.UniqueID}
+	d.GCPOutput.WorkloadIdentityProvider = types.String{Value: a.WorkloadIdentityProvider, Null: a.WorkloadIdentityProvider == ""}
+	serviceAccounts := []kubernetesServiceAccount{}
+	for _, subject := range a.KubernetesSubjects {
+		serviceAccounts = append(serviceAccounts, kubernetesServiceAccount{namespace: subject.Namespace, name: subject.ServiceAccountName})
+	}
+	setKubernetesOutputs(d, map[string]string{"iam.gke.io/gcp-service-account": a.ID}, nil, serviceAccounts)
+	if a.OIDCFederation == nil {
+		// removed outside of Terraform
+		d.OIDCFederation = nil
+	} else {
+		d.OIDCFederation = &OIDCFederationData{
+			Issuer:   types.String{Value: a.OIDCFederation.Issuer},
+			Audience: types.String{Value: a.OIDCFederation.Audience, Null: a.OIDCFederation.Audience == ""},
+			Subject:  types.String{Value: a.OIDCFederation.Subject},
+		}
+	}
 }
 
-func runApplicationIdentityFunctionGCP(function applicationIdentityFunctionGCP, ctx context.Context, d *ApplicationIdentityData, config *gcp.GCPConfig) diag.Diagnostics {
+func runApplicationIdentityFunctionGCP(function applicationIdentityFunctionGCP, ctx context.Context, d *ApplicationIdentityData, config *gcp.GCPConfig, removeIfNotFound bool) diag.Diagnostics {
 	var diags diag.Diagnostics
 	iamClient, serviceErr := config.NewIAMService(ctx, config.TokenSource)
 	if serviceErr != nil {
@@ -239,15 +734,34 @@ func runApplicationIdentityFunctionGCP(function applicationIdentityFunctionGCP,
 		)
 		return diags
 	}
-	cloudApplicationIdentityConfig := gcp.ApplicationIdentityConfig{}
-	convertApplicationIdentityConfigTerraformToGCP(d, &cloudApplicationIdentityConfig, config)
-	err := function(ctx, &cloudApplicationIdentityConfig, iamClient)
-	if err != nil {
+	rmClient, rmErr := config.NewResourceManagerService(ctx, config.TokenSource)
+	if rmErr != nil {
 		diags.Append(
-			diag.NewErrorDiagnostic(err.Error(), ""),
+			diag.NewErrorDiagnostic(rmErr.Error(), ""),
 		)
 		return diags
 	}
+	poolsClient, poolsErr := config.NewWorkloadIdentityPoolsService(ctx, config.TokenSource)
+	if poolsErr != nil {
+		diags.Append(
+			diag.NewErrorDiagnostic(poolsErr.Error(), ""),
+		)
+		return diags
+	}
+	providersClient, providersErr := config.NewWorkloadIdentityPoolProvidersService(ctx, config.TokenSource)
+	if providersErr != nil {
+		diags.Append(
+			diag.NewErrorDiagnostic(providersErr.Error(), ""),
+		)
+		return diags
+	}
+	cloudApplicationIdentityConfig := gcp.ApplicationIdentityConfig{}
+	convertApplicationIdentityConfigTerraformToGCP(d, &cloudApplicationIdentityConfig, config)
+	err := function(ctx, &cloudApplicationIdentityConfig, iamClient, rmClient, poolsClient, providersClient)
+	if err != nil {
+		return cloudFunctionDiagnostics(err, &d.Id, removeIfNotFound)
+	}
+	diags.Append(detachedDependenciesDiagnostics(cloudApplicationIdentityConfig.DetachedDependencies)...)
 	convertApplicationIdentityConfigGCPToTerraform(&cloudApplicationIdentityConfig, d)
 	return diags
 }
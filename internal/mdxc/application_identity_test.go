@@ -0,0 +1,54 @@
+package mdxc
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+func TestUpgradeApplicationIdentityV0(t *testing.T) {
+	azureKubernetes := &AzureKubernetesIdentityInputData{
+		Namespace:          types.String{Value: "test-namespace"},
+		ServiceAccountName: types.String{Value: "test-sa"},
+		OIDCURL:            types.String{Value: "https://oidc.example.com"},
+		Audiences:          types.List{ElemType: types.StringType, Null: true},
+	}
+	prior := &ApplicationIdentityDataV0{
+		Id:    types.String{Value: "test-id"},
+		Name:  types.String{Value: "test-name"},
+		Cloud: types.String{Value: "azure"},
+		AzureInput: &AzureApplicationIdentityInputDataV0{
+			Location:          types.String{Value: "westeurope"},
+			ResourceGroupName: types.String{Value: "test-rg"},
+			Kubernetes:        azureKubernetes,
+		},
+	}
+	d := &ApplicationIdentityData{}
+	UpgradeApplicationIdentityV0(prior, d)
+	compare(t, d.Id.Value, "test-id")
+	compare(t, d.AzureInput.Location.Value, "westeurope")
+	compare(t, fmt.Sprint(len(d.AzureInput.Kubernetes)), "1")
+	compare(t, d.AzureInput.Kubernetes[0].ServiceAccountName.Value, "test-sa")
+	compare(t, fmt.Sprint(d.GCPInput == nil), "true")
+
+	gcpKubernetes := &GCPKubernetesIdentityInputData{
+		Namespace:            types.String{Value: "test-namespace"},
+		ServiceAccountName:   types.String{Value: "test-sa"},
+		WorkloadIdentityPool: types.String{Null: true},
+	}
+	prior = &ApplicationIdentityDataV0{
+		Cloud:    types.String{Value: "gcp"},
+		GCPInput: &GCPApplicationIdentityInputDataV0{Kubernetes: gcpKubernetes},
+	}
+	UpgradeApplicationIdentityV0(prior, d)
+	compare(t, fmt.Sprint(d.AzureInput == nil), "true")
+	compare(t, fmt.Sprint(len(d.GCPInput.Kubernetes)), "1")
+	compare(t, d.GCPInput.Kubernetes[0].Namespace.Value, "test-namespace")
+	compare(t, fmt.Sprint(d.GCPInput.WorkloadProject.Null), "true")
+
+	// a configuration without a service account stays without one
+	prior.GCPInput.Kubernetes = nil
+	UpgradeApplicationIdentityV0(prior, d)
+	compare(t, fmt.Sprint(d.GCPInput.Kubernetes == nil), "true")
+}
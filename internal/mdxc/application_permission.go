@@ -7,14 +7,21 @@ import (
 	"terraform-provider-mdxc/internal/cloud/gcp"
 
 	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
 	"github.com/hashicorp/terraform-plugin-framework/types"
 )
 
+type ApplicationPermissionConditionData struct {
+	Expression  types.String `tfsdk:"expression"`
+	Title       types.String `tfsdk:"title"`
+	Description types.String `tfsdk:"description"`
+}
+
 type ApplicationPermissionPermissionData struct {
-	PolicyARN types.String `tfsdk:"policy_arn"`
-	Role      types.String `tfsdk:"role"`
-	Scope     types.String `tfsdk:"scope"`
-	Condition types.String `tfsdk:"condition"`
+	PolicyARN types.String                        `tfsdk:"policy_arn"`
+	Role      types.String                        `tfsdk:"role"`
+	Scope     types.String                        `tfsdk:"scope"`
+	Condition *ApplicationPermissionConditionData `tfsdk:"condition"`
 }
 
 type ApplicationPermissionData struct {
@@ -23,14 +30,29 @@ type ApplicationPermissionData struct {
 	Permission            *ApplicationPermissionPermissionData `tfsdk:"permission"`
 }
 
+// ApplicationPermissionDataV0 is the state of schema versions 0 and 1, when the condition was only an expression
+type ApplicationPermissionDataV0 struct {
+	Id                    types.String `tfsdk:"id"`
+	ApplicationIdentityID types.String `tfsdk:"application_identity_id"`
+	Permission            *struct {
+		PolicyARN types.String `tfsdk:"policy_arn"`
+		Role      types.String `tfsdk:"role"`
+		Scope     types.String `tfsdk:"scope"`
+		Condition types.String `tfsdk:"condition"`
+	} `tfsdk:"permission"`
+}
+
 func (c *MDXCClient) CreateApplicationPermission(ctx context.Context, d *ApplicationPermissionData) diag.Diagnostics {
+	if diags := c.validateApplicationPermission(d); diags.HasError() {
+		return diags
+	}
 	switch c.Cloud {
 	case "aws":
-		return runApplicationPermissionFunctionAWS(aws.CreateApplicationPermission, ctx, d, c.AWSConfig)
+		return runApplicationPermissionFunctionAWS(aws.CreateApplicationPermission, ctx, d, c.AWSConfig, false)
 	case "azure":
-		return runApplicationPermissionFunctionAzure(azure.CreateApplicationPermission, ctx, d, c.AzureConfig)
+		return runApplicationPermissionFunctionAzure(azure.CreateApplicationPermission, ctx, d, c.AzureConfig, false)
 	case "gcp":
-		return runApplicationPermissionFunctionGCP(gcp.CreateApplicationPermission, ctx, d, c.GCPConfig)
+		return runApplicationPermissionFunctionGCP(gcp.CreateApplicationPermission, ctx, d, c.GCPConfig, false)
 	}
 	return diag.Diagnostics{diag.NewErrorDiagnostic("Cloud not supported", "Provider does not support specified cloud: "+c.Cloud)}
 }
@@ -38,23 +60,81 @@ func (c *MDXCClient) CreateApplicationPermission(ctx context.Context, d *Applica
 func (c *MDXCClient) ReadApplicationPermission(ctx context.Context, d *ApplicationPermissionData) diag.Diagnostics {
 	switch c.Cloud {
 	case "aws":
-		return runApplicationPermissionFunctionAWS(aws.ReadApplicationPermission, ctx, d, c.AWSConfig)
+		return runApplicationPermissionFunctionAWS(aws.ReadApplicationPermission, ctx, d, c.AWSConfig, true)
 	case "azure":
-		return runApplicationPermissionFunctionAzure(azure.ReadApplicationPermission, ctx, d, c.AzureConfig)
+		return runApplicationPermissionFunctionAzure(azure.ReadApplicationPermission, ctx, d, c.AzureConfig, true)
 	case "gcp":
-		return runApplicationPermissionFunctionGCP(gcp.ReadApplicationPermission, ctx, d, c.GCPConfig)
+		return runApplicationPermissionFunctionGCP(gcp.ReadApplicationPermission, ctx, d, c.GCPConfig, true)
 	}
 	return diag.Diagnostics{diag.NewErrorDiagnostic("Cloud not supported", "Provider does not support specified cloud: "+c.Cloud)}
 }
 
+// ImportApplicationPermission fills d with the existing permission identified by id: roleArn#policyArn on AWS,
+// [{scope}/]{service_account_email}-{role}[#{condition_hash}] on GCP, the role assignment ID on Azure
+func (c *MDXCClient) ImportApplicationPermission(ctx context.Context, id string, d *ApplicationPermissionData) diag.Diagnostics {
+	d.Id = types.String{Value: id}
+	d.Permission = &ApplicationPermissionPermissionData{
+		PolicyARN: types.String{Null: true},
+		Role:      types.String{Null: true},
+		Scope:     types.String{Null: true},
+	}
+
+	var diags diag.Diagnostics
+	switch c.Cloud {
+	case "aws":
+		diags = runApplicationPermissionFunctionAWS(aws.ImportApplicationPermission, ctx, d, c.AWSConfig, false)
+	case "azure":
+		diags = runApplicationPermissionFunctionAzure(azure.ImportApplicationPermission, ctx, d, c.AzureConfig, false)
+	case "gcp":
+		diags = runApplicationPermissionFunctionGCP(gcp.ImportApplicationPermission, ctx, d, c.GCPConfig, false)
+	default:
+		return diag.Diagnostics{diag.NewErrorDiagnostic("Cloud not supported", "Provider does not support specified cloud: "+c.Cloud)}
+	}
+	return diags
+}
+
+// UpgradeApplicationPermissionV0 migrates state of schema versions 0 and 1: the condition expression moves into
+// the condition block, and GCP IDs of conditional bindings get the condition hash that version 0 did not have
+func (c *MDXCClient) UpgradeApplicationPermissionV0(ctx context.Context, prior *ApplicationPermissionDataV0, d *ApplicationPermissionData) {
+	d.Id = prior.Id
+	d.ApplicationIdentityID = prior.ApplicationIdentityID
+	if prior.Permission == nil {
+		return
+	}
+	d.Permission = &ApplicationPermissionPermissionData{
+		PolicyARN: prior.Permission.PolicyARN,
+		Role:      prior.Permission.Role,
+		Scope:     prior.Permission.Scope,
+	}
+	if prior.Permission.Condition.Value == "" {
+		return
+	}
+	// conditions created before the block existed have no title or description, and title is optional so they aren't replaced
+	d.Permission.Condition = &ApplicationPermissionConditionData{
+		Expression:  prior.Permission.Condition,
+		Title:       types.String{Null: true},
+		Description: types.String{Null: true},
+	}
+	if c.Cloud == "gcp" && !d.Id.Null {
+		d.Id = types.String{Value: gcp.ApplicationPermissionID(&gcp.ApplicationPermissionConfig{
+			ServiceAccountID: d.ApplicationIdentityID.Value,
+			Role:             d.Permission.Role.Value,
+			Condition:        &gcp.ApplicationPermissionCondition{Expression: prior.Permission.Condition.Value},
+		})}
+	}
+}
+
 func (c *MDXCClient) UpdateApplicationPermission(ctx context.Context, d *ApplicationPermissionData) diag.Diagnostics {
+	if diags := c.validateApplicationPermission(d); diags.HasError() {
+		return diags
+	}
 	switch c.Cloud {
 	case "aws":
-		return runApplicationPermissionFunctionAWS(aws.UpdateApplicationPermission, ctx, d, c.AWSConfig)
+		return runApplicationPermissionFunctionAWS(aws.UpdateApplicationPermission, ctx, d, c.AWSConfig, false)
 	case "azure":
-		return runApplicationPermissionFunctionAzure(azure.UpdateApplicationPermission, ctx, d, c.AzureConfig)
+		return runApplicationPermissionFunctionAzure(azure.UpdateApplicationPermission, ctx, d, c.AzureConfig, false)
 	case "gcp":
-		return runApplicationPermissionFunctionGCP(gcp.UpdateApplicationPermission, ctx, d, c.GCPConfig)
+		return runApplicationPermissionFunctionGCP(gcp.UpdateApplicationPermission, ctx, d, c.GCPConfig, false)
 	}
 	return diag.Diagnostics{diag.NewErrorDiagnostic("Cloud not supported", "Provider does not support specified cloud: "+c.Cloud)}
 }
@@ -62,15 +142,28 @@ func (c *MDXCClient) UpdateApplicationPermission(ctx context.Context, d *Applica
 func (c *MDXCClient) DeleteApplicationPermission(ctx context.Context, d *ApplicationPermissionData) diag.Diagnostics {
 	switch c.Cloud {
 	case "aws":
-		return runApplicationPermissionFunctionAWS(aws.DeleteApplicationPermission, ctx, d, c.AWSConfig)
+		return runApplicationPermissionFunctionAWS(aws.DeleteApplicationPermission, ctx, d, c.AWSConfig, true)
 	case "azure":
-		return runApplicationPermissionFunctionAzure(azure.DeleteApplicationPermission, ctx, d, c.AzureConfig)
+		return runApplicationPermissionFunctionAzure(azure.DeleteApplicationPermission, ctx, d, c.AzureConfig, true)
 	case "gcp":
-		return runApplicationPermissionFunctionGCP(gcp.DeleteApplicationPermission, ctx, d, c.GCPConfig)
+		return runApplicationPermissionFunctionGCP(gcp.DeleteApplicationPermission, ctx, d, c.GCPConfig, true)
 	}
 	return diag.Diagnostics{diag.NewErrorDiagnostic("Cloud not supported", "Provider does not support specified cloud: "+c.Cloud)}
 }
 
+// validateApplicationPermission rejects what only some clouds support, instead of silently ignoring it
+func (c *MDXCClient) validateApplicationPermission(d *ApplicationPermissionData) diag.Diagnostics {
+	var diags diag.Diagnostics
+	if c.Cloud != "gcp" && d.Permission != nil && d.Permission.Condition != nil {
+		diags.AddAttributeError(
+			path.Root("permission").AtName("condition"),
+			"Condition not supported",
+			"IAM conditions are only supported on GCP, remove permission.condition for "+c.Cloud,
+		)
+	}
+	return diags
+}
+
 // -------------- AWS --------------
 type applicationPermissionFunctionAWS func(context.Context, *aws.ApplicationPermissionConfig, aws.IAMClient) error
 
@@ -91,17 +184,14 @@ func convertApplicationPermissionConfigAWSToTerraform(a *aws.ApplicationPermissi
 	d.Permission.PolicyARN = types.String{Value: a.PolicyARN}
 }
 
-func runApplicationPermissionFunctionAWS(function applicationPermissionFunctionAWS, ctx context.Context, d *ApplicationPermissionData, config *aws.AWSConfig) diag.Diagnostics {
+func runApplicationPermissionFunctionAWS(function applicationPermissionFunctionAWS, ctx context.Context, d *ApplicationPermissionData, config *aws.AWSConfig, removeIfNotFound bool) diag.Diagnostics {
 	var diags diag.Diagnostics
 	iamClient := config.NewIAMService()
 	cloudApplicationPermissionConfig := aws.ApplicationPermissionConfig{}
 	convertApplicationPermissionConfigTerraformToAWS(d, &cloudApplicationPermissionConfig)
 	err := function(ctx, &cloudApplicationPermissionConfig, iamClient)
 	if err != nil {
-		diags.Append(
-			diag.NewErrorDiagnostic(err.Error(), ""),
-		)
-		return diags
+		return cloudFunctionDiagnostics(err, &d.Id, removeIfNotFound)
 	}
 	convertApplicationPermissionConfigAWSToTerraform(&cloudApplicationPermissionConfig, d)
 	return diags
@@ -129,7 +219,7 @@ func convertApplicationPermissionConfigAzureToTerraform(a *azure.ApplicationPerm
 	d.Permission.Scope = types.String{Value: a.Scope}
 }
 
-func runApplicationPermissionFunctionAzure(function applicationPermissionFunctionAzure, ctx context.Context, d *ApplicationPermissionData, config *azure.AzureConfig) diag.Diagnostics {
+func runApplicationPermissionFunctionAzure(function applicationPermissionFunctionAzure, ctx context.Context, d *ApplicationPermissionData, config *azure.AzureConfig, removeIfNotFound bool) diag.Diagnostics {
 	var diags diag.Diagnostics
 	raClient, raErr := config.NewRoleAssignmentsClient(ctx)
 	if raErr != nil {
@@ -149,17 +239,14 @@ func runApplicationPermissionFunctionAzure(function applicationPermissionFunctio
 	convertApplicationPermissionConfigTerraformToAzure(d, &cloudApplicationPermissionConfig)
 	err := function(ctx, &cloudApplicationPermissionConfig, raClient, rdClient)
 	if err != nil {
-		diags.Append(
-			diag.NewErrorDiagnostic(err.Error(), ""),
-		)
-		return diags
+		return cloudFunctionDiagnostics(err, &d.Id, removeIfNotFound)
 	}
 	convertApplicationPermissionConfigAzureToTerraform(&cloudApplicationPermissionConfig, d)
 	return diags
 }
 
 // // -------------- GCP --------------
-type applicationPermissionFunctionGCP func(context.Context, *gcp.ApplicationPermissionConfig, gcp.GCPResourceManagerIface) error
+type applicationPermissionFunctionGCP func(context.Context, *gcp.ApplicationPermissionConfig, *gcp.GCPIamPolicyClients) error
 
 func convertApplicationPermissionConfigTerraformToGCP(d *ApplicationPermissionData, a *gcp.ApplicationPermissionConfig, c *gcp.GCPConfig) {
 	a.ID = d.Id.Value
@@ -167,7 +254,14 @@ func convertApplicationPermissionConfigTerraformToGCP(d *ApplicationPermissionDa
 	a.ServiceAccountID = d.ApplicationIdentityID.Value
 	if d.Permission != nil {
 		a.Role = d.Permission.Role.Value
-		a.Condition = d.Permission.Condition.Value
+		a.Scope = d.Permission.Scope.Value
+		if d.Permission.Condition != nil {
+			a.Condition = &gcp.ApplicationPermissionCondition{
+				Expression:  d.Permission.Condition.Expression.Value,
+				Title:       d.Permission.Condition.Title.Value,
+				Description: d.Permission.Condition.Description.Value,
+			}
+		}
 	}
 }
 
@@ -177,14 +271,22 @@ func convertApplicationPermissionConfigGCPToTerraform(a *gcp.ApplicationPermissi
 		d.Permission = &ApplicationPermissionPermissionData{}
 	}
 	d.Permission.Role = types.String{Value: a.Role}
+	d.Permission.Scope = types.String{Value: a.Scope, Null: a.Scope == ""}
 	d.ApplicationIdentityID = types.String{Value: a.ServiceAccountID}
-	d.Permission.Condition = types.String{Value: a.Condition}
+	d.Permission.Condition = nil
+	if a.Condition != nil {
+		d.Permission.Condition = &ApplicationPermissionConditionData{
+			Expression:  types.String{Value: a.Condition.Expression},
+			Title:       types.String{Value: a.Condition.Title, Null: a.Condition.Title == ""},
+			Description: types.String{Value: a.Condition.Description, Null: a.Condition.Description == ""},
+		}
+	}
 }
 
-func runApplicationPermissionFunctionGCP(function applicationPermissionFunctionGCP, ctx context.Context, d *ApplicationPermissionData, config *gcp.GCPConfig) diag.Diagnostics {
+func runApplicationPermissionFunctionGCP(function applicationPermissionFunctionGCP, ctx context.Context, d *ApplicationPermissionData, config *gcp.GCPConfig, removeIfNotFound bool) diag.Diagnostics {
 	var diags diag.Diagnostics
 
-	iamClient, serviceErr := config.NewResourceManagerService(ctx, config.TokenSource)
+	iamClients, serviceErr := config.NewIamPolicyClients(ctx, config.TokenSource)
 	if serviceErr != nil {
 		diags.Append(
 			diag.NewErrorDiagnostic(serviceErr.Error(), ""),
@@ -194,12 +296,9 @@ func runApplicationPermissionFunctionGCP(function applicationPermissionFunctionG
 
 	cloudApplicationPermissionConfig := gcp.ApplicationPermissionConfig{}
 	convertApplicationPermissionConfigTerraformToGCP(d, &cloudApplicationPermissionConfig, config)
-	err := function(ctx, &cloudApplicationPermissionConfig, iamClient)
+	err := function(ctx, &cloudApplicationPermissionConfig, iamClients)
 	if err != nil {
-		diags.Append(
-			diag.NewErrorDiagnostic(err.Error(), ""),
-		)
-		return diags
+		return cloudFunctionDiagnostics(err, &d.Id, removeIfNotFound)
 	}
 	convertApplicationPermissionConfigGCPToTerraform(&cloudApplicationPermissionConfig, d)
 	return diags
@@ -0,0 +1,77 @@
+package mdxc
+
+import (
+	"context"
+	"fmt"
+	"terraform-provider-mdxc/internal/cloud/gcp"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+func TestApplicationPermissionConditionOutsideGCP(t *testing.T) {
+	d := &ApplicationPermissionData{
+		Permission: &ApplicationPermissionPermissionData{
+			Role:      types.String{Value: "Reader"},
+			Condition: &ApplicationPermissionConditionData{Expression: types.String{Value: "true"}},
+		},
+	}
+	for _, cloud := range []string{"aws", "azure"} {
+		client := &MDXCClient{Cloud: cloud}
+		if diags := client.CreateApplicationPermission(context.Background(), d); !diags.HasError() {
+			t.Errorf("expect error for a condition on %s, got none", cloud)
+		}
+		if diags := client.UpdateApplicationPermission(context.Background(), d); !diags.HasError() {
+			t.Errorf("expect error for a condition on %s, got none", cloud)
+		}
+	}
+}
+
+func TestUpgradeApplicationPermissionV0(t *testing.T) {
+	serviceAccount := "test-name-prefix@test-project.iam.gserviceaccount.com"
+	expression := `resource.name.startsWith("projects/_/buckets/test-bucket")`
+	prior := &ApplicationPermissionDataV0{
+		Id:                    types.String{Value: serviceAccount + "-roles/storage.objectViewer"},
+		ApplicationIdentityID: types.String{Value: serviceAccount},
+	}
+	prior.Permission = &struct {
+		PolicyARN types.String `tfsdk:"policy_arn"`
+		Role      types.String `tfsdk:"role"`
+		Scope     types.String `tfsdk:"scope"`
+		Condition types.String `tfsdk:"condition"`
+	}{
+		PolicyARN: types.String{Null: true},
+		Role:      types.String{Value: "roles/storage.objectViewer"},
+		Scope:     types.String{Null: true},
+		Condition: types.String{Value: expression},
+	}
+
+	client := &MDXCClient{Cloud: "gcp"}
+	d := &ApplicationPermissionData{}
+	client.UpgradeApplicationPermissionV0(context.Background(), prior, d)
+	compare(t, d.Permission.Condition.Expression.Value, expression)
+	compare(t, fmt.Sprint(d.Permission.Condition.Title.Null, d.Permission.Condition.Description.Null), "true true")
+	// the binding was created without a title, so the ID hashes the expression only
+	want := gcp.ApplicationPermissionID(&gcp.ApplicationPermissionConfig{
+		ServiceAccountID: serviceAccount,
+		Role:             "roles/storage.objectViewer",
+		Condition:        &gcp.ApplicationPermissionCondition{Expression: expression},
+	})
+	compare(t, d.Id.Value, want)
+
+	// version 1 already has the hash, upgrading it again keeps the ID
+	prior.Id = d.Id
+	d = &ApplicationPermissionData{}
+	client.UpgradeApplicationPermissionV0(context.Background(), prior, d)
+	compare(t, d.Id.Value, want)
+
+	// unconditional bindings keep their ID and get no condition block
+	prior.Id = types.String{Value: serviceAccount + "-roles/storage.objectViewer"}
+	prior.Permission.Condition = types.String{Null: true}
+	d = &ApplicationPermissionData{}
+	client.UpgradeApplicationPermissionV0(context.Background(), prior, d)
+	compare(t, d.Id.Value, prior.Id.Value)
+	if d.Permission.Condition != nil {
+		t.Errorf("expect no condition, got %v", d.Permission.Condition)
+	}
+}
@@ -6,6 +6,9 @@ import (
 	"terraform-provider-mdxc/internal/cloud/aws"
 	"terraform-provider-mdxc/internal/cloud/azure"
 	"terraform-provider-mdxc/internal/cloud/gcp"
+
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/types"
 )
 
 // type MDXCClient interface {
@@ -74,3 +77,21 @@ func MDXCClientFactory(ctx context.Context, config *MDXCProviderConfig) (*MDXCCl
 
 	return nil, errors.New("at least one of 'aws', 'azure' or 'gcp' must be set")
 }
+
+// isNotFoundError reports whether a cloud function failed because its resource was deleted outside Terraform
+func isNotFoundError(err error) bool {
+	var awsNotFound *aws.NotFoundError
+	var azureNotFound *azure.NotFoundError
+	var gcpNotFound *gcp.NotFoundError
+	return errors.As(err, &awsNotFound) || errors.As(err, &azureNotFound) || errors.As(err, &gcpNotFound)
+}
+
+// cloudFunctionDiagnostics turns the error of a cloud function into diagnostics. Only Read and Delete set
+// removeIfNotFound: a resource deleted outside Terraform then gets a null id, which removes it from the state.
+func cloudFunctionDiagnostics(err error, id *types.String, removeIfNotFound bool) diag.Diagnostics {
+	if removeIfNotFound && isNotFoundError(err) {
+		*id = types.String{Null: true}
+		return nil
+	}
+	return diag.Diagnostics{diag.NewErrorDiagnostic(err.Error(), "")}
+}
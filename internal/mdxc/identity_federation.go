@@ -0,0 +1,273 @@
+package mdxc
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"terraform-provider-mdxc/internal/cloud/aws"
+	"terraform-provider-mdxc/internal/cloud/azure"
+	"terraform-provider-mdxc/internal/cloud/gcp"
+
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+// IdentityFederationSourceData is the identity of another cloud, which gets an OIDC token from its own cloud
+type IdentityFederationSourceData struct {
+	Cloud                     types.String `tfsdk:"cloud"`
+	GCPServiceAccountUniqueID types.String `tfsdk:"gcp_service_account_unique_id"`
+	AzureTenantID             types.String `tfsdk:"azure_tenant_id"`
+	AzurePrincipalID          types.String `tfsdk:"azure_principal_id"`
+	AWSRoleARN                types.String `tfsdk:"aws_role_arn"`
+	AWSTokenIssuer            types.String `tfsdk:"aws_token_issuer"`
+}
+
+type IdentityFederationData struct {
+	Id             types.String                  `tfsdk:"id"`
+	TargetIdentity types.String                  `tfsdk:"target_identity"`
+	Source         *IdentityFederationSourceData `tfsdk:"source"`
+	Audience       types.String                  `tfsdk:"audience"`
+}
+
+func (c *MDXCClient) CreateIdentityFederation(ctx context.Context, d *IdentityFederationData) diag.Diagnostics {
+	switch c.Cloud {
+	case "aws":
+		return runIdentityFederationFunctionAWS(aws.CreateIdentityFederation, ctx, d, c.AWSConfig, false)
+	case "azure":
+		return runIdentityFederationFunctionAzure(azure.CreateIdentityFederation, ctx, d, c.AzureConfig, false)
+	case "gcp":
+		return runIdentityFederationFunctionGCP(gcp.CreateIdentityFederation, ctx, d, c.GCPConfig, false)
+	}
+	return diag.Diagnostics{diag.NewErrorDiagnostic("Cloud not supported", "Provider does not support specified cloud: "+c.Cloud)}
+}
+
+func (c *MDXCClient) ReadIdentityFederation(ctx context.Context, d *IdentityFederationData) diag.Diagnostics {
+	switch c.Cloud {
+	case "aws":
+		return runIdentityFederationFunctionAWS(aws.ReadIdentityFederation, ctx, d, c.AWSConfig, true)
+	case "azure":
+		return runIdentityFederationFunctionAzure(azure.ReadIdentityFederation, ctx, d, c.AzureConfig, true)
+	case "gcp":
+		return runIdentityFederationFunctionGCP(gcp.ReadIdentityFederation, ctx, d, c.GCPConfig, true)
+	}
+	return diag.Diagnostics{diag.NewErrorDiagnostic("Cloud not supported", "Provider does not support specified cloud: "+c.Cloud)}
+}
+
+func (c *MDXCClient) DeleteIdentityFederation(ctx context.Context, d *IdentityFederationData) diag.Diagnostics {
+	switch c.Cloud {
+	case "aws":
+		return runIdentityFederationFunctionAWS(aws.DeleteIdentityFederation, ctx, d, c.AWSConfig, true)
+	case "azure":
+		return runIdentityFederationFunctionAzure(azure.DeleteIdentityFederation, ctx, d, c.AzureConfig, true)
+	case "gcp":
+		return runIdentityFederationFunctionGCP(gcp.DeleteIdentityFederation, ctx, d, c.GCPConfig, true)
+	}
+	return diag.Diagnostics{diag.NewErrorDiagnostic("Cloud not supported", "Provider does not support specified cloud: "+c.Cloud)}
+}
+
+// identityFederationToken returns the issuer and sub claim of the OIDC token the source identity gets from its cloud
+func identityFederationToken(cloud string, s *IdentityFederationSourceData) (string, string, error) {
+	if s == nil {
+		return "", "", fmt.Errorf("source is required")
+	}
+	if s.Cloud.Value == cloud {
+		return "", "", fmt.Errorf("source cloud %s is the provider's cloud, use the application identity's own configuration instead", cloud)
+	}
+
+	switch s.Cloud.Value {
+	case "gcp":
+		// https://cloud.google.com/iam/docs/create-short-lived-credentials-direct#sa-credentials-oidc
+		if s.GCPServiceAccountUniqueID.Value == "" {
+			return "", "", fmt.Errorf("source gcp_service_account_unique_id is required for source cloud gcp")
+		}
+		return "https://accounts.google.com", s.GCPServiceAccountUniqueID.Value, nil
+	case "azure":
+		// managed identity tokens are issued by the tenant's v1 endpoint for its principal
+		if s.AzureTenantID.Value == "" || s.AzurePrincipalID.Value == "" {
+			return "", "", fmt.Errorf("source azure_tenant_id and azure_principal_id are required for source cloud azure")
+		}
+		return fmt.Sprintf("https://sts.windows.net/%s/", s.AzureTenantID.Value), s.AzurePrincipalID.Value, nil
+	case "aws":
+		// https://docs.aws.amazon.com/IAM/latest/UserGuide/id_roles_providers_outbound.html
+		if s.AWSRoleARN.Value == "" || s.AWSTokenIssuer.Value == "" {
+			return "", "", fmt.Errorf("source aws_role_arn and aws_token_issuer are required for source cloud aws")
+		}
+		return s.AWSTokenIssuer.Value, s.AWSRoleARN.Value, nil
+	}
+	return "", "", fmt.Errorf("source cloud %s is not supported", s.Cloud.Value)
+}
+
+// setIdentityFederationToken is the reverse of identityFederationToken, so a federation changed outside of
+// Terraform shows as a changed source
+func setIdentityFederationToken(s *IdentityFederationSourceData, issuer string, subject string) {
+	if s == nil {
+		return
+	}
+
+	switch s.Cloud.Value {
+	case "gcp":
+		s.GCPServiceAccountUniqueID = types.String{Value: subject}
+	case "azure":
+		s.AzureTenantID = types.String{Value: strings.TrimSuffix(strings.TrimPrefix(issuer, "https://sts.windows.net/"), "/")}
+		s.AzurePrincipalID = types.String{Value: subject}
+	case "aws":
+		s.AWSTokenIssuer = types.String{Value: issuer}
+		s.AWSRoleARN = types.String{Value: subject}
+	}
+}
+
+// -------------- AWS --------------
+type identityFederationFunctionAWS func(context.Context, *aws.IdentityFederationConfig, aws.IAMClient) error
+
+func convertIdentityFederationConfigTerraformToAWS(d *IdentityFederationData, a *aws.IdentityFederationConfig) error {
+	issuer, subject, err := identityFederationToken("aws", d.Source)
+	if err != nil {
+		return err
+	}
+	a.ID = d.Id.Value
+	a.RoleARN = d.TargetIdentity.Value
+	a.Issuer = issuer
+	a.Subject = subject
+	a.Audience = d.Audience.Value
+	return nil
+}
+
+func convertIdentityFederationConfigAWSToTerraform(a *aws.IdentityFederationConfig, d *IdentityFederationData) {
+	d.Id = types.String{Value: a.ID}
+	d.TargetIdentity = types.String{Value: a.RoleARN}
+	d.Audience = types.String{Value: a.Audience}
+	setIdentityFederationToken(d.Source, a.Issuer, a.Subject)
+}
+
+func runIdentityFederationFunctionAWS(function identityFederationFunctionAWS, ctx context.Context, d *IdentityFederationData, config *aws.AWSConfig, removeIfNotFound bool) diag.Diagnostics {
+	var diags diag.Diagnostics
+	iamClient := config.NewIAMService()
+	cloudIdentityFederationConfig := aws.IdentityFederationConfig{}
+	if errConvert := convertIdentityFederationConfigTerraformToAWS(d, &cloudIdentityFederationConfig); errConvert != nil {
+		diags.Append(
+			diag.NewErrorDiagnostic(errConvert.Error(), ""),
+		)
+		return diags
+	}
+	err := function(ctx, &cloudIdentityFederationConfig, iamClient)
+	if err != nil {
+		return cloudFunctionDiagnostics(err, &d.Id, removeIfNotFound)
+	}
+	convertIdentityFederationConfigAWSToTerraform(&cloudIdentityFederationConfig, d)
+	return diags
+}
+
+// -------------- Azure --------------
+type identityFederationFunctionAzure func(context.Context, *azure.IdentityFederationConfig, azure.FederatedIdentityCredentialClient) error
+
+func convertIdentityFederationConfigTerraformToAzure(d *IdentityFederationData, a *azure.IdentityFederationConfig) error {
+	issuer, subject, err := identityFederationToken("azure", d.Source)
+	if err != nil {
+		return err
+	}
+	a.ID = d.Id.Value
+	a.IdentityResourceID = d.TargetIdentity.Value
+	a.Issuer = issuer
+	a.Subject = subject
+	a.Audience = d.Audience.Value
+	return nil
+}
+
+func convertIdentityFederationConfigAzureToTerraform(a *azure.IdentityFederationConfig, d *IdentityFederationData) {
+	d.Id = types.String{Value: a.ID}
+	d.Audience = types.String{Value: a.Audience}
+	setIdentityFederationToken(d.Source, a.Issuer, a.Subject)
+}
+
+func runIdentityFederationFunctionAzure(function identityFederationFunctionAzure, ctx context.Context, d *IdentityFederationData, config *azure.AzureConfig, removeIfNotFound bool) diag.Diagnostics {
+	var diags diag.Diagnostics
+	fedClient, errFed := config.NewFederatedIdentityCredentialsClient(ctx, config.Provider)
+	if errFed != nil {
+		diags.Append(
+			diag.NewErrorDiagnostic(errFed.Error(), ""),
+		)
+		return diags
+	}
+	cloudIdentityFederationConfig := azure.IdentityFederationConfig{}
+	if errConvert := convertIdentityFederationConfigTerraformToAzure(d, &cloudIdentityFederationConfig); errConvert != nil {
+		diags.Append(
+			diag.NewErrorDiagnostic(errConvert.Error(), ""),
+		)
+		return diags
+	}
+	err := function(ctx, &cloudIdentityFederationConfig, fedClient)
+	if err != nil {
+		return cloudFunctionDiagnostics(err, &d.Id, removeIfNotFound)
+	}
+	convertIdentityFederationConfigAzureToTerraform(&cloudIdentityFederationConfig, d)
+	return diags
+}
+
+// -------------- GCP --------------
+type identityFederationFunctionGCP func(context.Context, *gcp.IdentityFederationConfig, gcp.GCPIamIface, gcp.GCPResourceManagerIface, gcp.GCPWorkloadIdentityPoolsIface, gcp.GCPWorkloadIdentityPoolProvidersIface) error
+
+func convertIdentityFederationConfigTerraformToGCP(d *IdentityFederationData, a *gcp.IdentityFederationConfig, c *gcp.GCPConfig) error {
+	issuer, subject, err := identityFederationToken("gcp", d.Source)
+	if err != nil {
+		return err
+	}
+	a.ID = d.Id.Value
+	a.Project = c.Provider.Project.Value
+	a.ServiceAccountEmail = d.TargetIdentity.Value
+	a.Issuer = issuer
+	a.Subject = subject
+	a.Audience = d.Audience.Value
+	return nil
+}
+
+func convertIdentityFederationConfigGCPToTerraform(a *gcp.IdentityFederationConfig, d *IdentityFederationData) {
+	d.Id = types.String{Value: a.ID}
+	d.TargetIdentity = types.String{Value: a.ServiceAccountEmail}
+	d.Audience = types.String{Value: a.Audience}
+	setIdentityFederationToken(d.Source, a.Issuer, a.Subject)
+}
+
+func runIdentityFederationFunctionGCP(function identityFederationFunctionGCP, ctx context.Context, d *IdentityFederationData, config *gcp.GCPConfig, removeIfNotFound bool) diag.Diagnostics {
+	var diags diag.Diagnostics
+	iamClient, serviceErr := config.NewIAMService(ctx, config.TokenSource)
+	if serviceErr != nil {
+		diags.Append(
+			diag.NewErrorDiagnostic(serviceErr.Error(), ""),
+		)
+		return diags
+	}
+	rmClient, rmErr := config.NewResourceManagerService(ctx, config.TokenSource)
+	if rmErr != nil {
+		diags.Append(
+			diag.NewErrorDiagnostic(rmErr.Error(), ""),
+		)
+		return diags
+	}
+	poolsClient, poolsErr := config.NewWorkloadIdentityPoolsService(ctx, config.TokenSource)
+	if poolsErr != nil {
+		diags.Append(
+			diag.NewErrorDiagnostic(poolsErr.Error(), ""),
+		)
+		return diags
+	}
+	providersClient, providersErr := config.NewWorkloadIdentityPoolProvidersService(ctx, config.TokenSource)
+	if providersErr != nil {
+		diags.Append(
+			diag.NewErrorDiagnostic(providersErr.Error(), ""),
+		)
+		return diags
+	}
+	cloudIdentityFederationConfig := gcp.IdentityFederationConfig{}
+	if errConvert := convertIdentityFederationConfigTerraformToGCP(d, &cloudIdentityFederationConfig, config); errConvert != nil {
+		diags.Append(
+			diag.NewErrorDiagnostic(errConvert.Error(), ""),
+		)
+		return diags
+	}
+	err := function(ctx, &cloudIdentityFederationConfig, iamClient, rmClient, poolsClient, providersClient)
+	if err != nil {
+		return cloudFunctionDiagnostics(err, &d.Id, removeIfNotFound)
+	}
+	convertIdentityFederationConfigGCPToTerraform(&cloudIdentityFederationConfig, d)
+	return diags
+}
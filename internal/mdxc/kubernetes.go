@@ -0,0 +1,67 @@
+package mdxc
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/terraform-plugin-framework/attr"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+// kubernetesServiceAccount is a Kubernetes service account allowed to use the application identity
+type kubernetesServiceAccount struct {
+	namespace string
+	name      string
+}
+
+// setKubernetesOutputs sets what a Kubernetes service account and its pods need to use the application identity,
+// so charts don't have to know each cloud's annotations
+func setKubernetesOutputs(d *ApplicationIdentityData, annotations map[string]string, podLabels map[string]string, serviceAccounts []kubernetesServiceAccount) {
+	d.KubernetesServiceAccountAnnotations = stringMap(annotations)
+	d.KubernetesPodLabels = stringMap(podLabels)
+
+	if len(serviceAccounts) == 0 {
+		d.KubernetesServiceAccountManifest = types.String{Null: true}
+		return
+	}
+	manifests := make([]string, 0, len(serviceAccounts))
+	for _, serviceAccount := range serviceAccounts {
+		manifests = append(manifests, kubernetesServiceAccountManifest(serviceAccount, annotations))
+	}
+	d.KubernetesServiceAccountManifest = types.String{Value: strings.Join(manifests, "---\n")}
+}
+
+func kubernetesServiceAccountManifest(serviceAccount kubernetesServiceAccount, annotations map[string]string) string {
+	var manifest strings.Builder
+	manifest.WriteString("apiVersion: v1\n")
+	manifest.WriteString("kind: ServiceAccount\n")
+	manifest.WriteString("metadata:\n")
+	fmt.Fprintf(&manifest, "  name: %s\n", strconv.Quote(serviceAccount.name))
+	fmt.Fprintf(&manifest, "  namespace: %s\n", strconv.Quote(serviceAccount.namespace))
+	if len(annotations) > 0 {
+		manifest.WriteString("  annotations:\n")
+		for _, key := range sortedKeys(annotations) {
+			fmt.Fprintf(&manifest, "    %s: %s\n", key, strconv.Quote(annotations[key]))
+		}
+	}
+	return manifest.String()
+}
+
+func stringMap(values map[string]string) types.Map {
+	m := types.Map{ElemType: types.StringType, Elems: map[string]attr.Value{}}
+	for key, value := range values {
+		m.Elems[key] = types.String{Value: value}
+	}
+	return m
+}
+
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,93 @@
+package mdxc
+
+import (
+	"fmt"
+	"terraform-provider-mdxc/internal/cloud/aws"
+	"testing"
+)
+
+func TestKubernetesServiceAccountManifest(t *testing.T) {
+	manifest := kubernetesServiceAccountManifest(
+		kubernetesServiceAccount{namespace: "default", name: "app"},
+		map[string]string{"iam.gke.io/gcp-service-account": "app@project.iam.gserviceaccount.com", "azure.workload.identity/client-id": "client-id"},
+	)
+	want := `apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: "app"
+  namespace: "default"
+  annotations:
+    azure.workload.identity/client-id: "client-id"
+    iam.gke.io/gcp-service-account: "app@project.iam.gserviceaccount.com"
+`
+	compare(t, manifest, want)
+
+	// no annotations block without annotations
+	manifest = kubernetesServiceAccountManifest(kubernetesServiceAccount{namespace: "default", name: "app"}, nil)
+	want = `apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: "app"
+  namespace: "default"
+`
+	compare(t, manifest, want)
+}
+
+func TestSetKubernetesOutputs(t *testing.T) {
+	d := &ApplicationIdentityData{}
+	setKubernetesOutputs(d, map[string]string{"key": "value"}, map[string]string{"label": "true"}, []kubernetesServiceAccount{
+		{namespace: "default", name: "app"},
+		{namespace: "canary", name: "app"},
+	})
+	compare(t, fmt.Sprint(d.KubernetesServiceAccountAnnotations.Elems), `map[key:"value"]`)
+	compare(t, fmt.Sprint(d.KubernetesPodLabels.Elems), `map[label:"true"]`)
+	want := kubernetesServiceAccountManifest(kubernetesServiceAccount{namespace: "default", name: "app"}, map[string]string{"key": "value"}) +
+		"---\n" +
+		kubernetesServiceAccountManifest(kubernetesServiceAccount{namespace: "canary", name: "app"}, map[string]string{"key": "value"})
+	compare(t, d.KubernetesServiceAccountManifest.Value, want)
+
+	// without service accounts there is no manifest, but the annotations are still set
+	setKubernetesOutputs(d, map[string]string{"key": "value"}, nil, nil)
+	compare(t, fmt.Sprint(d.KubernetesServiceAccountManifest.Null), "true")
+	compare(t, fmt.Sprint(len(d.KubernetesServiceAccountAnnotations.Elems)), "1")
+	compare(t, fmt.Sprint(d.KubernetesPodLabels.Null, len(d.KubernetesPodLabels.Elems)), "false 0")
+}
+
+func TestAWSKubernetesAnnotations(t *testing.T) {
+	roleARN := "arn:aws:iam::account:role/test"
+	subjects := []aws.KubernetesSubject{{OIDCProviderARN: "arn:aws:iam::account:oidc-provider/oidc.eks.us-west-2.amazonaws.com/id/EXAMPLE", Namespace: "default", ServiceAccountName: "app"}}
+	tests := []struct {
+		name        string
+		config      aws.ApplicationIdentityConfig
+		annotations string
+	}{
+		{
+			name:        "irsa",
+			config:      aws.ApplicationIdentityConfig{IAMRoleARN: roleARN, KubernetesSubjects: subjects},
+			annotations: `map[eks.amazonaws.com/role-arn:"arn:aws:iam::account:role/test"]`,
+		},
+		{
+			name:        "pod identity",
+			config:      aws.ApplicationIdentityConfig{IAMRoleARN: roleARN, PodIdentityClusterName: "cluster", PodIdentityNamespace: "default", PodIdentityServiceAccountName: "app"},
+			annotations: `map[]`,
+		},
+		{
+			name:        "no kubernetes",
+			config:      aws.ApplicationIdentityConfig{IAMRoleARN: roleARN},
+			annotations: `map[]`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d := &ApplicationIdentityData{}
+			convertApplicationIdentityConfigAWSToTerraform(&tc.config, d)
+			compare(t, fmt.Sprint(d.KubernetesServiceAccountAnnotations.Elems), tc.annotations)
+		})
+	}
+}
+
+func compare(t *testing.T, got string, want string) {
+	if want != got {
+		t.Errorf("expect %v, got %v", want, got)
+	}
+}
@@ -132,6 +132,7 @@ func (p *MDXCProvider) GetResources(_ context.Context) (map[string]provider.Reso
 	return map[string]provider.ResourceType{
 		"mdxc_application_identity":   ResourceApplicationIdentityType{},
 		"mdxc_application_permission": ResourceApplicationPermissionType{},
+		"mdxc_identity_federation":    ResourceIdentityFederationType{},
 	}, nil
 }
 
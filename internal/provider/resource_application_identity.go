@@ -2,8 +2,17 @@ package provider
 
 import (
 	"context"
+	"fmt"
+	"reflect"
+	"regexp"
 	"terraform-provider-mdxc/internal/mdxc"
+	"terraform-provider-mdxc/internal/verify"
 
+	"github.com/hashicorp/terraform-plugin-framework-validators/int64validator"
+	"github.com/hashicorp/terraform-plugin-framework-validators/listvalidator"
+	"github.com/hashicorp/terraform-plugin-framework-validators/schemavalidator"
+	"github.com/hashicorp/terraform-plugin-framework-validators/setvalidator"
+	"github.com/hashicorp/terraform-plugin-framework-validators/stringvalidator"
 	"github.com/hashicorp/terraform-plugin-framework/diag"
 	"github.com/hashicorp/terraform-plugin-framework/path"
 	"github.com/hashicorp/terraform-plugin-framework/provider"
@@ -17,6 +26,8 @@ import (
 var _ provider.ResourceType = ResourceApplicationIdentityType{}
 var _ resource.Resource = ResourceApplicationIdentity{}
 var _ resource.ResourceWithImportState = ResourceApplicationIdentity{}
+var _ resource.ResourceWithModifyPlan = ResourceApplicationIdentity{}
+var _ resource.ResourceWithUpgradeState = ResourceApplicationIdentity{}
 
 type ResourceApplicationIdentityType struct{}
 
@@ -26,12 +37,109 @@ var awsApplicationIdentityInputs = tfsdk.Attribute{
 	Attributes: tfsdk.SingleNestedAttributes(map[string]tfsdk.Attribute{
 		"assume_role_policy": {
 			Type:        types.StringType,
-			Description: "The AWS IAM role assume role policy. Required if provisioning into AWS",
-			Required:    true,
+			Description: "The AWS IAM role assume role policy. Generated when `kubernetes`, `pod_identity`, `oidc_federation` or `workload` is set, otherwise required, and changes to a generated policy made outside of Terraform are planned back. Changes are applied in place",
+			Optional:    true,
+			Computed:    true,
 			PlanModifiers: tfsdk.AttributePlanModifiers{
+				verify.SuppressEquivalentPolicyDiffs(),
+			},
+			Validators: []tfsdk.AttributeValidator{
+				schemavalidator.ConflictsWith(
+					path.MatchRelative().AtParent().AtName("kubernetes"),
+					path.MatchRelative().AtParent().AtName("pod_identity"),
+					path.MatchRoot("oidc_federation"),
+					path.MatchRoot("workload"),
+				),
+				schemavalidator.AtLeastOneOf(
+					path.MatchRelative().AtParent().AtName("kubernetes"),
+					path.MatchRelative().AtParent().AtName("pod_identity"),
+					path.MatchRoot("oidc_federation"),
+					path.MatchRoot("workload"),
+				),
+			},
+		},
+		"path": {
+			Type:        types.StringType,
+			Description: "Path to the role. Defaults to `/`",
+			Optional:    true,
+			Computed:    true,
+			PlanModifiers: tfsdk.AttributePlanModifiers{
+				resource.UseStateForUnknown(),
 				resource.RequiresReplace(),
 			},
 		},
+		"description": {
+			Type:        types.StringType,
+			Description: "Description of the role",
+			Optional:    true,
+		},
+		"max_session_duration": {
+			Type:        types.Int64Type,
+			Description: "Maximum session duration in seconds, between 3600 and 43200. Defaults to 3600",
+			Optional:    true,
+			Computed:    true,
+			PlanModifiers: tfsdk.AttributePlanModifiers{
+				resource.UseStateForUnknown(),
+			},
+			Validators: []tfsdk.AttributeValidator{
+				int64validator.Between(3600, 43200),
+			},
+		},
+		"permissions_boundary": {
+			Type:        types.StringType,
+			Description: "ARN of the managed policy used as the role's permissions boundary",
+			Optional:    true,
+		},
+		"tags": {
+			Type:        types.MapType{ElemType: types.StringType},
+			Description: "Tags to apply to the role",
+			Optional:    true,
+		},
+		"kubernetes": {
+			Optional:    true,
+			Description: "Kubernetes service accounts allowed to assume the role. Generates an IAM Roles for Service Accounts (IRSA) assume role policy with one statement per service account",
+			Validators: []tfsdk.AttributeValidator{
+				setvalidator.SizeAtLeast(1),
+			},
+			Attributes: tfsdk.SetNestedAttributes(map[string]tfsdk.Attribute{
+				"oidc_provider_arn": {
+					Type:        types.StringType,
+					Description: "ARN of the EKS cluster's IAM OIDC provider. The issuer is taken from the ARN",
+					Required:    true,
+				},
+				"namespace": {
+					Type:     types.StringType,
+					Required: true,
+				},
+				"service_account_name": {
+					Type:     types.StringType,
+					Required: true,
+				},
+			}),
+		},
+		"pod_identity": {
+			Optional:    true,
+			Description: "EKS Pod Identity configuration. Trusts EKS Pod Identity and associates the role with the Kubernetes service account",
+			Attributes: tfsdk.SingleNestedAttributes(map[string]tfsdk.Attribute{
+				"cluster_name": {
+					Type:     types.StringType,
+					Required: true,
+				},
+				"namespace": {
+					Type:     types.StringType,
+					Required: true,
+				},
+				"service_account_name": {
+					Type:     types.StringType,
+					Required: true,
+				},
+			}),
+		},
+		"create_instance_profile": {
+			Type:        types.BoolType,
+			Description: "Create an instance profile named after the role, so EC2 instances can use it. Requires `workload` `ec2`",
+			Optional:    true,
+		},
 	}),
 }
 
@@ -49,8 +157,11 @@ var azureApplicationIdentityInputs = tfsdk.Attribute{
 		},
 		"kubernetes": {
 			Optional:    true,
-			Description: "Kubernetes configuration",
-			Attributes: tfsdk.SingleNestedAttributes(map[string]tfsdk.Attribute{
+			Description: "Kubernetes service accounts allowed to use the identity, each with its own federated identity credential",
+			Validators: []tfsdk.AttributeValidator{
+				setvalidator.SizeAtLeast(1),
+			},
+			Attributes: tfsdk.SetNestedAttributes(map[string]tfsdk.Attribute{
 				"namespace": {
 					Type:     types.StringType,
 					Required: true,
@@ -63,6 +174,14 @@ var azureApplicationIdentityInputs = tfsdk.Attribute{
 					Type:     types.StringType,
 					Required: true,
 				},
+				"audiences": {
+					Type:        types.ListType{ElemType: types.StringType},
+					Description: "Audiences accepted in the service account token. Defaults to `api://AzureADTokenExchange`",
+					Optional:    true,
+					Validators: []tfsdk.AttributeValidator{
+						listvalidator.SizeAtLeast(1),
+					},
+				},
 			}),
 		},
 	}),
@@ -74,8 +193,11 @@ var gcpApplicationIdentityInputs = tfsdk.Attribute{
 	Attributes: tfsdk.SingleNestedAttributes(map[string]tfsdk.Attribute{
 		"kubernetes": {
 			Optional:    true,
-			Description: "Kubernetes configuration",
-			Attributes: tfsdk.SingleNestedAttributes(map[string]tfsdk.Attribute{
+			Description: "Kubernetes service accounts allowed to impersonate the service account, each with its own workload identity user member",
+			Validators: []tfsdk.AttributeValidator{
+				setvalidator.SizeAtLeast(1),
+			},
+			Attributes: tfsdk.SetNestedAttributes(map[string]tfsdk.Attribute{
 				"namespace": {
 					Type:     types.StringType,
 					Required: true,
@@ -84,25 +206,55 @@ var gcpApplicationIdentityInputs = tfsdk.Attribute{
 					Type:     types.StringType,
 					Required: true,
 				},
+				"workload_identity_pool": {
+					Type:        types.StringType,
+					Optional:    true,
+					Description: "Workload identity pool of the cluster, e.g. the fleet host project pool `<fleet-project>.svc.id.goog` for fleet workload identity. Defaults to `<project>.svc.id.goog`",
+					Validators: []tfsdk.AttributeValidator{
+						stringvalidator.RegexMatches(regexp.MustCompile(`^[a-z0-9.:-]+\.svc\.id\.goog$`), "must be a workload identity pool ending in .svc.id.goog"),
+					},
+				},
 			}),
 		},
+		"workload_project": {
+			Type:        types.StringType,
+			Optional:    true,
+			Description: "Project the `workload` runs in, when it isn't the provider's project. Its service agent gets `roles/iam.serviceAccountTokenCreator` on the service account, which cross-project workloads need",
+			Validators: []tfsdk.AttributeValidator{
+				stringvalidator.RegexMatches(regexp.MustCompile(`^[a-z][a-z0-9-]{4,28}[a-z0-9]$`), "must be a project ID"),
+			},
+		},
 	}),
 }
 
 var awsApplicationIdentityOutputs = tfsdk.Attribute{
 	Computed:    true,
 	Description: "AWS IAM role configuration",
+	PlanModifiers: tfsdk.AttributePlanModifiers{
+		resource.UseStateForUnknown(),
+	},
 	Attributes: tfsdk.SingleNestedAttributes(map[string]tfsdk.Attribute{
 		"iam_role_arn": {
 			Type:     types.StringType,
 			Computed: true,
 		},
+		"pod_identity_association_arn": {
+			Type:     types.StringType,
+			Computed: true,
+		},
+		"instance_profile_arn": {
+			Type:     types.StringType,
+			Computed: true,
+		},
 	}),
 }
 
 var azureApplicationIdentityOutputs = tfsdk.Attribute{
 	Computed:    true,
 	Description: "Azure Managed Identity configuration",
+	PlanModifiers: tfsdk.AttributePlanModifiers{
+		resource.UseStateForUnknown(),
+	},
 	Attributes: tfsdk.SingleNestedAttributes(map[string]tfsdk.Attribute{
 		"client_id": {
 			Type:     types.StringType,
@@ -122,22 +274,59 @@ var azureApplicationIdentityOutputs = tfsdk.Attribute{
 var gcpApplicationIdentityOutputs = tfsdk.Attribute{
 	Computed:    true,
 	Description: "GCP Service Account configuration",
+	PlanModifiers: tfsdk.AttributePlanModifiers{
+		resource.UseStateForUnknown(),
+	},
 	Attributes: tfsdk.SingleNestedAttributes(map[string]tfsdk.Attribute{
 		"service_account_email": {
 			Type:     types.StringType,
 			Computed: true,
 		},
+		"unique_id": {
+			Type:        types.StringType,
+			Description: "Unique ID of the service account, the subject of its identity tokens, e.g. for `mdxc_identity_federation`",
+			Computed:    true,
+		},
+		"workload_identity_provider": {
+			Type:        types.StringType,
+			Description: "Resource name of the workload identity pool provider created for `oidc_federation`, e.g. for the `workload_identity_provider` input of google-github-actions/auth",
+			Computed:    true,
+		},
+	}),
+}
+
+var oidcFederationInputs = tfsdk.Attribute{
+	Optional:    true,
+	Description: "Trust the tokens of an external OIDC issuer such as GitHub Actions, GitLab or CircleCI, for keyless deploys. Creates an assume role policy statement on AWS, a federated identity credential on Azure, and a workload identity pool and provider on GCP",
+	Attributes: tfsdk.SingleNestedAttributes(map[string]tfsdk.Attribute{
+		"issuer": {
+			Type:        types.StringType,
+			Description: "Issuer URL, e.g. `https://token.actions.githubusercontent.com`. On AWS the issuer's IAM OIDC provider must already exist",
+			Required:    true,
+		},
+		"audience": {
+			Type:        types.StringType,
+			Description: "Audience of the tokens. Defaults to `sts.amazonaws.com` on AWS, `api://AzureADTokenExchange` on Azure and the workload identity pool provider on GCP",
+			Optional:    true,
+		},
+		"subject": {
+			Type:        types.StringType,
+			Description: "Subject claim of the tokens, e.g. `repo:my-org/my-repo:ref:refs/heads/main`. On AWS and GCP `*` matches any characters, Azure requires an exact subject",
+			Required:    true,
+		},
 	}),
 }
 
 func (t ResourceApplicationIdentityType) GetSchema(ctx context.Context) (tfsdk.Schema, diag.Diagnostics) {
 	return tfsdk.Schema{
 		MarkdownDescription: "A cross-cloud application identity resource (AWS IAM Role, GCP Service Account, Azure Application)",
+		// Version 1 turns azure_configuration.kubernetes and gcp_configuration.kubernetes into sets
+		Version: 1,
 
 		Attributes: map[string]tfsdk.Attribute{
 			"id": {
 				Computed:            true,
-				MarkdownDescription: "Cloud specific identifier of the application identity",
+				MarkdownDescription: "Cloud specific identifier of the application identity: the IAM role ARN on AWS, the service account email on GCP, the principal ID of the managed identity on Azure",
 				PlanModifiers: tfsdk.AttributePlanModifiers{
 					resource.UseStateForUnknown(),
 				},
@@ -152,7 +341,64 @@ func (t ResourceApplicationIdentityType) GetSchema(ctx context.Context) (tfsdk.S
 				Type:                types.StringType,
 				MarkdownDescription: "The cloud the application identity was provisioned into (value will be `aws`, `azure` or `gcp`)",
 				Computed:            true,
+				PlanModifiers: tfsdk.AttributePlanModifiers{
+					resource.UseStateForUnknown(),
+				},
+			},
+			"principal": {
+				Type:                types.StringType,
+				MarkdownDescription: "The identity as other policies reference it: the IAM role ARN on AWS, `serviceAccount:{email}` on GCP, the principal object ID on Azure",
+				Computed:            true,
+				PlanModifiers: tfsdk.AttributePlanModifiers{
+					resource.UseStateForUnknown(),
+				},
 			},
+			"principal_type": {
+				Type:                types.StringType,
+				MarkdownDescription: "The kind of `principal` (value will be `iam_role`, `service_account` or `managed_identity`)",
+				Computed:            true,
+				PlanModifiers: tfsdk.AttributePlanModifiers{
+					resource.UseStateForUnknown(),
+				},
+			},
+			"force_detach_on_destroy": {
+				Type:                types.BoolType,
+				MarkdownDescription: "Remove everything still attached to the identity before deleting it: managed and inline policies and instance profiles on AWS, project role bindings on GCP, federated credentials and role assignments on Azure. Must be applied before the destroy to take effect",
+				Optional:            true,
+			},
+			"workload": {
+				Type:                types.StringType,
+				MarkdownDescription: "Workload that runs as the identity. Each cloud only accepts its own presets: `lambda`, `ecs_task` or `ec2` trust the matching AWS service, `cloud_run` or `compute` grant the service agent of `gcp_configuration.workload_project` `roles/iam.serviceAccountTokenCreator`, and `app_service` tags the Azure identity. `kubernetes` works everywhere and requires the cloud's `kubernetes` configuration",
+				Optional:            true,
+				Validators: []tfsdk.AttributeValidator{
+					stringvalidator.OneOf("lambda", "ecs_task", "ec2", "cloud_run", "compute", "app_service", "kubernetes"),
+				},
+			},
+			"kubernetes_service_account_annotations": {
+				Type:                types.MapType{ElemType: types.StringType},
+				MarkdownDescription: "Annotations that let a Kubernetes service account use the identity: `eks.amazonaws.com/role-arn` on AWS, `iam.gke.io/gcp-service-account` on GCP, `azure.workload.identity/client-id` and `azure.workload.identity/tenant-id` on Azure",
+				Computed:            true,
+				PlanModifiers: tfsdk.AttributePlanModifiers{
+					resource.UseStateForUnknown(),
+				},
+			},
+			"kubernetes_pod_labels": {
+				Type:                types.MapType{ElemType: types.StringType},
+				MarkdownDescription: "Labels the pods running as the Kubernetes service account need, `azure.workload.identity/use` on Azure",
+				Computed:            true,
+				PlanModifiers: tfsdk.AttributePlanModifiers{
+					resource.UseStateForUnknown(),
+				},
+			},
+			"kubernetes_service_account_manifest": {
+				Type:                types.StringType,
+				MarkdownDescription: "ServiceAccount YAML of every Kubernetes service account configured for the identity, with `kubernetes_service_account_annotations` applied. Null without Kubernetes configuration",
+				Computed:            true,
+				PlanModifiers: tfsdk.AttributePlanModifiers{
+					resource.UseStateForUnknown(),
+				},
+			},
+			"oidc_federation":            oidcFederationInputs,
 			"aws_configuration":          awsApplicationIdentityInputs,
 			"azure_configuration":        azureApplicationIdentityInputs,
 			"gcp_configuration":          gcpApplicationIdentityInputs,
@@ -203,11 +449,20 @@ func (r ResourceApplicationIdentity) Read(ctx context.Context, req resource.Read
 		return
 	}
 
+	id := data.Id.Value
 	diags = r.provider.Client.ReadApplicationIdentity(ctx, &data)
 	resp.Diagnostics.Append(diags...)
 	if resp.Diagnostics.HasError() {
 		return
 	}
+	if data.Id.Null {
+		resp.Diagnostics.AddWarning(
+			"Application identity not found",
+			fmt.Sprintf("%s was deleted outside of Terraform and is removed from the state, the next apply recreates it", id),
+		)
+		resp.State.RemoveResource(ctx)
+		return
+	}
 
 	diags = resp.State.Set(ctx, &data)
 	resp.Diagnostics.Append(diags...)
@@ -222,7 +477,14 @@ func (r ResourceApplicationIdentity) Update(ctx context.Context, req resource.Up
 		return
 	}
 
-	diags = r.provider.Client.UpdateApplicationIdentity(ctx, &data)
+	var state mdxc.ApplicationIdentityData
+	diags = req.State.Get(ctx, &state)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	diags = r.provider.Client.UpdateApplicationIdentity(ctx, &state, &data)
 	resp.Diagnostics.Append(diags...)
 	if resp.Diagnostics.HasError() {
 		return
@@ -251,6 +513,250 @@ func (r ResourceApplicationIdentity) Delete(ctx context.Context, req resource.De
 	resp.Diagnostics.Append(diags...)
 }
 
+func (r ResourceApplicationIdentity) ModifyPlan(ctx context.Context, req resource.ModifyPlanRequest, resp *resource.ModifyPlanResponse) {
+	// nothing to compare against on create or destroy
+	if req.State.Raw.IsNull() || req.Plan.Raw.IsNull() {
+		return
+	}
+
+	// a changed EKS Pod Identity association is replaced, which gives it a new ARN
+	var planPodIdentity, statePodIdentity *mdxc.AWSPodIdentityInputData
+	podIdentityPath := path.Root("aws_configuration").AtName("pod_identity")
+	resp.Diagnostics.Append(req.Plan.GetAttribute(ctx, podIdentityPath, &planPodIdentity)...)
+	resp.Diagnostics.Append(req.State.GetAttribute(ctx, podIdentityPath, &statePodIdentity)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	if !reflect.DeepEqual(planPodIdentity, statePodIdentity) {
+		resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("aws_application_identity").AtName("pod_identity_association_arn"), types.String{Unknown: true})...)
+	}
+
+	// toggling create_instance_profile creates or deletes the instance profile
+	var planCreateInstanceProfile, stateCreateInstanceProfile types.Bool
+	var stateAWSOutput *mdxc.AWSApplicationIdentityOutputData
+	createInstanceProfilePath := path.Root("aws_configuration").AtName("create_instance_profile")
+	resp.Diagnostics.Append(req.Plan.GetAttribute(ctx, createInstanceProfilePath, &planCreateInstanceProfile)...)
+	resp.Diagnostics.Append(req.State.GetAttribute(ctx, createInstanceProfilePath, &stateCreateInstanceProfile)...)
+	resp.Diagnostics.Append(req.State.GetAttribute(ctx, path.Root("aws_application_identity"), &stateAWSOutput)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	if stateAWSOutput != nil && planCreateInstanceProfile.Value != stateCreateInstanceProfile.Value {
+		resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("aws_application_identity").AtName("instance_profile_arn"), types.String{Unknown: true})...)
+	}
+
+	// adding or removing the OIDC federation creates or deletes the GCP workload identity pool provider
+	var planOIDCFederation, stateOIDCFederation *mdxc.OIDCFederationData
+	var stateGCPOutput *mdxc.GCPApplicationIdentityOutputData
+	resp.Diagnostics.Append(req.Plan.GetAttribute(ctx, path.Root("oidc_federation"), &planOIDCFederation)...)
+	resp.Diagnostics.Append(req.State.GetAttribute(ctx, path.Root("oidc_federation"), &stateOIDCFederation)...)
+	resp.Diagnostics.Append(req.State.GetAttribute(ctx, path.Root("gcp_application_identity"), &stateGCPOutput)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	if stateGCPOutput != nil && (planOIDCFederation == nil) != (stateOIDCFederation == nil) {
+		resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("gcp_application_identity").AtName("workload_identity_provider"), types.String{Unknown: true})...)
+	}
+
+	// the Kubernetes outputs only follow the Kubernetes service accounts and the workload
+	kubernetesChanged := !reflect.DeepEqual(planPodIdentity, statePodIdentity)
+	for _, kubernetesPath := range []path.Path{
+		path.Root("aws_configuration").AtName("kubernetes"),
+		path.Root("azure_configuration").AtName("kubernetes"),
+		path.Root("gcp_configuration").AtName("kubernetes"),
+	} {
+		var planKubernetes, stateKubernetes types.Set
+		resp.Diagnostics.Append(req.Plan.GetAttribute(ctx, kubernetesPath, &planKubernetes)...)
+		resp.Diagnostics.Append(req.State.GetAttribute(ctx, kubernetesPath, &stateKubernetes)...)
+		kubernetesChanged = kubernetesChanged || !planKubernetes.Equal(stateKubernetes)
+	}
+	var planWorkload, stateWorkload types.String
+	resp.Diagnostics.Append(req.Plan.GetAttribute(ctx, path.Root("workload"), &planWorkload)...)
+	resp.Diagnostics.Append(req.State.GetAttribute(ctx, path.Root("workload"), &stateWorkload)...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	if kubernetesChanged || !planWorkload.Equal(stateWorkload) {
+		resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("kubernetes_service_account_annotations"), types.Map{ElemType: types.StringType, Unknown: true})...)
+		resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("kubernetes_pod_labels"), types.Map{ElemType: types.StringType, Unknown: true})...)
+		resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, path.Root("kubernetes_service_account_manifest"), types.String{Unknown: true})...)
+	}
+
+	// a generated trust policy changed outside of Terraform is only read into the computed assume_role_policy, so plan
+	// it back. Changed inputs already leave it unknown, and may depend on resources that don't exist yet.
+	if !r.provider.Configured || kubernetesChanged || !planWorkload.Equal(stateWorkload) || !reflect.DeepEqual(planOIDCFederation, stateOIDCFederation) {
+		return
+	}
+	var data mdxc.ApplicationIdentityData
+	var stateAssumeRolePolicy types.String
+	assumeRolePolicyPath := path.Root("aws_configuration").AtName("assume_role_policy")
+	resp.Diagnostics.Append(req.Plan.GetAttribute(ctx, path.Root("name"), &data.Name)...)
+	resp.Diagnostics.Append(req.Plan.GetAttribute(ctx, path.Root("aws_configuration"), &data.AWSInput)...)
+	resp.Diagnostics.Append(req.State.GetAttribute(ctx, assumeRolePolicyPath, &stateAssumeRolePolicy)...)
+	if resp.Diagnostics.HasError() || data.AWSInput == nil {
+		return
+	}
+
+	data.Workload = planWorkload
+	data.OIDCFederation = planOIDCFederation
+	data.AWSInput.AssumeRolePolicy = stateAssumeRolePolicy
+	resp.Diagnostics.Append(r.provider.Client.PlanApplicationIdentity(ctx, &data)...)
+	if !resp.Diagnostics.HasError() && !data.AWSInput.AssumeRolePolicy.Equal(stateAssumeRolePolicy) {
+		resp.Diagnostics.Append(resp.Plan.SetAttribute(ctx, assumeRolePolicyPath, data.AWSInput.AssumeRolePolicy)...)
+	}
+}
+
+// applicationIdentitySchemaV0 is the schema of version 0, when the Azure and GCP kubernetes attributes were single objects.
+// It only needs the types to read old state.
+func applicationIdentitySchemaV0() tfsdk.Schema {
+	optionalString := tfsdk.Attribute{Type: types.StringType, Optional: true}
+	computedString := tfsdk.Attribute{Type: types.StringType, Computed: true}
+	computedMap := tfsdk.Attribute{Type: types.MapType{ElemType: types.StringType}, Computed: true}
+
+	return tfsdk.Schema{
+		Attributes: map[string]tfsdk.Attribute{
+			"id":                                     computedString,
+			"name":                                   {Type: types.StringType, Required: true},
+			"cloud":                                  computedString,
+			"principal":                              computedString,
+			"principal_type":                         computedString,
+			"force_detach_on_destroy":                {Type: types.BoolType, Optional: true},
+			"workload":                               optionalString,
+			"kubernetes_service_account_annotations": computedMap,
+			"kubernetes_pod_labels":                  computedMap,
+			"kubernetes_service_account_manifest":    computedString,
+			"oidc_federation": {
+				Optional: true,
+				Attributes: tfsdk.SingleNestedAttributes(map[string]tfsdk.Attribute{
+					"issuer":   optionalString,
+					"audience": optionalString,
+					"subject":  optionalString,
+				}),
+			},
+			"aws_configuration": {
+				Optional: true,
+				Attributes: tfsdk.SingleNestedAttributes(map[string]tfsdk.Attribute{
+					"assume_role_policy":   {Type: types.StringType, Optional: true, Computed: true},
+					"path":                 {Type: types.StringType, Optional: true, Computed: true},
+					"description":          optionalString,
+					"max_session_duration": {Type: types.Int64Type, Optional: true, Computed: true},
+					"permissions_boundary": optionalString,
+					"tags":                 {Type: types.MapType{ElemType: types.StringType}, Optional: true},
+					"kubernetes": {
+						Optional: true,
+						Attributes: tfsdk.SetNestedAttributes(map[string]tfsdk.Attribute{
+							"oidc_provider_arn":    optionalString,
+							"namespace":            optionalString,
+							"service_account_name": optionalString,
+						}),
+					},
+					"pod_identity": {
+						Optional: true,
+						Attributes: tfsdk.SingleNestedAttributes(map[string]tfsdk.Attribute{
+							"cluster_name":         optionalString,
+							"namespace":            optionalString,
+							"service_account_name": optionalString,
+						}),
+					},
+					"create_instance_profile": {Type: types.BoolType, Optional: true},
+				}),
+			},
+			"azure_configuration": {
+				Optional: true,
+				Attributes: tfsdk.SingleNestedAttributes(map[string]tfsdk.Attribute{
+					"location":            optionalString,
+					"resource_group_name": optionalString,
+					"kubernetes": {
+						Optional: true,
+						Attributes: tfsdk.SingleNestedAttributes(map[string]tfsdk.Attribute{
+							"namespace":            optionalString,
+							"service_account_name": optionalString,
+							"oidc_issuer_url":      optionalString,
+							"audiences":            {Type: types.ListType{ElemType: types.StringType}, Optional: true},
+						}),
+					},
+				}),
+			},
+			"gcp_configuration": {
+				Optional: true,
+				Attributes: tfsdk.SingleNestedAttributes(map[string]tfsdk.Attribute{
+					"kubernetes": {
+						Optional: true,
+						Attributes: tfsdk.SingleNestedAttributes(map[string]tfsdk.Attribute{
+							"namespace":              optionalString,
+							"service_account_name":   optionalString,
+							"workload_identity_pool": optionalString,
+						}),
+					},
+				}),
+			},
+			"aws_application_identity": {
+				Computed: true,
+				Attributes: tfsdk.SingleNestedAttributes(map[string]tfsdk.Attribute{
+					"iam_role_arn":                 computedString,
+					"pod_identity_association_arn": computedString,
+					"instance_profile_arn":         computedString,
+				}),
+			},
+			"azure_application_identity": {
+				Computed: true,
+				Attributes: tfsdk.SingleNestedAttributes(map[string]tfsdk.Attribute{
+					"client_id":   computedString,
+					"tenant_id":   computedString,
+					"resource_id": computedString,
+				}),
+			},
+			"gcp_application_identity": {
+				Computed: true,
+				Attributes: tfsdk.SingleNestedAttributes(map[string]tfsdk.Attribute{
+					"service_account_email":      computedString,
+					"unique_id":                  computedString,
+					"workload_identity_provider": computedString,
+				}),
+			},
+		},
+	}
+}
+
+func (r ResourceApplicationIdentity) UpgradeState(ctx context.Context) map[int64]resource.StateUpgrader {
+	schemaV0 := applicationIdentitySchemaV0()
+	return map[int64]resource.StateUpgrader{
+		0: {
+			PriorSchema: &schemaV0,
+			StateUpgrader: func(ctx context.Context, req resource.UpgradeStateRequest, resp *resource.UpgradeStateResponse) {
+				var prior mdxc.ApplicationIdentityDataV0
+
+				diags := req.State.Get(ctx, &prior)
+				resp.Diagnostics.Append(diags...)
+				if resp.Diagnostics.HasError() {
+					return
+				}
+
+				var data mdxc.ApplicationIdentityData
+				mdxc.UpgradeApplicationIdentityV0(&prior, &data)
+
+				diags = resp.State.Set(ctx, &data)
+				resp.Diagnostics.Append(diags...)
+			},
+		},
+	}
+}
+
+// ImportState accepts an IAM role name or ARN on AWS, a service account email or
+// projects/{project}/serviceAccounts/{email} on GCP, and a user-assigned identity resource ID on Azure
 func (r ResourceApplicationIdentity) ImportState(ctx context.Context, req resource.ImportStateRequest, resp *resource.ImportStateResponse) {
-	resource.ImportStatePassthroughID(ctx, path.Root("id"), req, resp)
+	var data mdxc.ApplicationIdentityData
+
+	diags := r.provider.Client.ImportApplicationIdentity(ctx, req.ID, &data)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	diags = resp.State.Set(ctx, &data)
+	resp.Diagnostics.Append(diags...)
 }
@@ -2,9 +2,12 @@ package provider
 
 import (
 	"context"
+	"fmt"
 	"terraform-provider-mdxc/internal/mdxc"
+	"terraform-provider-mdxc/internal/verify"
 
 	"github.com/hashicorp/terraform-plugin-framework-validators/schemavalidator"
+	"github.com/hashicorp/terraform-plugin-framework-validators/stringvalidator"
 	"github.com/hashicorp/terraform-plugin-framework/diag"
 	"github.com/hashicorp/terraform-plugin-framework/path"
 	"github.com/hashicorp/terraform-plugin-framework/provider"
@@ -18,17 +21,20 @@ import (
 var _ provider.ResourceType = ResourceApplicationPermissionType{}
 var _ resource.Resource = ResourceApplicationPermission{}
 var _ resource.ResourceWithImportState = ResourceApplicationPermission{}
+var _ resource.ResourceWithUpgradeState = ResourceApplicationPermission{}
 
 type ResourceApplicationPermissionType struct{}
 
 func (t ResourceApplicationPermissionType) GetSchema(ctx context.Context) (tfsdk.Schema, diag.Diagnostics) {
 	return tfsdk.Schema{
 		MarkdownDescription: "A cross-cloud application Permission resource (AWS IAM Role, GCP Service Account, Azure Application)",
+		// Version 1 adds the condition hash to GCP IDs, version 2 replaces the condition expression with a block
+		Version: 2,
 
 		Attributes: map[string]tfsdk.Attribute{
 			"id": {
 				Computed:            true,
-				MarkdownDescription: "Cloud specific identifier of the application Permission",
+				MarkdownDescription: "Cloud specific identifier of the application Permission: `{role_arn}#{policy_arn}` on AWS, `{service_account_email}-{role}` on GCP, prefixed with `{scope}/` for bindings on a resource and followed by `#{condition_hash}` for conditional bindings, the role assignment ID on Azure",
 				PlanModifiers: tfsdk.AttributePlanModifiers{
 					resource.UseStateForUnknown(),
 				},
@@ -72,9 +78,9 @@ func (t ResourceApplicationPermissionType) GetSchema(ctx context.Context) (tfsdk
 						},
 					},
 					"scope": {
-						Type:        types.StringType,
-						Optional:    true,
-						Description: "The scope at which the Azure Role Assignment applies to",
+						Type:                types.StringType,
+						Optional:            true,
+						MarkdownDescription: "The scope at which the Azure Role Assignment applies to. On GCP the organization, folder or resource to bind the role on instead of the project: `organizations/{organization_id}`, `folders/{folder_id}`, `projects/_/buckets/{bucket}`, `projects/{project}/topics/{topic}`, `projects/{project}/subscriptions/{subscription}`, `projects/{project}/secrets/{secret}`, `projects/{project}/datasets/{dataset}`, `projects/{project}/locations/{location}/keyRings/{key_ring}/cryptoKeys/{key}` or `projects/{project}/locations/{location}/repositories/{repository}`",
 						PlanModifiers: tfsdk.AttributePlanModifiers{
 							resource.RequiresReplace(),
 						},
@@ -82,7 +88,6 @@ func (t ResourceApplicationPermissionType) GetSchema(ctx context.Context) (tfsdk
 						Validators: []tfsdk.AttributeValidator{
 							schemavalidator.ConflictsWith(
 								path.MatchRelative().AtParent().AtName("policy_arn"),
-								path.MatchRelative().AtParent().AtName("condition"),
 							),
 							schemavalidator.AlsoRequires(
 								path.MatchRelative().AtParent().AtName("role"),
@@ -90,21 +95,56 @@ func (t ResourceApplicationPermissionType) GetSchema(ctx context.Context) (tfsdk
 						},
 					},
 					"condition": {
-						Type:        types.StringType,
 						Optional:    true,
-						Description: "An GCP IAM Condition for a given role binding",
+						Description: "A GCP IAM Condition for a given role binding",
 						PlanModifiers: tfsdk.AttributePlanModifiers{
 							resource.RequiresReplace(),
 						},
 						Validators: []tfsdk.AttributeValidator{
 							schemavalidator.ConflictsWith(
 								path.MatchRelative().AtParent().AtName("policy_arn"),
-								path.MatchRelative().AtParent().AtName("scope"),
 							),
 							schemavalidator.AlsoRequires(
 								path.MatchRelative().AtParent().AtName("role"),
 							),
 						},
+						Attributes: tfsdk.SingleNestedAttributes(map[string]tfsdk.Attribute{
+							"expression": {
+								Type:                types.StringType,
+								Required:            true,
+								MarkdownDescription: "The [CEL](https://cloud.google.com/iam/docs/conditions-overview#cel) expression the request has to satisfy",
+								PlanModifiers: tfsdk.AttributePlanModifiers{
+									resource.RequiresReplace(),
+								},
+								Validators: []tfsdk.AttributeValidator{
+									verify.ValidCELExpression(),
+								},
+							},
+							"title": {
+								Type:        types.StringType,
+								Optional:    true,
+								Computed:    true,
+								Description: "A title for the condition. Null for conditions created before the condition block, which had none",
+								PlanModifiers: tfsdk.AttributePlanModifiers{
+									resource.UseStateForUnknown(),
+									resource.RequiresReplace(),
+								},
+								Validators: []tfsdk.AttributeValidator{
+									stringvalidator.LengthAtLeast(1),
+								},
+							},
+							"description": {
+								Type:        types.StringType,
+								Optional:    true,
+								Description: "A description of the condition",
+								PlanModifiers: tfsdk.AttributePlanModifiers{
+									resource.RequiresReplace(),
+								},
+								Validators: []tfsdk.AttributeValidator{
+									stringvalidator.LengthAtLeast(1),
+								},
+							},
+						}),
 					},
 				}),
 			},
@@ -152,11 +192,20 @@ func (r ResourceApplicationPermission) Read(ctx context.Context, req resource.Re
 		return
 	}
 
+	id := data.Id.Value
 	diags = r.provider.Client.ReadApplicationPermission(ctx, &data)
 	resp.Diagnostics.Append(diags...)
 	if resp.Diagnostics.HasError() {
 		return
 	}
+	if data.Id.Null {
+		resp.Diagnostics.AddWarning(
+			"Application permission not found",
+			fmt.Sprintf("%s was deleted outside of Terraform and is removed from the state, the next apply recreates it", id),
+		)
+		resp.State.RemoveResource(ctx)
+		return
+	}
 
 	diags = resp.State.Set(ctx, &data)
 	resp.Diagnostics.Append(diags...)
@@ -200,6 +249,68 @@ func (r ResourceApplicationPermission) Delete(ctx context.Context, req resource.
 	resp.Diagnostics.Append(diags...)
 }
 
+// applicationPermissionSchemaV0 is the schema of versions 0 and 1, when the condition was an expression string.
+// It only needs the types to read old state.
+func applicationPermissionSchemaV0() tfsdk.Schema {
+	return tfsdk.Schema{
+		Attributes: map[string]tfsdk.Attribute{
+			"id": {
+				Type:     types.StringType,
+				Computed: true,
+			},
+			"application_identity_id": {
+				Type:     types.StringType,
+				Required: true,
+			},
+			"permission": {
+				Required: true,
+				Attributes: tfsdk.SingleNestedAttributes(map[string]tfsdk.Attribute{
+					"policy_arn": {Type: types.StringType, Optional: true},
+					"role":       {Type: types.StringType, Optional: true},
+					"scope":      {Type: types.StringType, Optional: true},
+					"condition":  {Type: types.StringType, Optional: true},
+				}),
+			},
+		},
+	}
+}
+
+func (r ResourceApplicationPermission) UpgradeState(ctx context.Context) map[int64]resource.StateUpgrader {
+	schemaV0 := applicationPermissionSchemaV0()
+	upgrader := resource.StateUpgrader{
+		PriorSchema: &schemaV0,
+		StateUpgrader: func(ctx context.Context, req resource.UpgradeStateRequest, resp *resource.UpgradeStateResponse) {
+			var prior mdxc.ApplicationPermissionDataV0
+
+			diags := req.State.Get(ctx, &prior)
+			resp.Diagnostics.Append(diags...)
+			if resp.Diagnostics.HasError() {
+				return
+			}
+
+			var data mdxc.ApplicationPermissionData
+			r.provider.Client.UpgradeApplicationPermissionV0(ctx, &prior, &data)
+
+			diags = resp.State.Set(ctx, &data)
+			resp.Diagnostics.Append(diags...)
+		},
+	}
+	return map[int64]resource.StateUpgrader{
+		0: upgrader,
+		1: upgrader,
+	}
+}
+
+// ImportState accepts roleArn#policyArn on AWS, [{scope}/]{service_account_email}-{role}[#{condition_hash}] on GCP and the role assignment ID on Azure
 func (r ResourceApplicationPermission) ImportState(ctx context.Context, req resource.ImportStateRequest, resp *resource.ImportStateResponse) {
-	resource.ImportStatePassthroughID(ctx, path.Root("id"), req, resp)
+	var data mdxc.ApplicationPermissionData
+
+	diags := r.provider.Client.ImportApplicationPermission(ctx, req.ID, &data)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	diags = resp.State.Set(ctx, &data)
+	resp.Diagnostics.Append(diags...)
 }
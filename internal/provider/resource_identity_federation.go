@@ -0,0 +1,221 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"terraform-provider-mdxc/internal/mdxc"
+
+	"github.com/hashicorp/terraform-plugin-framework-validators/schemavalidator"
+	"github.com/hashicorp/terraform-plugin-framework-validators/stringvalidator"
+	"github.com/hashicorp/terraform-plugin-framework/diag"
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/provider"
+	"github.com/hashicorp/terraform-plugin-framework/resource"
+	"github.com/hashicorp/terraform-plugin-framework/tfsdk"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-log/tflog"
+)
+
+// Ensure provider defined types fully satisfy framework interfaces
+var _ provider.ResourceType = ResourceIdentityFederationType{}
+var _ resource.Resource = ResourceIdentityFederation{}
+
+type ResourceIdentityFederationType struct{}
+
+func (t ResourceIdentityFederationType) GetSchema(ctx context.Context) (tfsdk.Schema, diag.Diagnostics) {
+	return tfsdk.Schema{
+		MarkdownDescription: "Lets an application identity of another cloud assume an application identity of the provider's cloud with short-lived OIDC tokens instead of long-lived keys: a GCP service account or Azure managed identity assumes an AWS IAM role through web identity federation, an AWS role or Azure managed identity impersonates a GCP service account through a workload identity pool, or an AWS role or GCP service account uses an Azure managed identity through a federated identity credential. Every change replaces the federation",
+
+		Attributes: map[string]tfsdk.Attribute{
+			"id": {
+				Computed:            true,
+				MarkdownDescription: "Cloud specific identifier of the federation: the trust policy statement on AWS, the workload identity pool provider on GCP, the federated identity credential on Azure",
+				PlanModifiers: tfsdk.AttributePlanModifiers{
+					resource.UseStateForUnknown(),
+				},
+				Type: types.StringType,
+			},
+			"target_identity": {
+				Type:                types.StringType,
+				MarkdownDescription: "The identity of the provider's cloud to assume: the AWS IAM role ARN, the GCP service account email or the Azure managed identity resource ID",
+				Required:            true,
+				PlanModifiers: tfsdk.AttributePlanModifiers{
+					resource.RequiresReplace(),
+				},
+			},
+			"source": {
+				Required:    true,
+				Description: "The identity of the other cloud",
+				PlanModifiers: tfsdk.AttributePlanModifiers{
+					resource.RequiresReplace(),
+				},
+				Attributes: tfsdk.SingleNestedAttributes(map[string]tfsdk.Attribute{
+					"cloud": {
+						Type:        types.StringType,
+						Description: "The cloud of the identity, one of aws, azure or gcp. Must differ from the provider's cloud",
+						Required:    true,
+						Validators: []tfsdk.AttributeValidator{
+							stringvalidator.OneOf("aws", "azure", "gcp"),
+						},
+					},
+					"gcp_service_account_unique_id": {
+						Type:        types.StringType,
+						Description: "Unique ID of the GCP service account, the subject of its identity tokens",
+						Optional:    true,
+						Validators: []tfsdk.AttributeValidator{
+							schemavalidator.ConflictsWith(
+								path.MatchRelative().AtParent().AtName("azure_principal_id"),
+								path.MatchRelative().AtParent().AtName("aws_role_arn"),
+							),
+						},
+					},
+					"azure_tenant_id": {
+						Type:        types.StringType,
+						Description: "Tenant of the Azure managed identity, which issues its tokens",
+						Optional:    true,
+						Validators: []tfsdk.AttributeValidator{
+							schemavalidator.AlsoRequires(
+								path.MatchRelative().AtParent().AtName("azure_principal_id"),
+							),
+						},
+					},
+					"azure_principal_id": {
+						Type:        types.StringType,
+						Description: "Principal ID of the Azure managed identity, the subject of its tokens",
+						Optional:    true,
+						Validators: []tfsdk.AttributeValidator{
+							schemavalidator.AlsoRequires(
+								path.MatchRelative().AtParent().AtName("azure_tenant_id"),
+							),
+							schemavalidator.ConflictsWith(
+								path.MatchRelative().AtParent().AtName("aws_role_arn"),
+							),
+						},
+					},
+					"aws_role_arn": {
+						Type:        types.StringType,
+						Description: "ARN of the AWS IAM role, the subject of its outbound web identity tokens",
+						Optional:    true,
+						Validators: []tfsdk.AttributeValidator{
+							schemavalidator.AlsoRequires(
+								path.MatchRelative().AtParent().AtName("aws_token_issuer"),
+							),
+						},
+					},
+					"aws_token_issuer": {
+						Type:        types.StringType,
+						Description: "Issuer URL of the AWS account's outbound web identity tokens",
+						Optional:    true,
+						Validators: []tfsdk.AttributeValidator{
+							schemavalidator.AlsoRequires(
+								path.MatchRelative().AtParent().AtName("aws_role_arn"),
+							),
+						},
+					},
+				}),
+			},
+			"audience": {
+				Type:                types.StringType,
+				MarkdownDescription: "The audience the source identity requests its token for. Defaults to `sts.amazonaws.com` on AWS, the workload identity pool provider on GCP and `api://AzureADTokenExchange` on Azure",
+				Optional:            true,
+				Computed:            true,
+				PlanModifiers: tfsdk.AttributePlanModifiers{
+					resource.UseStateForUnknown(),
+					resource.RequiresReplace(),
+				},
+			},
+		},
+	}, nil
+}
+
+func (t ResourceIdentityFederationType) NewResource(ctx context.Context, in provider.Provider) (resource.Resource, diag.Diagnostics) {
+	return ResourceIdentityFederation{
+		provider: *(in.(*MDXCProvider)),
+	}, diag.Diagnostics{}
+}
+
+type ResourceIdentityFederation struct {
+	provider MDXCProvider
+}
+
+func (r ResourceIdentityFederation) Create(ctx context.Context, req resource.CreateRequest, resp *resource.CreateResponse) {
+	var data mdxc.IdentityFederationData
+
+	diags := req.Plan.Get(ctx, &data)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	diags = r.provider.Client.CreateIdentityFederation(ctx, &data)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	tflog.Trace(ctx, "created identity federation")
+
+	diags = resp.State.Set(ctx, &data)
+	resp.Diagnostics.Append(diags...)
+}
+
+func (r ResourceIdentityFederation) Read(ctx context.Context, req resource.ReadRequest, resp *resource.ReadResponse) {
+	var data mdxc.IdentityFederationData
+
+	diags := req.State.Get(ctx, &data)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	id := data.Id.Value
+	diags = r.provider.Client.ReadIdentityFederation(ctx, &data)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	if data.Id.Null {
+		resp.Diagnostics.AddWarning(
+			"Identity federation not found",
+			fmt.Sprintf("%s was deleted outside of Terraform and is removed from the state, the next apply recreates it", id),
+		)
+		resp.State.RemoveResource(ctx)
+		return
+	}
+
+	diags = resp.State.Set(ctx, &data)
+	resp.Diagnostics.Append(diags...)
+}
+
+// Update only runs when nothing changed, every attribute requires replacement
+func (r ResourceIdentityFederation) Update(ctx context.Context, req resource.UpdateRequest, resp *resource.UpdateResponse) {
+	var data mdxc.IdentityFederationData
+
+	diags := req.Plan.Get(ctx, &data)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	diags = resp.State.Set(ctx, &data)
+	resp.Diagnostics.Append(diags...)
+}
+
+func (r ResourceIdentityFederation) Delete(ctx context.Context, req resource.DeleteRequest, resp *resource.DeleteResponse) {
+	var data mdxc.IdentityFederationData
+
+	diags := req.State.Get(ctx, &data)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	diags = r.provider.Client.DeleteIdentityFederation(ctx, &data)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	diags = resp.State.Set(ctx, &data)
+	resp.Diagnostics.Append(diags...)
+}
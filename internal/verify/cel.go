@@ -0,0 +1,44 @@
+package verify
+
+import (
+	"context"
+
+	"github.com/google/cel-go/common"
+	"github.com/google/cel-go/parser"
+	"github.com/hashicorp/terraform-plugin-framework/tfsdk"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+// ValidCELExpression returns a validator that parses the attribute as a Common Expression Language expression,
+// so syntax errors in IAM conditions are reported at plan time instead of by the IAM API on apply.
+// Only the syntax is checked: the attributes available to a condition depend on the resource it is evaluated against.
+func ValidCELExpression() tfsdk.AttributeValidator {
+	return validCELExpressionValidator{}
+}
+
+type validCELExpressionValidator struct{}
+
+func (v validCELExpressionValidator) Description(ctx context.Context) string {
+	return "Value must be a valid CEL expression."
+}
+
+func (v validCELExpressionValidator) MarkdownDescription(ctx context.Context) string {
+	return v.Description(ctx)
+}
+
+func (v validCELExpressionValidator) Validate(ctx context.Context, req tfsdk.ValidateAttributeRequest, resp *tfsdk.ValidateAttributeResponse) {
+	var expression types.String
+	diags := tfsdk.ValueAs(ctx, req.AttributeConfig, &expression)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+
+	if expression.Null || expression.Unknown {
+		return
+	}
+
+	if _, errs := parser.Parse(common.NewTextSource(expression.Value)); len(errs.GetErrors()) > 0 {
+		resp.Diagnostics.AddAttributeError(req.AttributePath, "Invalid CEL expression", errs.ToDisplayString())
+	}
+}
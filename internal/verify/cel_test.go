@@ -0,0 +1,54 @@
+package verify_test
+
+import (
+	"context"
+	"terraform-provider-mdxc/internal/verify"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-framework/path"
+	"github.com/hashicorp/terraform-plugin-framework/tfsdk"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+func TestValidCELExpression(t *testing.T) {
+	tests := []struct {
+		name       string
+		expression types.String
+		wantError  bool
+	}{
+		{
+			name:       "valid",
+			expression: types.String{Value: `resource.name.startsWith("projects/test-project/locations/us-central1/instances/test-instance") && request.time < timestamp("2030-01-01T00:00:00Z")`},
+		},
+		{
+			name:       "unbalanced parentheses",
+			expression: types.String{Value: `resource.name.startsWith("projects/test-project"`},
+			wantError:  true,
+		},
+		{
+			name:       "unterminated string",
+			expression: types.String{Value: `resource.type == "redis.googleapis.com/Instance`},
+			wantError:  true,
+		},
+		{
+			name:       "unknown",
+			expression: types.String{Unknown: true},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := tfsdk.ValidateAttributeRequest{
+				AttributePath:   path.Root("expression"),
+				AttributeConfig: tc.expression,
+			}
+			resp := &tfsdk.ValidateAttributeResponse{}
+
+			verify.ValidCELExpression().Validate(context.Background(), req, resp)
+
+			if resp.Diagnostics.HasError() != tc.wantError {
+				t.Errorf("expected error %v, got %v", tc.wantError, resp.Diagnostics)
+			}
+		})
+	}
+}
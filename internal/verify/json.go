@@ -1,26 +1,61 @@
 package verify
 
 import (
+	"context"
+	"fmt"
 	"strings"
 
 	awspolicy "github.com/hashicorp/awspolicyequivalence"
-	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/schema"
+	"github.com/hashicorp/terraform-plugin-framework/tfsdk"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+	"github.com/hashicorp/terraform-plugin-sdk/v2/helper/structure"
 )
 
-func SuppressEquivalentPolicyDiffs(k, old, new string, d *schema.ResourceData) bool {
-	if strings.TrimSpace(old) == "" && strings.TrimSpace(new) == "" {
-		return true
+// SuppressEquivalentPolicyDiffs returns a plan modifier that keeps the prior state value
+// of a JSON policy attribute when the configured policy is semantically equivalent to it,
+// e.g. statements reordered, single element arrays written as strings, or whitespace changes.
+func SuppressEquivalentPolicyDiffs() tfsdk.AttributePlanModifier {
+	return suppressEquivalentPolicyDiffsModifier{}
+}
+
+type suppressEquivalentPolicyDiffsModifier struct{}
+
+func (m suppressEquivalentPolicyDiffsModifier) Description(ctx context.Context) string {
+	return "Ignores changes to the policy that do not change its meaning."
+}
+
+func (m suppressEquivalentPolicyDiffsModifier) MarkdownDescription(ctx context.Context) string {
+	return m.Description(ctx)
+}
+
+func (m suppressEquivalentPolicyDiffsModifier) Modify(ctx context.Context, req tfsdk.ModifyAttributePlanRequest, resp *tfsdk.ModifyAttributePlanResponse) {
+	if req.AttributeState == nil || resp.AttributePlan == nil {
+		return
 	}
 
-	if strings.TrimSpace(old) == "{}" && strings.TrimSpace(new) == "" {
-		return true
+	// nothing to compare against on create, and unknown values can't be compared yet
+	if req.AttributeState.IsNull() || resp.AttributePlan.IsNull() || resp.AttributePlan.IsUnknown() {
+		return
 	}
 
-	if strings.TrimSpace(old) == "" && strings.TrimSpace(new) == "{}" {
-		return true
+	var state, plan types.String
+	diags := tfsdk.ValueAs(ctx, req.AttributeState, &state)
+	resp.Diagnostics.Append(diags...)
+	diags = tfsdk.ValueAs(ctx, resp.AttributePlan, &plan)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
 	}
 
-	if strings.TrimSpace(old) == "{}" && strings.TrimSpace(new) == "{}" {
+	if PoliciesAreEquivalent(state.Value, plan.Value) {
+		resp.AttributePlan = req.AttributeState
+	}
+}
+
+// PoliciesAreEquivalent reports whether two IAM policy documents grant the same permissions.
+// Empty and "{}" policies are considered equivalent to each other.
+func PoliciesAreEquivalent(old, new string) bool {
+	if isEmptyPolicy(old) && isEmptyPolicy(new) {
 		return true
 	}
 
@@ -31,3 +66,33 @@ func SuppressEquivalentPolicyDiffs(k, old, new string, d *schema.ResourceData) b
 
 	return equivalent
 }
+
+func isEmptyPolicy(policy string) bool {
+	trimmed := strings.TrimSpace(policy)
+	return trimmed == "" || trimmed == "{}"
+}
+
+// PolicyToSet returns the existing policy if the new policy is equivalent to it,
+// otherwise the normalized new policy. This keeps the user's formatting in state
+// while still surfacing real changes made outside of Terraform.
+func PolicyToSet(exist, new string) (string, error) {
+	policyToSet, err := structure.NormalizeJsonString(new)
+	if err != nil {
+		return "", fmt.Errorf("policy (%s) is invalid JSON: %w", new, err)
+	}
+
+	if strings.TrimSpace(exist) == "" {
+		return policyToSet, nil
+	}
+
+	equivalent, err := awspolicy.PoliciesAreEquivalent(exist, policyToSet)
+	if err != nil {
+		return "", err
+	}
+
+	if equivalent {
+		return exist, nil
+	}
+
+	return policyToSet, nil
+}
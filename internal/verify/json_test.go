@@ -0,0 +1,54 @@
+package verify_test
+
+import (
+	"context"
+	"terraform-provider-mdxc/internal/verify"
+	"testing"
+
+	"github.com/hashicorp/terraform-plugin-framework/tfsdk"
+	"github.com/hashicorp/terraform-plugin-framework/types"
+)
+
+func TestSuppressEquivalentPolicyDiffs(t *testing.T) {
+	state := `{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Principal":{"Service":["lambda.amazonaws.com"]},"Action":"sts:AssumeRole"}]}`
+
+	tests := []struct {
+		name string
+		plan string
+		want string
+	}{
+		{
+			name: "equivalent",
+			plan: `{"Statement": [{"Action": ["sts:AssumeRole"], "Effect": "Allow", "Principal": {"Service": "lambda.amazonaws.com"}}], "Version": "2012-10-17"}`,
+			want: state,
+		},
+		{
+			name: "different",
+			plan: `{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Principal":{"Service":"ec2.amazonaws.com"},"Action":"sts:AssumeRole"}]}`,
+			want: `{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Principal":{"Service":"ec2.amazonaws.com"},"Action":"sts:AssumeRole"}]}`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := tfsdk.ModifyAttributePlanRequest{
+				AttributeConfig: types.String{Value: tc.plan},
+				AttributeState:  types.String{Value: state},
+				AttributePlan:   types.String{Value: tc.plan},
+			}
+			resp := &tfsdk.ModifyAttributePlanResponse{
+				AttributePlan: req.AttributePlan,
+			}
+
+			verify.SuppressEquivalentPolicyDiffs().Modify(context.Background(), req, resp)
+			if resp.Diagnostics.HasError() {
+				t.Fatalf("unexpected diagnostics: %v", resp.Diagnostics)
+			}
+
+			got := resp.AttributePlan.(types.String).Value
+			if got != tc.want {
+				t.Errorf("expect %v, got %v", tc.want, got)
+			}
+		})
+	}
+}